@@ -0,0 +1,10 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package carddav provides a CardDAV server for a bmagent user's address
+// book, so that mail clients can auto-complete Bitmessage addresses. Each
+// contact is served as a vCard whose e-mail address is the contact's
+// Bitmessage address in the form BM-...@bm.addr. Contacts which are created,
+// edited or deleted through the server are written back to the address book.
+package carddav
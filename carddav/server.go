@@ -0,0 +1,723 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package carddav
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+const (
+	nsDAV     = "DAV:"
+	nsCardDAV = "urn:ietf:params:xml:ns:carddav"
+	nsCS      = "http://calendarserver.org/ns/"
+
+	// homePath is the path of the principal, which is also the home of the
+	// address book.
+	homePath = "/"
+
+	// addressBookPath is the path of the address book collection.
+	addressBookPath = "/contacts/"
+
+	// cardExt is the extension of the paths of vCards.
+	cardExt = ".vcf"
+
+	vcardType = "text/vcard; charset=utf-8"
+
+	// maxCardSize is the largest vCard that can be uploaded.
+	maxCardSize = 1 << 20
+)
+
+// Contacts is the address book which is served. It is implemented by
+// store.Contacts.
+type Contacts interface {
+	// ForEach runs the specified function for each contact.
+	ForEach(f func(address string, contact *store.Contact) error) error
+
+	// Get returns the contact with the given address or store.ErrNotFound.
+	Get(address string) (*store.Contact, error)
+
+	// AddCard adds an address to the address book with the given label
+	// and saves the name of its vCard.
+	AddCard(address, label, card string) error
+
+	// Remove removes an address from the address book or returns
+	// store.ErrNotFound.
+	Remove(address string) error
+}
+
+// Config is the configuration of the CardDAV server.
+type Config struct {
+	// Username and Password are required of clients. Authentication is not
+	// required if Username is empty.
+	Username string
+	Password string
+}
+
+// Server is a CardDAV server which serves a single address book.
+type Server struct {
+	cfg      *Config
+	contacts Contacts
+}
+
+// NewServer creates a new CardDAV server for the given address book.
+func NewServer(cfg *Config, contacts Contacts) *Server {
+	return &Server{
+		cfg:      cfg,
+		contacts: contacts,
+	}
+}
+
+// Serve accepts connections on the listener and serves CardDAV requests
+// until the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	return http.Serve(l, s)
+}
+
+// ServeHTTP checks that requests are authorized and dispatches them according
+// to their path.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.cfg.Username != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(s.cfg.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bmagent"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	log.Tracef("%s %s", req.Method, req.URL.Path)
+
+	path := req.URL.Path
+	switch {
+	case path == "/.well-known/carddav":
+		http.Redirect(w, req, homePath, http.StatusMovedPermanently)
+	case path == homePath:
+		s.serveHome(w, req)
+	case path == addressBookPath || path+"/" == addressBookPath:
+		s.serveAddressBook(w, req)
+	case strings.HasPrefix(path, addressBookPath) &&
+		!strings.Contains(path[len(addressBookPath):], "/"):
+		s.serveCard(w, req, path[len(addressBookPath):])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// serveHome handles requests for the principal.
+func (s *Server) serveHome(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "OPTIONS":
+		writeOptions(w)
+	case "PROPFIND":
+		query, err := parseQuery(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resources := []*resource{homeResource()}
+		if depth(req) > 0 {
+			book, err := s.addressBookResource()
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+			resources = append(resources, book)
+		}
+		writeMultistatus(w, query, resources)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// serveAddressBook handles requests for the address book collection.
+func (s *Server) serveAddressBook(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "OPTIONS":
+		writeOptions(w)
+	case "PROPFIND":
+		query, err := parseQuery(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		book, err := s.addressBookResource()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		resources := []*resource{book}
+		if depth(req) > 0 {
+			cards, err := s.cards()
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+			for _, c := range cards {
+				resources = append(resources, cardResource(c))
+			}
+		}
+		writeMultistatus(w, query, resources)
+	case "REPORT":
+		s.report(w, req)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// report handles the addressbook-query and addressbook-multiget reports.
+// Filters in queries are not supported, so all cards are returned.
+func (s *Server) report(w http.ResponseWriter, req *http.Request) {
+	query, err := parseQuery(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resources []*resource
+	switch query.root {
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-query"}:
+		cards, err := s.cards()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		for _, c := range cards {
+			resources = append(resources, cardResource(c))
+		}
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"}:
+		cards, err := s.cards()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		byName := make(map[string]*card)
+		for _, c := range cards {
+			byName[c.name] = c
+		}
+		for _, href := range query.hrefs {
+			// Some clients send absolute URLs.
+			path := href
+			if u, err := url.Parse(href); err == nil {
+				path = u.Path
+			}
+			c, ok := byName[strings.TrimPrefix(path, addressBookPath)]
+			if !ok {
+				resources = append(resources, &resource{
+					href:   href,
+					status: http.StatusNotFound,
+				})
+				continue
+			}
+			resources = append(resources, cardResource(c))
+		}
+	default:
+		http.Error(w, "Unsupported report", http.StatusForbidden)
+		return
+	}
+
+	writeMultistatus(w, query, resources)
+}
+
+// serveCard handles requests for a single vCard.
+func (s *Server) serveCard(w http.ResponseWriter, req *http.Request, name string) {
+	c, err := s.card(name)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+
+	switch req.Method {
+	case "OPTIONS":
+		writeOptions(w)
+	case "GET", "HEAD":
+		if c == nil {
+			http.NotFound(w, req)
+			return
+		}
+		data := c.encode()
+		w.Header().Set("Content-Type", vcardType)
+		w.Header().Set("ETag", etag(data))
+		if req.Method == "GET" {
+			w.Write(data)
+		}
+	case "PROPFIND":
+		if c == nil {
+			http.NotFound(w, req)
+			return
+		}
+		query, err := parseQuery(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeMultistatus(w, query, []*resource{cardResource(c)})
+	case "PUT":
+		s.put(w, req, name)
+	case "DELETE":
+		if c == nil {
+			http.NotFound(w, req)
+			return
+		}
+		if !checkPreconditions(req, c) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err := s.contacts.Remove(c.address); err != nil {
+			serverError(w, err)
+			return
+		}
+		log.Infof("Removed %s from the address book.", c.address)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// put saves a vCard uploaded with the given name. Cards may be given any
+// name, which is saved with the contact. If the card at that name had a
+// different address, the old contact is removed from the address book.
+func (s *Server) put(w http.ResponseWriter, req *http.Request, name string) {
+	if !strings.HasSuffix(name, cardExt) {
+		http.Error(w, "vCards must be saved as "+cardExt+" files", http.StatusForbidden)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxCardSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxCardSize {
+		http.Error(w, "vCard too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	c, err := decodeCard(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.name = name
+
+	existing, err := s.card(name)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	if !checkPreconditions(req, existing) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	// The address plays the part of the UID of the card, so it may only
+	// be in one card.
+	contact, err := s.contacts.Get(c.address)
+	if err != nil && err != store.ErrNotFound {
+		serverError(w, err)
+		return
+	}
+	if err == nil && contact.AddressBook {
+		if other := cardName(c.address, contact); other != name {
+			writeUIDConflict(w, addressBookPath+other)
+			return
+		}
+	}
+
+	if err := s.contacts.AddCard(c.address, c.label, name); err != nil {
+		serverError(w, err)
+		return
+	}
+	log.Infof("Saved %s in the address book as %s.", c.address, c.label)
+
+	if existing != nil && existing.address != c.address {
+		if err := s.contacts.Remove(existing.address); err != nil {
+			serverError(w, err)
+			return
+		}
+		log.Infof("Removed %s from the address book.", existing.address)
+	}
+
+	if existing == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// cardName returns the name of the vCard of a contact. Contacts which were
+// not saved through CardDAV are named after their addresses.
+func cardName(address string, contact *store.Contact) string {
+	if contact.Card != "" {
+		return contact.Card
+	}
+	return address + cardExt
+}
+
+// card returns the card with the given name, or nil if there is no such
+// contact in the address book.
+func (s *Server) card(name string) (*card, error) {
+	if !strings.HasSuffix(name, cardExt) {
+		return nil, nil
+	}
+
+	cards, err := s.cards()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cards {
+		if c.name == name {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// cards returns all the cards in the address book, sorted by address.
+func (s *Server) cards() ([]*card, error) {
+	var cards []*card
+	err := s.contacts.ForEach(func(address string, contact *store.Contact) error {
+		if contact.AddressBook {
+			cards = append(cards, &card{
+				address: address,
+				label:   contact.Label,
+				name:    cardName(address, contact),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byAddress(cards))
+	return cards, nil
+}
+
+// addressBookResource returns the address book collection. Its ctag changes
+// whenever any card in it is changed.
+func (s *Server) addressBookResource() (*resource, error) {
+	cards, err := s.cards()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	for _, c := range cards {
+		h.Write(c.encode())
+	}
+
+	return &resource{
+		href: addressBookPath,
+		props: map[xml.Name]string{
+			{Space: nsDAV, Local: "resourcetype"}:           "<d:collection/><card:addressbook/>",
+			{Space: nsDAV, Local: "displayname"}:            "Bitmessage",
+			{Space: nsDAV, Local: "current-user-principal"}: "<d:href>" + homePath + "</d:href>",
+			{Space: nsDAV, Local: "supported-report-set"}: "<d:supported-report><d:report><card:addressbook-query/></d:report></d:supported-report>" +
+				"<d:supported-report><d:report><card:addressbook-multiget/></d:report></d:supported-report>",
+			{Space: nsCardDAV, Local: "addressbook-description"}: "Bitmessage contacts",
+			{Space: nsCardDAV, Local: "supported-address-data"}:  `<card:address-data-type content-type="text/vcard" version="3.0"/>`,
+			{Space: nsCS, Local: "getctag"}:                      hex.EncodeToString(h.Sum(nil)),
+		},
+	}, nil
+}
+
+// byAddress sorts cards by address.
+type byAddress []*card
+
+func (b byAddress) Len() int           { return len(b) }
+func (b byAddress) Less(i, j int) bool { return b[i].address < b[j].address }
+func (b byAddress) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// resource is a resource whose properties are returned in a multistatus
+// response.
+type resource struct {
+	href string
+
+	// props maps the names of properties to their values as XML.
+	props map[xml.Name]string
+
+	// private properties are only returned when requested by name.
+	private map[xml.Name]string
+
+	// status is set if the resource could not be found.
+	status int
+}
+
+// homeResource returns the principal, which is also the address book home.
+func homeResource() *resource {
+	href := "<d:href>" + homePath + "</d:href>"
+	return &resource{
+		href: homePath,
+		props: map[xml.Name]string{
+			{Space: nsDAV, Local: "resourcetype"}:             "<d:collection/>",
+			{Space: nsDAV, Local: "displayname"}:              "bmagent",
+			{Space: nsDAV, Local: "current-user-principal"}:   href,
+			{Space: nsDAV, Local: "principal-URL"}:            href,
+			{Space: nsCardDAV, Local: "addressbook-home-set"}: href,
+		},
+	}
+}
+
+// cardResource returns the resource of a vCard.
+func cardResource(c *card) *resource {
+	data := c.encode()
+	return &resource{
+		href: addressBookPath + c.name,
+		props: map[xml.Name]string{
+			{Space: nsDAV, Local: "resourcetype"}:     "",
+			{Space: nsDAV, Local: "getetag"}:          escape(etag(data)),
+			{Space: nsDAV, Local: "getcontenttype"}:   vcardType,
+			{Space: nsDAV, Local: "getcontentlength"}: fmt.Sprint(len(data)),
+		},
+		private: map[xml.Name]string{
+			{Space: nsCardDAV, Local: "address-data"}: escape(string(data)),
+		},
+	}
+}
+
+// query is the body of a PROPFIND or REPORT request.
+type query struct {
+	root    xml.Name
+	props   []xml.Name
+	hrefs   []string
+	allprop bool
+}
+
+// parseQuery reads the properties and hrefs requested in a PROPFIND or REPORT
+// request. An empty body requests all properties.
+func parseQuery(r io.Reader) (*query, error) {
+	q := &query{}
+	var stack []xml.Name
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 {
+				q.root = t.Name
+			}
+			if len(stack) > 0 &&
+				stack[len(stack)-1] == (xml.Name{Space: nsDAV, Local: "prop"}) {
+				q.props = append(q.props, t.Name)
+				if err := d.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			switch t.Name {
+			case xml.Name{Space: nsDAV, Local: "allprop"},
+				xml.Name{Space: nsDAV, Local: "propname"}:
+				q.allprop = true
+			case xml.Name{Space: nsDAV, Local: "href"}:
+				var href string
+				if err := d.DecodeElement(&href, &t); err != nil {
+					return nil, err
+				}
+				q.hrefs = append(q.hrefs, strings.TrimSpace(href))
+				continue
+			}
+			stack = append(stack, t.Name)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	if q.root.Local == "" {
+		q.allprop = true
+	}
+	return q, nil
+}
+
+// depth returns the value of the Depth header. Infinity is treated as 1.
+func depth(req *http.Request) int {
+	if req.Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1
+}
+
+// etag returns the entity tag of a vCard.
+func etag(data []byte) string {
+	h := sha1.Sum(data)
+	return `"` + hex.EncodeToString(h[:]) + `"`
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a
+// request against the card which is already at its path, if any.
+func checkPreconditions(req *http.Request, c *card) bool {
+	if match := req.Header.Get("If-Match"); match != "" {
+		if c == nil {
+			return false
+		}
+		if match != "*" && !strings.Contains(match, etag(c.encode())) {
+			return false
+		}
+	}
+
+	if match := req.Header.Get("If-None-Match"); match != "" && c != nil {
+		if match == "*" || strings.Contains(match, etag(c.encode())) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeUIDConflict answers a PUT of a card whose address is already in the
+// card at href with the no-uid-conflict precondition of RFC 6352.
+func writeUIDConflict(w http.ResponseWriter, href string) {
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusConflict)
+	fmt.Fprintf(w, `%s<d:error xmlns:d="%s" xmlns:card="%s"><card:no-uid-conflict><d:href>%s</d:href></card:no-uid-conflict></d:error>`,
+		xml.Header, nsDAV, nsCardDAV, escape(href))
+}
+
+// escape escapes text for XML.
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// prefixes maps namespaces to the prefixes used for them in responses.
+var prefixes = map[string]string{
+	nsDAV:     "d",
+	nsCardDAV: "card",
+	nsCS:      "cs",
+}
+
+// writeProp writes a property with the given name and value.
+func writeProp(b *bytes.Buffer, name xml.Name, value string) {
+	prefix, ok := prefixes[name.Space]
+	if !ok {
+		fmt.Fprintf(b, `<x:%s xmlns:x="%s">%s</x:%s>`,
+			name.Local, escape(name.Space), value, name.Local)
+		return
+	}
+	fmt.Fprintf(b, "<%s:%s>%s</%s:%s>", prefix, name.Local, value, prefix, name.Local)
+}
+
+// writePropstat writes a propstat element with the given properties.
+func writePropstat(b *bytes.Buffer, props map[xml.Name]string, names []xml.Name, status int) {
+	if len(names) == 0 {
+		return
+	}
+
+	b.WriteString("<d:propstat><d:prop>")
+	for _, name := range names {
+		writeProp(b, name, props[name])
+	}
+	fmt.Fprintf(b, "</d:prop><d:status>HTTP/1.1 %d %s</d:status></d:propstat>",
+		status, http.StatusText(status))
+}
+
+// writeMultistatus writes the properties of resources which are requested in
+// a query.
+func writeMultistatus(w http.ResponseWriter, q *query, resources []*resource) {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<d:multistatus xmlns:d="%s" xmlns:card="%s" xmlns:cs="%s">`,
+		nsDAV, nsCardDAV, nsCS)
+
+	for _, r := range resources {
+		b.WriteString("<d:response><d:href>" + escape(r.href) + "</d:href>")
+		if r.status != 0 {
+			fmt.Fprintf(&b, "<d:status>HTTP/1.1 %d %s</d:status></d:response>",
+				r.status, http.StatusText(r.status))
+			continue
+		}
+
+		found := make(map[xml.Name]string)
+		var foundNames, missing []xml.Name
+		if q.allprop {
+			for name, value := range r.props {
+				found[name] = value
+				foundNames = append(foundNames, name)
+			}
+			sort.Sort(byName(foundNames))
+		}
+		for _, name := range q.props {
+			if value, ok := r.props[name]; ok {
+				if _, ok := found[name]; !ok {
+					found[name] = value
+					foundNames = append(foundNames, name)
+				}
+			} else if value, ok := r.private[name]; ok {
+				found[name] = value
+				foundNames = append(foundNames, name)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+
+		writePropstat(&b, found, foundNames, http.StatusOK)
+		writePropstat(&b, nil, missing, http.StatusNotFound)
+		b.WriteString("</d:response>")
+	}
+	b.WriteString("</d:multistatus>")
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207) // Multi-Status
+	if _, err := w.Write(b.Bytes()); err != nil {
+		log.Errorf("Unable to write response: %v", err)
+	}
+}
+
+// byName sorts property names.
+type byName []xml.Name
+
+func (b byName) Len() int { return len(b) }
+func (b byName) Less(i, j int) bool {
+	if b[i].Space != b[j].Space {
+		return b[i].Space < b[j].Space
+	}
+	return b[i].Local < b[j].Local
+}
+func (b byName) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// writeOptions answers an OPTIONS request.
+func writeOptions(w http.ResponseWriter) {
+	w.Header().Set("DAV", "1, 3, addressbook")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	w.WriteHeader(http.StatusOK)
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	log.Errorf("Unable to access the address book: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
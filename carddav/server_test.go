@@ -0,0 +1,285 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package carddav_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DanielKrawisz/bmagent/carddav"
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+const (
+	alice = "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq"
+	bob   = "BM-2cUJvFYHhXpBHyd96KHfjxsgTYi44BajdE"
+	carol = "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+)
+
+// contacts is an in-memory address book.
+type contacts map[string]*store.Contact
+
+func (c contacts) ForEach(f func(string, *store.Contact) error) error {
+	for address, contact := range c {
+		if err := f(address, contact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c contacts) Get(address string) (*store.Contact, error) {
+	contact, ok := c[address]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	return contact, nil
+}
+
+func (c contacts) AddCard(address, label, card string) error {
+	contact, ok := c[address]
+	if !ok {
+		contact = &store.Contact{}
+		c[address] = contact
+	}
+	contact.Label = label
+	contact.AddressBook = true
+	contact.Card = card
+	return nil
+}
+
+func (c contacts) Remove(address string) error {
+	contact, ok := c[address]
+	if !ok || !contact.AddressBook {
+		return store.ErrNotFound
+	}
+	delete(c, address)
+	return nil
+}
+
+func vcard(address, label string) string {
+	return "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:" + label + "\r\nEMAIL:" +
+		address + "@bm.addr\r\nEND:VCARD\r\n"
+}
+
+type testServer struct {
+	*testing.T
+	server *httptest.Server
+}
+
+// do makes a request and returns the status and body of the response.
+func (s testServer) do(method, path, body string, header map[string]string) (int, string) {
+	req, err := http.NewRequest(method, s.server.URL+path, strings.NewReader(body))
+	if err != nil {
+		s.Fatal(err)
+	}
+	req.SetBasicAuth("user", "pass")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestServer(t *testing.T) {
+	book := contacts{
+		alice: &store.Contact{Label: "Alice", AddressBook: true},
+
+		// Saved senders are not in the address book.
+		bob: &store.Contact{SigningKey: []byte{1}},
+	}
+	srv := httptest.NewServer(carddav.NewServer(&carddav.Config{
+		Username: "user",
+		Password: "pass",
+	}, book))
+	defer srv.Close()
+	s := testServer{t, srv}
+
+	// Authentication is required.
+	resp, err := http.Get(srv.URL + "/contacts/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Discovery.
+	status, body := s.do("PROPFIND", "/", `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+<d:prop><d:current-user-principal/><card:addressbook-home-set/><d:foo/></d:prop>
+</d:propfind>`, map[string]string{"Depth": "0"})
+	if status != 207 {
+		t.Fatalf("expected status 207, got %d", status)
+	}
+	if !strings.Contains(body, "<card:addressbook-home-set><d:href>/</d:href></card:addressbook-home-set>") ||
+		!strings.Contains(body, "<d:foo></d:foo></d:prop><d:status>HTTP/1.1 404 Not Found") {
+		t.Errorf("unexpected response %s", body)
+	}
+
+	// Listing.
+	status, body = s.do("PROPFIND", "/contacts/", `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`,
+		map[string]string{"Depth": "1"})
+	if status != 207 {
+		t.Fatalf("expected status 207, got %d", status)
+	}
+	if !strings.Contains(body, "/contacts/"+alice+".vcf") ||
+		strings.Contains(body, bob) {
+		t.Errorf("unexpected response %s", body)
+	}
+
+	// Get a card.
+	status, body = s.do("GET", "/contacts/"+alice+".vcf", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if !strings.Contains(body, "EMAIL;TYPE=INTERNET:"+alice+"@bm.addr\r\n") ||
+		!strings.Contains(body, "FN:Alice\r\n") {
+		t.Errorf("unexpected card %s", body)
+	}
+	status, _ = s.do("GET", "/contacts/"+bob+".vcf", "", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", status)
+	}
+
+	// Multiget.
+	status, body = s.do("REPORT", "/contacts/", `<?xml version="1.0"?>
+<card:addressbook-multiget xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+<d:prop><d:getetag/><card:address-data/></d:prop>
+<d:href>/contacts/`+alice+`.vcf</d:href><d:href>/contacts/`+carol+`.vcf</d:href>
+</card:addressbook-multiget>`, nil)
+	if status != 207 {
+		t.Fatalf("expected status 207, got %d", status)
+	}
+	if !strings.Contains(body, "FN:Alice") ||
+		!strings.Contains(body, carol+".vcf</d:href><d:status>HTTP/1.1 404 Not Found") {
+		t.Errorf("unexpected response %s", body)
+	}
+
+	// Cards may be given any name. Cards which are not in the address book
+	// are created as well.
+	uuid := "/contacts/0f0e3ad9-1d7a-4cf5-bb4e-5e9b4c3c8a37.vcf"
+	status, _ = s.do("PUT", uuid, vcard(bob, "Bob"),
+		map[string]string{"If-None-Match": "*"})
+	if status != http.StatusCreated {
+		t.Errorf("expected status 201, got %d", status)
+	}
+	if c := book[bob]; c == nil || c.Label != "Bob" || !c.AddressBook {
+		t.Errorf("contact not created: %v", c)
+	}
+	status, body = s.do("GET", uuid, "", nil)
+	if status != http.StatusOK || !strings.Contains(body, bob+"@bm.addr") {
+		t.Errorf("expected card of %s, got %d %s", bob, status, body)
+	}
+	status, _ = s.do("GET", "/contacts/"+bob+".vcf", "", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", status)
+	}
+	status, body = s.do("PROPFIND", "/contacts/", "", map[string]string{"Depth": "1"})
+	if status != 207 || !strings.Contains(body, "<d:href>"+uuid+"</d:href>") {
+		t.Errorf("unexpected response %d %s", status, body)
+	}
+
+	// An address can only be in one card.
+	status, body = s.do("PUT", "/contacts/"+bob+".vcf", vcard(bob, "Bob"), nil)
+	if status != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", status)
+	}
+	if !strings.Contains(body, "<card:no-uid-conflict><d:href>"+uuid+"</d:href></card:no-uid-conflict>") {
+		t.Errorf("unexpected response %s", body)
+	}
+
+	// Changing the address of a card replaces the old contact.
+	status, _ = s.do("PUT", uuid, vcard(carol, "Carol"), nil)
+	if status != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", status)
+	}
+	if c := book[carol]; c == nil || c.Label != "Carol" || c.Card != uuid[len("/contacts/"):] {
+		t.Errorf("contact not created: %v", c)
+	}
+	if c, ok := book[bob]; ok && c.AddressBook {
+		t.Errorf("contact %s should be removed", bob)
+	}
+
+	// Create a card named after its address.
+	status, _ = s.do("PUT", "/contacts/"+bob+".vcf", vcard(bob, "Bob"),
+		map[string]string{"If-None-Match": "*"})
+	if status != http.StatusCreated {
+		t.Errorf("expected status 201, got %d", status)
+	}
+
+	// Cards cannot be overwritten by If-None-Match requests.
+	status, _ = s.do("PUT", "/contacts/"+alice+".vcf", vcard(alice, "Eve"),
+		map[string]string{"If-None-Match": "*"})
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412, got %d", status)
+	}
+
+	// Edit a card.
+	status, _ = s.do("PUT", "/contacts/"+alice+".vcf", vcard(alice, "Alice Liddell"), nil)
+	if status != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", status)
+	}
+	if book[alice].Label != "Alice Liddell" {
+		t.Errorf("expected label Alice Liddell, got %s", book[alice].Label)
+	}
+
+	// Cards are not overwritten if they have changed.
+	status, _ = s.do("PUT", "/contacts/"+alice+".vcf", vcard(alice, "Eve"),
+		map[string]string{"If-Match": `"x"`})
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412, got %d", status)
+	}
+
+	// The address of a card cannot be changed to one in another card.
+	status, _ = s.do("PUT", uuid, vcard(alice, "Carol"), nil)
+	if status != http.StatusConflict {
+		t.Errorf("expected status 409, got %d", status)
+	}
+	if _, ok := book[carol]; !ok {
+		t.Errorf("contact %s should not be removed", carol)
+	}
+	if book[alice].Label != "Alice Liddell" {
+		t.Errorf("expected label Alice Liddell, got %s", book[alice].Label)
+	}
+
+	// Invalid cards are rejected.
+	status, _ = s.do("PUT", "/contacts/x.vcf", vcard("alice", "Alice"), nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", status)
+	}
+
+	// Delete a card.
+	status, _ = s.do("DELETE", "/contacts/"+alice+".vcf", "", map[string]string{"If-Match": `"x"`})
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412, got %d", status)
+	}
+	status, _ = s.do("DELETE", "/contacts/"+alice+".vcf", "", nil)
+	if status != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", status)
+	}
+	if _, ok := book[alice]; ok {
+		t.Errorf("contact %s not removed", alice)
+	}
+	status, _ = s.do("DELETE", "/contacts/"+alice+".vcf", "", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", status)
+	}
+}
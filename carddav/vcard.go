@@ -0,0 +1,192 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package carddav
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/DanielKrawisz/bmutil"
+)
+
+// bmDomain is the e-mail domain of Bitmessage addresses.
+const bmDomain = "@bm.addr"
+
+// maxLineLength is the length in octets after which vCard lines are folded.
+const maxLineLength = 75
+
+var (
+	// ErrNotVCard is returned when a card cannot be parsed as a vCard.
+	ErrNotVCard = errors.New("not a vCard")
+
+	// ErrNoAddress is returned when a vCard has no e-mail address in the
+	// form BM-...@bm.addr.
+	ErrNoAddress = errors.New("vCard has no Bitmessage e-mail address")
+)
+
+// card is a contact as it is represented in a vCard.
+type card struct {
+	address string // The Bitmessage address, without the domain.
+	label   string
+	name    string // The name of the card in the address book.
+}
+
+// escapeText escapes a vCard text value.
+func escapeText(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, ",", `\,`, -1)
+	s = strings.Replace(s, ";", `\;`, -1)
+	s = strings.Replace(s, "\r\n", `\n`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// unescapeText reverses escapeText.
+func unescapeText(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// writeLine writes a content line, folding it so that no line is longer than
+// maxLineLength octets.
+func writeLine(b *bytes.Buffer, line string) {
+	limit := maxLineLength
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+
+		// The leading space counts toward the length of the next line.
+		limit = maxLineLength - 1
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// encode returns the card as a vCard 3.0.
+func (c *card) encode() []byte {
+	name := c.label
+	if name == "" {
+		name = c.address
+	}
+
+	var b bytes.Buffer
+	writeLine(&b, "BEGIN:VCARD")
+	writeLine(&b, "VERSION:3.0")
+	writeLine(&b, "PRODID:-//bmagent//CardDAV//EN")
+	writeLine(&b, "UID:"+c.address)
+	writeLine(&b, "FN:"+escapeText(name))
+	writeLine(&b, "N:"+escapeText(c.label)+";;;;")
+	writeLine(&b, "EMAIL;TYPE=INTERNET:"+c.address+bmDomain)
+	writeLine(&b, "END:VCARD")
+	return b.Bytes()
+}
+
+// bmAddress returns the Bitmessage address in an EMAIL value, or the empty
+// string if it is not a valid address of the form BM-...@bm.addr.
+func bmAddress(email string) string {
+	email = strings.TrimSpace(email)
+	if len(email) > 7 && strings.EqualFold(email[:7], "mailto:") {
+		email = email[7:]
+	}
+	if len(email) <= len(bmDomain) ||
+		!strings.EqualFold(email[len(email)-len(bmDomain):], bmDomain) {
+		return ""
+	}
+
+	address := email[:len(email)-len(bmDomain)]
+	if _, err := bmutil.DecodeAddress(address); err != nil {
+		return ""
+	}
+	return address
+}
+
+// decodeCard parses a vCard. The address of the card is taken from the first
+// EMAIL property with a Bitmessage address and its label from FN, or from N
+// if FN is not given.
+func decodeCard(data []byte) (*card, error) {
+	// Unfold the lines.
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	text = strings.Replace(text, "\n ", "", -1)
+	text = strings.Replace(text, "\n\t", "", -1)
+
+	var begun bool
+	var fn, n string
+	c := &card{}
+	for _, line := range strings.Split(text, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		value := line[i+1:]
+
+		// Strip the parameters and the group from the property name.
+		name := line[:i]
+		if j := strings.Index(name, ";"); j >= 0 {
+			name = name[:j]
+		}
+		if j := strings.LastIndex(name, "."); j >= 0 {
+			name = name[j+1:]
+		}
+
+		switch strings.ToUpper(name) {
+		case "BEGIN":
+			if !strings.EqualFold(strings.TrimSpace(value), "VCARD") {
+				return nil, ErrNotVCard
+			}
+			begun = true
+		case "FN":
+			fn = strings.TrimSpace(unescapeText(value))
+		case "N":
+			// N is family;given;additional;prefixes;suffixes.
+			parts := strings.Split(value, ";")
+			n = strings.TrimSpace(unescapeText(parts[0]))
+			if len(parts) > 1 {
+				given := strings.TrimSpace(unescapeText(parts[1]))
+				n = strings.TrimSpace(given + " " + n)
+			}
+		case "EMAIL":
+			if c.address == "" {
+				c.address = bmAddress(value)
+			}
+		}
+	}
+
+	if !begun {
+		return nil, ErrNotVCard
+	}
+	if c.address == "" {
+		return nil, ErrNoAddress
+	}
+
+	c.label = fn
+	if c.label == "" {
+		c.label = n
+	}
+
+	// A card without a label is given the address as its name.
+	if c.label == c.address {
+		c.label = ""
+	}
+	return c, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package carddav
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVCard(t *testing.T) {
+	tests := []struct {
+		card card
+	}{
+		{card{"BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq", "Alice", ""}},
+		{card{"BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq", "", ""}},
+		{card{"BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq", `Bob; the \ builder, again`, ""}},
+		{card{"BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq", strings.Repeat("Ünïcödé-", 30), ""}},
+	}
+
+	for i, test := range tests {
+		data := test.card.encode()
+		for _, line := range strings.Split(string(data), "\r\n") {
+			if len(line) > maxLineLength {
+				t.Errorf("case %d: line too long: %q", i, line)
+			}
+		}
+
+		c, err := decodeCard(data)
+		if err != nil {
+			t.Errorf("case %d: decodeCard returned error %v", i, err)
+			continue
+		}
+		if *c != test.card {
+			t.Errorf("case %d: expected %v, got %v", i, test.card, *c)
+		}
+	}
+}
+
+func TestDecodeCard(t *testing.T) {
+	tests := []struct {
+		vcard   string
+		address string
+		label   string
+		err     error
+	}{
+		{
+			"BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Alice\r\n" +
+				"EMAIL:alice@example.com\r\n" +
+				"item1.EMAIL;TYPE=work:BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq@BM.ADDR\r\n" +
+				"END:VCARD\r\n",
+			"BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq", "Alice", nil,
+		},
+		{
+			// Folded lines, no FN and a mailto URI.
+			"begin:vcard\nversion:3.0\nn:Smith;John;;;\nemail:mailto:BM-2cUfDTJXLeMxA\n" +
+				" Ve7pWXBEneBjDuQ783VSq@bm.addr\nend:vcard\n",
+			"BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq", "John Smith", nil,
+		},
+		{
+			"BEGIN:VCARD\r\nFN:Alice\r\nEMAIL:alice@example.com\r\nEND:VCARD\r\n",
+			"", "", ErrNoAddress,
+		},
+		{
+			"BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n",
+			"", "", ErrNotVCard,
+		},
+		{
+			"FN:Alice\r\n", "", "", ErrNotVCard,
+		},
+	}
+
+	for i, test := range tests {
+		c, err := decodeCard([]byte(test.vcard))
+		if err != test.err {
+			t.Errorf("case %d: expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.address != test.address || c.label != test.label {
+			t.Errorf("case %d: expected %s, %s, got %s, %s", i,
+				test.address, test.label, c.address, c.label)
+		}
+	}
+}
@@ -20,9 +20,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/DanielKrawisz/bmagent/powmgr"
 	"github.com/btcsuite/btcutil"
 	flags "github.com/jessevdk/go-flags"
-	"github.com/DanielKrawisz/bmutil/pow"
 )
 
 const (
@@ -35,26 +35,33 @@ const (
 	defaultRPCMaxClients    = 10
 	defaultRPCMaxWebsockets = 25
 
-	defaultBmdPort  = 8442
-	defaultRPCPort  = 8446
-	defaultIMAPPort = 1143
-	defaultSMTPPort = 1587
+	defaultBmdPort     = 8442
+	defaultRPCPort     = 8446
+	defaultIMAPPort    = 1143
+	defaultSMTPPort    = 1587
+	defaultCardDAVPort = 1808
 
 	keyfileName = "keys.dat"
 	storeDbName = "store.db"
 
 	defaultPowHandler = "parallel"
+	defaultPowTimeout = time.Minute * 30
 
 	defaultMsgExpiry        = time.Hour * 60      // 2.5 days
 	defaultBroadcastExpiry  = time.Hour * 48      // 2 days
 	defaultPubkeyExpiry     = time.Hour * 24 * 14 // 14 days
 	defaultGetpubkeyExpiry  = time.Hour * 24 * 14 // 14 days
 	defaultUnknownObjExpiry = time.Hour * 24
+
+	defaultGetpubkeyInterval = time.Hour * 24
 	
 	defaultPlaintextDB = true // TODO change to false for production version.
 	defaultLogConsole = true
 	
 	defaultGenKeys = -1
+
+	defaultNumAddresses   = 1
+	defaultAddressVersion = 4
 )
 
 var (
@@ -78,36 +85,74 @@ type config struct {
 	Create        bool   `long:"create" description:"Create the identity and message databases if they don't exist"`
 	ImportKeyFile string `long:"importkeyfile" description:"Path to keys.db from PyBitmessage. If set, private keys from this file are imported into bmagent"`
 
-	EnableRPC     bool     `long:"rpc" description:"Enable built-in RPC server -- NOTE: The RPC server is disabled by default"`
-	RPCListeners  []string `long:"rpclisten" description:"Listen for RPC/websocket connections on this interface/port (default port: 8446)"`
-	IMAPListeners []string `long:"imaplisten" description:"Listen for IMAP connections on this interface/port (default port: 143)"`
-	SMTPListeners []string `long:"smtplisten" description:"Listen for SMTP connections on this interface/port (default port: 587)"`
+	CreateChan  string `long:"createchan" description:"Create the chan with the given passphrase and exit"`
+	JoinChan    string `long:"joinchan" description:"Join the chan with the given passphrase and exit. Its address must be given with --chanaddress"`
+	ChanAddress string `long:"chanaddress" description:"Address of the chan joined with --joinchan, which is checked against the passphrase"`
+
+	Deterministic    bool   `long:"deterministic" description:"Recreate the identities that PyBitmessage generates from a passphrase, which is prompted for, and exit"`
+	NumAddresses     int    `long:"numaddresses" description:"Number of identities to recreate with --deterministic"`
+	AddressVersion   uint64 `long:"addressversion" description:"Address version of the identities recreated with --deterministic. Options: {3, 4}"`
+	EighteenByteRipe bool   `long:"eighteenbyteripe" description:"Recreate identities with --deterministic whose addresses were made shorter with PyBitmessage's eighteen byte ripe option"`
+
+	Vanity      string `long:"vanity" description:"Search for a new identity whose address begins with BM- followed by the given prefix and exit"`
+	VanityZeros int    `long:"vanityzeros" description:"Search for a new identity whose ripe begins with the given number of zero bytes, which makes its address shorter, and exit"`
+	VanityHD    bool   `long:"vanityhd" description:"Derive the identities tried by --vanity and --vanityzeros from the master key instead of generating random ones"`
+
+	DisableIdentity string `long:"disableidentity" description:"Stop receiving messages for the given identity and exit. Its keys are kept"`
+	EnableIdentity  string `long:"enableidentity" description:"Start receiving messages for the given disabled identity again and exit"`
+	RemoveIdentity  string `long:"removeidentity" description:"Permanently remove the given imported identity or chan and exit"`
+	RetireIdentity  string `long:"retireidentity" description:"Permanently disable the given identity derived from the seed and exit"`
+	ListIdentities  bool   `long:"listidentities" description:"List the identities and whether they are disabled and exit"`
+
+	Subscribe         string `long:"subscribe" description:"Subscribe to broadcasts from the given address and exit"`
+	Unsubscribe       string `long:"unsubscribe" description:"Unsubscribe from broadcasts from the given address and exit"`
+	ListSubscriptions bool   `long:"listsubscriptions" description:"List the addresses whose broadcasts are received and exit"`
+	Label             string `long:"label" description:"Label to give to an address added with --subscribe, --blacklist or --whitelist, or to the identity found with --vanity or --vanityzeros"`
+
+	Blacklist    string `long:"blacklist" description:"Add the given address to the blacklist and exit"`
+	Unblacklist  string `long:"unblacklist" description:"Remove the given address from the blacklist and exit"`
+	Whitelist    string `long:"whitelist" description:"Add the given address to the whitelist and exit"`
+	Unwhitelist  string `long:"unwhitelist" description:"Remove the given address from the whitelist and exit"`
+	FilterMode   string `long:"filtermode" description:"Set whether the blacklist or the whitelist decides whose messages are blocked and exit. Options: {blacklist, whitelist}"`
+	FilterAction string `long:"filteraction" description:"Set whether messages from blocked senders are dropped or put in the Junk folder and exit. Options: {drop, junk}"`
+	ListFilter   bool   `long:"listfilter" description:"Show the filter mode and action and the addresses on the blacklist and the whitelist and exit"`
+
+	EnableRPC        bool     `long:"rpc" description:"Enable built-in RPC server -- NOTE: The RPC server is disabled by default"`
+	RPCListeners     []string `long:"rpclisten" description:"Listen for RPC/websocket connections on this interface/port (default port: 8446)"`
+	IMAPListeners    []string `long:"imaplisten" description:"Listen for IMAP connections on this interface/port (default port: 143)"`
+	SMTPListeners    []string `long:"smtplisten" description:"Listen for SMTP connections on this interface/port (default port: 587)"`
+	CardDAVListeners []string `long:"carddavlisten" description:"Listen for CardDAV connections to the address book on this interface/port (default port: 1808) -- NOTE: The CardDAV server is disabled unless this is given"`
 
 	TLSCert          string `long:"rpccert" description:"File containing the certificate file"`
 	TLSKey           string `long:"rpckey" description:"File containing the certificate key"`
-	DisableServerTLS bool   `long:"noservertls" description:"Disable TLS for the RPC, IMAP and SMTP servers -- NOTE: This is only allowed if the servers are all bound to localhost"`
+	DisableServerTLS bool   `long:"noservertls" description:"Disable TLS for the RPC, IMAP, SMTP and CardDAV servers -- NOTE: This is only allowed if the servers are all bound to localhost"`
 	DisableClientTLS bool   `long:"noclienttls" description:"Disable TLS for the RPC client -- NOTE: This is only allowed if the RPC client is connecting to localhost"`
 	CAFile           string `long:"cafile" description:"File containing root certificates to authenticate a TLS connection with bmd"`
 	RPCConnect       string `short:"c" long:"rpcconnect" description:"Hostname/IP and port of bmd RPC server to connect to (default localhost:8442)"`
 
-	Username    string `short:"u" long:"username" description:"Username for clients (RPC/IMAP/SMTP) and bmd authorization"`
-	Password    string `short:"P" long:"password" default-mask:"-" description:"Password for clients (RPC/IMAP/SMTP) and bmd authorization"`
+	Username    string `short:"u" long:"username" description:"Username for clients (RPC/IMAP/SMTP/CardDAV) and bmd authorization"`
+	Password    string `short:"P" long:"password" default-mask:"-" description:"Password for clients (RPC/IMAP/SMTP/CardDAV) and bmd authorization"`
 	BmdUsername string `long:"bmdusername" description:"Alternative username for bmd authorization"`
 	BmdPassword string `long:"bmdpassword" default-mask:"-" description:"Alternative password for bmd authorization"`
 
 	Profile string `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
 
-	ProofOfWork     string        `long:"pow" description:"Choose proof-of-work handler. Options: {sequential, parallel}"`
-	PowThreads      int           `long:"powthreads" description:"Number of threads to use for parallel proof-of-work calculation. It should not be greater than the number of cores"`
-	MsgExpiry       time.Duration `long:"msgexpiry" description:"Time after which a message sent out should expire, more means more time for POW calculations"`
-	BroadcastExpiry time.Duration `long:"broadcastexpiry" description:"Time after which a broadcast sent out should expire, more means more time for POW calculations"`
+	ProofOfWork       string        `long:"pow" description:"Choose proof-of-work handler. Options: {sequential, parallel, pool, command, http}"`
+	PowThreads        int           `long:"powthreads" description:"Number of threads to use for parallel proof-of-work calculation, or number of workers in the pool. It should not be greater than the number of cores"`
+	PowCommand        string        `long:"powcommand" description:"Command which calculates proof-of-work for the command handler. It reads a JSON request from stdin and writes the response to stdout"`
+	PowURL            string        `long:"powurl" description:"URL of the proof-of-work service for the http handler"`
+	PowTimeout        time.Duration `long:"powtimeout" description:"Time after which the command or http proof-of-work handler gives up and proof-of-work is calculated locally"`
+	MsgExpiry         time.Duration `long:"msgexpiry" description:"Time after which a message sent out should expire, more means more time for POW calculations"`
+	BroadcastExpiry   time.Duration `long:"broadcastexpiry" description:"Time after which a broadcast sent out should expire, more means more time for POW calculations"`
+	GetpubkeyInterval time.Duration `long:"getpubkeyinterval" description:"Minimum time between responses to getpubkey requests for one of our identities. Requests are ignored during this time unless the published pubkey has expired"`
 
 	PlaintextDB bool `long:"plaintextdb" description:"Allow plaintext database (useful for testing purposes)."`
 	LogConsole  bool `long:"logconsole" description:"display logs to console."`
 
 	GenKeys int16 `long:"genkeys" description:"number of new keys to generate."`
 
-	powHandler  func(target uint64, hash []byte) uint64
+	powHandler  powmgr.PowFunc
+	powWorkers  int
 	storePath   string
 	
 	// TODO there should not be a global path for a single key file. 
@@ -309,6 +354,15 @@ func checkCreateDir(path string) error {
 	return nil
 }
 
+// localPowHandler returns the proof-of-work handler which is used when a
+// remote handler fails.
+func localPowHandler(cfg *config) powmgr.PowFunc {
+	if cfg.PowThreads < 2 {
+		return powmgr.Sequential
+	}
+	return powmgr.Parallel(cfg.PowThreads)
+}
+
 // newConfigParser returns a new command line flags parser.
 func newConfigParser(cfg *config, appName string, options flags.Options) *flags.Parser {
 	p := flags.NewNamedParser(appName, options)
@@ -351,11 +405,15 @@ func LoadConfig(appName string, args []string) (*config, []string, error) {
 		TLSCert:         defaultTLSCertFile,
 		PowThreads:      runtime.NumCPU(),
 		ProofOfWork:     defaultPowHandler,
+		PowTimeout:      defaultPowTimeout,
 		MsgExpiry:       defaultMsgExpiry,
 		BroadcastExpiry: defaultBroadcastExpiry,
+		GetpubkeyInterval: defaultGetpubkeyInterval,
 		PlaintextDB:     defaultPlaintextDB,
 		LogConsole:      defaultLogConsole,
 		GenKeys:         defaultGenKeys, 
+		NumAddresses:    defaultNumAddresses,
+		AddressVersion:  defaultAddressVersion,
 	}
 
 	// Pre-parse the command line options to see if an alternative config
@@ -452,18 +510,42 @@ func LoadConfig(appName string, args []string) (*config, []string, error) {
 	}
 
 	// Verify proof-of-work parameters.
+	cfg.powWorkers = 1
 	switch cfg.ProofOfWork {
 	case "sequential":
-		cfg.powHandler = pow.DoSequential
+		cfg.powHandler = powmgr.Sequential
 	case "parallel":
 		if cfg.PowThreads < 2 {
 			err := errors.New("Number of threads for proof-of-work cannot be less than 2")
 			fmt.Fprintln(os.Stderr, err)
 			return nil, nil, err
 		}
-		cfg.powHandler = func(target uint64, hash []byte) uint64 {
-			return pow.DoParallel(target, hash, cfg.PowThreads)
+		cfg.powHandler = powmgr.Parallel(cfg.PowThreads)
+	case "pool":
+		if cfg.PowThreads < 1 {
+			err := errors.New("Number of proof-of-work workers cannot be less than 1")
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
 		}
+		cfg.powHandler = powmgr.Sequential
+		cfg.powWorkers = cfg.PowThreads
+	case "command":
+		command := strings.Fields(cfg.PowCommand)
+		if len(command) == 0 {
+			err := errors.New("No proof-of-work command given")
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.powHandler = powmgr.Remote(
+			powmgr.NewCommandBackend(command, cfg.PowTimeout), localPowHandler(&cfg))
+	case "http":
+		if cfg.PowURL == "" {
+			err := errors.New("No proof-of-work service given")
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.powHandler = powmgr.Remote(
+			powmgr.NewHTTPBackend(cfg.PowURL, cfg.PowTimeout), localPowHandler(&cfg))
 	default:
 		err := errors.New("Unknown proof-of-work handler")
 		fmt.Fprintln(os.Stderr, err)
@@ -533,6 +615,69 @@ func LoadConfig(appName string, args []string) (*config, []string, error) {
 		os.Exit(0)
 	}
 
+	// Create or join a chan.
+	if cfg.CreateChan != "" || cfg.JoinChan != "" {
+		if err := manageChans(&cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+
+		os.Exit(0)
+	}
+
+	// Recreate deterministic identities from a passphrase.
+	if cfg.Deterministic {
+		if err := manageDeterministic(&cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+
+		os.Exit(0)
+	}
+
+	// Search for a vanity address.
+	if cfg.Vanity != "" || cfg.VanityZeros != 0 {
+		if err := manageVanity(&cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+
+		os.Exit(0)
+	}
+
+	// Disable, enable, remove, retire or list identities.
+	if cfg.DisableIdentity != "" || cfg.EnableIdentity != "" ||
+		cfg.RemoveIdentity != "" || cfg.RetireIdentity != "" || cfg.ListIdentities {
+		if err := manageIdentities(&cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+
+		os.Exit(0)
+	}
+
+	// Add, remove or list broadcast subscriptions.
+	if cfg.Subscribe != "" || cfg.Unsubscribe != "" || cfg.ListSubscriptions {
+		if err := manageSubscriptions(&cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+
+		os.Exit(0)
+	}
+
+	// Manage the blacklist and whitelist.
+	if cfg.Blacklist != "" || cfg.Unblacklist != "" || cfg.Whitelist != "" ||
+		cfg.Unwhitelist != "" || cfg.FilterMode != "" || cfg.FilterAction != "" ||
+		cfg.ListFilter {
+		if err := manageSenderFilter(&cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+
+		os.Exit(0)
+	}
+
 	// Username and password must be specified.
 	if cfg.Username == "" || cfg.Password == "" {
 		err := errors.New("Username and password cannot be left blank.")
@@ -614,6 +759,7 @@ func LoadConfig(appName string, args []string) (*config, []string, error) {
 	cfg.RPCListeners = normalizeAddresses(cfg.RPCListeners, defaultRPCPort)
 	cfg.IMAPListeners = normalizeAddresses(cfg.IMAPListeners, defaultIMAPPort)
 	cfg.SMTPListeners = normalizeAddresses(cfg.SMTPListeners, defaultSMTPPort)
+	cfg.CardDAVListeners = normalizeAddresses(cfg.CardDAVListeners, defaultCardDAVPort)
 
 	// Only allow server TLS to be disabled if the RPC is bound to localhost
 	// addresses.
@@ -630,6 +776,10 @@ func LoadConfig(appName string, args []string) (*config, []string, error) {
 		if err != nil {
 			return nil, nil, err
 		}
+		err = verifyListeners(cfg.CardDAVListeners, "CardDAV", funcName, usageMessage)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// If the bmd username or password are unset, use the same auth as for
@@ -18,8 +18,11 @@ import (
 	"strings"
 	"regexp"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/DanielKrawisz/bmutil"
 	"github.com/DanielKrawisz/bmagent/email"
 	"github.com/DanielKrawisz/bmagent/keymgr"
 	"github.com/DanielKrawisz/bmagent/store"
@@ -374,34 +377,38 @@ func openDatabases(cfg *config) (*keymgr.Manager,
 		cfg.keyfilePass = keyfilePass
 	}
 	
-	
-	load, err := store.Open(cfg.storePath)
+	dstore, q, pk, err := openStore(cfg)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	
-	var dstore *store.Store
-	var q *store.PowQueue
-	var pk *store.PKRequests
+
+	return kmgr, dstore, q, pk, nil
+}
+
+// openStore returns an instance of store.Store based on the configuration.
+func openStore(cfg *config) (*store.Store, *store.PowQueue, *store.PKRequests, error) {
+	load, err := store.Open(cfg.storePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	
 	if cfg.PlaintextDB && !load.IsEncrypted() {
-		dstore, q, pk, err = load.Construct(nil)
-	} else {
+		return load.Construct(nil)
+	}
 		
-		// Read store passphrase from console.
-		storePass, err := promptStorePassPhrase()
-		if err != nil {
-			return nil, nil, nil, nil, err
-		}
-	
-		// Open store.
-		dstore, q, pk, err = load.Construct(storePass)
-		if err != nil {
-			return nil, nil, nil, nil, fmt.Errorf("Failed to open data store: %v", err)
-		}
+	// Read store passphrase from console.
+	storePass, err := promptStorePassPhrase()
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return kmgr, dstore, q, pk, nil
+	// Open store.
+	dstore, q, pk, err := load.Construct(storePass)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to open data store: %v", err)
+	}
+	
+	return dstore, q, pk, nil
 }
 
 // importKeyfile is used to import a keys.dat file from PyBitmessage. It adds
@@ -423,3 +430,345 @@ func importKeyfile(kmgr *keymgr.Manager, file string) error {
 	
 	return nil
 }
+
+// manageChans creates or joins a chan, as given by the configuration, and
+// saves it in the key file.
+func manageChans(cfg *config) error {
+	if cfg.CreateChan != "" && cfg.JoinChan != "" {
+		return errors.New("Only one of --createchan and --joinchan may be given.")
+	}
+	if cfg.JoinChan != "" && cfg.ChanAddress == "" {
+		return errors.New("The address of the chan must be given with --chanaddress.")
+	}
+	
+	kmgr, s, _, _, err := openDatabases(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to open databases: %v", err)
+	}
+	s.Close()
+	
+	var id *keymgr.PrivateID
+	if cfg.CreateChan != "" {
+		id, err = kmgr.CreateChan(cfg.CreateChan)
+	} else {
+		id, err = kmgr.JoinChan(cfg.JoinChan, cfg.ChanAddress)
+	}
+	if err == keymgr.ErrDuplicateIdentity {
+		fmt.Printf("Already in chan %s %s\n", id.Address(), id.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	
+	u := &User{kmgr, cfg.keyfilePath, cfg.Username, cfg.keyfilePass}
+	u.SaveKeyfile()
+	
+	fmt.Printf("Joined chan %s %s\n", id.Address(), id.Name)
+	return nil
+}
+
+// manageDeterministic recreates the identities that PyBitmessage generates
+// from a passphrase, which is read from the console, and saves them in the
+// key file.
+func manageDeterministic(cfg *config) error {
+	kmgr, s, _, _, err := openDatabases(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to open databases: %v", err)
+	}
+	s.Close()
+	
+	pass, err := promptConsolePass("Enter the passphrase of the addresses", false)
+	if err != nil {
+		return err
+	}
+	if pass == nil {
+		return errors.New("A passphrase is required.")
+	}
+	
+	ids, err := kmgr.NewDeterministicIdentities(string(pass), cfg.NumAddresses,
+		cfg.AddressVersion, cfg.EighteenByteRipe)
+	if err != nil {
+		return err
+	}
+	
+	u := &User{kmgr, cfg.keyfilePath, cfg.Username, cfg.keyfilePass}
+	u.SaveKeyfile()
+	
+	for _, id := range ids {
+		fmt.Printf("Recreated address %s %s\n", id.Address(), id.Name)
+	}
+	return nil
+}
+
+// manageVanity searches for an identity whose address matches the vanity
+// pattern given by the configuration and saves it in the key file. The
+// search can be cancelled with Ctrl+C.
+func manageVanity(cfg *config) error {
+	search := &keymgr.VanitySearch{
+		Prefix: cfg.Vanity,
+		Zeros:  cfg.VanityZeros,
+		Name:   cfg.Label,
+		HD:     cfg.VanityHD,
+	}
+	expected, err := search.ExpectedAttempts()
+	if err != nil {
+		return err
+	}
+	
+	kmgr, s, _, _, err := openDatabases(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to open databases: %v", err)
+	}
+	s.Close()
+	
+	// Show the progress about once a second.
+	var mtx sync.Mutex
+	var last time.Time
+	start := time.Now()
+	search.Progress = func(attempts uint64) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		
+		if time.Since(last) < time.Second {
+			return
+		}
+		last = time.Now()
+		
+		rate := float64(attempts) / time.Since(start).Seconds()
+		fmt.Printf("\rTried %d of about %.0f expected addresses (%.0f per second)",
+			attempts, expected, rate)
+	}
+	
+	quit := make(chan struct{})
+	addInterruptHandler(func() {
+		close(quit)
+	})
+	
+	fmt.Printf("Searching for an address. About %.0f addresses are expected to be tried. Press Ctrl+C to stop.\n",
+		expected)
+	id, err := kmgr.NewVanityIdentity(search, quit)
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	
+	u := &User{kmgr, cfg.keyfilePath, cfg.Username, cfg.keyfilePass}
+	u.SaveKeyfile()
+	
+	fmt.Printf("Found address %s %s\n", id.Address(), id.Name)
+	return nil
+}
+
+// manageIdentities disables, enables, removes or retires an identity, or
+// lists them, as given by the configuration, and saves the key file.
+func manageIdentities(cfg *config) error {
+	kmgr, s, _, _, err := openDatabases(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to open databases: %v", err)
+	}
+	s.Close()
+	
+	operations := []struct {
+		address string
+		f       func(string) error
+		done    string
+	}{
+		{cfg.DisableIdentity, kmgr.DisableIdentity, "Disabled"},
+		{cfg.EnableIdentity, kmgr.EnableIdentity, "Enabled"},
+		{cfg.RemoveIdentity, kmgr.RemoveImported, "Removed"},
+		{cfg.RetireIdentity, kmgr.RetireIdentity, "Retired"},
+	}
+	
+	changed := false
+	for _, op := range operations {
+		if op.address == "" {
+			continue
+		}
+		
+		if err = op.f(op.address); err != nil {
+			return fmt.Errorf("%s: %v", op.address, err)
+		}
+		fmt.Printf("%s %s\n", op.done, op.address)
+		changed = true
+	}
+	
+	if changed {
+		u := &User{kmgr, cfg.keyfilePath, cfg.Username, cfg.keyfilePass}
+		u.SaveKeyfile()
+	}
+	
+	if cfg.ListIdentities {
+		return kmgr.ForEach(func(id *keymgr.PrivateID) error {
+			state := "enabled"
+			if id.Retired {
+				state = "retired"
+			} else if id.Disabled {
+				state = "disabled"
+			}
+			fmt.Printf("%s %s %s\n", id.Address(), state, id.Name)
+			return nil
+		})
+	}
+	
+	return nil
+}
+
+// manageSubscriptions adds or removes a broadcast address from the user's 
+// subscriptions or lists them, as given by the configuration. 
+func manageSubscriptions(cfg *config) error {
+	if cfg.Username == "" {
+		return errors.New("A username is required to manage subscriptions.")
+	}
+	
+	s, _, _, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to open data store: %v", err)
+	}
+	defer s.Close()
+	
+	user, err := s.GetUser(cfg.Username)
+	if err != nil {
+		return err
+	}
+	broadcasts := user.BroadcastAddresses
+	
+	if cfg.Subscribe != "" {
+		err = broadcasts.Add(cfg.Subscribe, cfg.Label)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Subscribed to %s %s\n", cfg.Subscribe, cfg.Label)
+	}
+	
+	if cfg.Unsubscribe != "" {
+		err = broadcasts.Remove(cfg.Unsubscribe)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Unsubscribed from %s\n", cfg.Unsubscribe)
+	}
+	
+	if cfg.ListSubscriptions {
+		return broadcasts.ForEach(func(addr *bmutil.Address) error {
+			address, err := addr.Encode()
+			if err != nil {
+				return err
+			}
+			
+			label, err := broadcasts.Label(address)
+			if err != nil {
+				return err
+			}
+			
+			fmt.Printf("%s %s\n", address, label)
+			return nil
+		})
+	}
+	
+	return nil
+}
+
+// manageSenderFilter adds or removes addresses from the user's blacklist and
+// whitelist, sets the filter mode and action, or lists them, as given by the
+// configuration.
+func manageSenderFilter(cfg *config) error {
+	if cfg.Username == "" {
+		return errors.New("A username is required to manage the sender filter.")
+	}
+	
+	s, _, _, err := openStore(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to open data store: %v", err)
+	}
+	defer s.Close()
+	
+	user, err := s.GetUser(cfg.Username)
+	if err != nil {
+		return err
+	}
+	filter := user.SenderFilter
+	
+	if cfg.Blacklist != "" {
+		err = filter.Blacklist.Add(cfg.Blacklist, cfg.Label)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %s %s to the blacklist\n", cfg.Blacklist, cfg.Label)
+	}
+	
+	if cfg.Unblacklist != "" {
+		err = filter.Blacklist.Remove(cfg.Unblacklist)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from the blacklist\n", cfg.Unblacklist)
+	}
+	
+	if cfg.Whitelist != "" {
+		err = filter.Whitelist.Add(cfg.Whitelist, cfg.Label)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %s %s to the whitelist\n", cfg.Whitelist, cfg.Label)
+	}
+	
+	if cfg.Unwhitelist != "" {
+		err = filter.Whitelist.Remove(cfg.Unwhitelist)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from the whitelist\n", cfg.Unwhitelist)
+	}
+	
+	if cfg.FilterMode != "" {
+		mode, err := store.ParseFilterMode(cfg.FilterMode)
+		if err != nil {
+			return err
+		}
+		if err = filter.SetMode(mode); err != nil {
+			return err
+		}
+		fmt.Printf("Filter mode set to %s\n", mode)
+	}
+	
+	if cfg.FilterAction != "" {
+		action, err := store.ParseFilterAction(cfg.FilterAction)
+		if err != nil {
+			return err
+		}
+		if err = filter.SetAction(action); err != nil {
+			return err
+		}
+		fmt.Printf("Filter action set to %s\n", action)
+	}
+	
+	if cfg.ListFilter {
+		mode, err := filter.Mode()
+		if err != nil {
+			return err
+		}
+		action, err := filter.Action()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Mode: %s\nAction: %s\n", mode, action)
+		
+		fmt.Println("Blacklist:")
+		err = filter.Blacklist.ForEach(func(address, label string) error {
+			fmt.Printf("%s %s\n", address, label)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		
+		fmt.Println("Whitelist:")
+		return filter.Whitelist.ForEach(func(address, label string) error {
+			fmt.Printf("%s %s\n", address, label)
+			return nil
+		})
+	}
+	
+	return nil
+}
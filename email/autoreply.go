@@ -0,0 +1,86 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"strings"
+
+	"github.com/DanielKrawisz/bmagent/message/format"
+)
+
+// autoReplyPrefix marks the subject of the automatic replies that bmagent
+// sends. Bitmessage has no headers in which to say that a message was sent
+// automatically, so auto-responders are recognized by their subjects.
+const autoReplyPrefix = "Auto: "
+
+// autoReplySubjects are the beginnings of the subjects of automatic replies
+// sent by bmagent and by common mail programs, in lower case.
+var autoReplySubjects = []string{
+	"auto:",
+	"auto-reply",
+	"autoreply",
+	"automatic reply",
+	"out of office",
+}
+
+// isAutoReplySubject returns whether a subject is that of an automatic
+// reply.
+func isAutoReplySubject(subject string) bool {
+	subject = strings.ToLower(strings.TrimSpace(subject))
+	for _, prefix := range autoReplySubjects {
+		if strings.HasPrefix(subject, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageSubject returns the subject of a message, or the empty string if
+// its encoding has none.
+func messageSubject(bm *Bitmessage) string {
+	if msg, ok := bm.Message.(*format.Encoding2); ok {
+		return msg.Subject
+	}
+	return ""
+}
+
+// IsAutoReply returns whether a message appears to be an automatic reply,
+// which should not be replied to automatically.
+func IsAutoReply(bm *Bitmessage) bool {
+	return isAutoReplySubject(messageSubject(bm))
+}
+
+// autoReplyTo creates an automatic reply to a message. If the subject is
+// empty, the reply is titled after the message. The subject is marked so
+// that the recipient's auto-responder, if any, does not answer it.
+func autoReplyTo(bm *Bitmessage, subject, body string) *Bitmessage {
+	if subject == "" {
+		subject = "Re: " + messageSubject(bm)
+	}
+	if !isAutoReplySubject(subject) {
+		subject = autoReplyPrefix + subject
+	}
+
+	return &Bitmessage{
+		From: bm.To,
+		To:   bm.From,
+		Message: &format.Encoding2{
+			Subject: subject,
+			Body:    body,
+		},
+		state: &MessageState{
+			AckExpected: true,
+		},
+	}
+}
+
+// SendAutoReply sends an automatic reply to a message received from bmd. The
+// reply goes through the Outbox and the proof-of-work queue like any other
+// message.
+func (u *User) SendAutoReply(bm *Bitmessage, subject, body string) error {
+	reply := autoReplyTo(bm, subject, body)
+	smtpLog.Debug("Sending automatic reply from " + reply.From + " to " + reply.To)
+	return u.send(reply)
+}
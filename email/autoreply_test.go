@@ -0,0 +1,55 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"testing"
+
+	"github.com/DanielKrawisz/bmagent/message/format"
+)
+
+func TestAutoReplyTo(t *testing.T) {
+	from := "BM-2cUJvFYHhXpBHyd96KHfjxsgTYi44BajdE@bm.addr"
+	to := "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq@bm.addr"
+
+	tests := []struct {
+		received  string
+		subject   string
+		expected  string
+		autoReply bool
+	}{
+		{"Help!", "Out of office", "Out of office", false},
+		{"Help!", "", "Auto: Re: Help!", false},
+		{"Help!", "We got your message", "Auto: We got your message", false},
+		{"Auto: Thanks", "Away", "Auto: Away", true},
+		{"AUTOMATIC REPLY: away", "Away", "Auto: Away", true},
+		{"  Out of Office until Monday", "Away", "Auto: Away", true},
+		{"Autoreply", "Away", "Auto: Away", true},
+		{"Automobiles", "Away", "Auto: Away", false},
+	}
+
+	for i, test := range tests {
+		received := &Bitmessage{
+			From:    from,
+			To:      to,
+			Message: &format.Encoding2{Subject: test.received, Body: "body"},
+		}
+		if IsAutoReply(received) != test.autoReply {
+			t.Errorf("Test %d: expected IsAutoReply to be %v", i, test.autoReply)
+		}
+
+		reply := autoReplyTo(received, test.subject, "reply")
+		if reply.From != to || reply.To != from {
+			t.Errorf("Test %d: reply sent from %s to %s", i, reply.From, reply.To)
+		}
+		msg := reply.Message.(*format.Encoding2)
+		if msg.Subject != test.expected || msg.Body != "reply" {
+			t.Errorf("Test %d: expected subject %q got %q", i, test.expected, msg.Subject)
+		}
+		if !IsAutoReply(reply) {
+			t.Errorf("Test %d: reply is not recognized as automatic", i)
+		}
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"net/mail"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 	"github.com/mailhog/data"
 	"github.com/DanielKrawisz/bmagent/message/format"
 	"github.com/DanielKrawisz/bmagent/message/serialize"
+	"github.com/DanielKrawisz/bmagent/store"
 	"github.com/DanielKrawisz/bmutil"
 	"github.com/DanielKrawisz/bmutil/cipher"
 	"github.com/DanielKrawisz/bmutil/identity"
@@ -33,6 +36,36 @@ const (
 	bmAddrPattern = "BM-[123456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ]+"
 	
 	commandPattern = "[a-z]+"
+
+	// broadcastAddress is the e-mail address to which broadcasts are sent.
+	broadcastAddress = "broadcast@bm.agent"
+
+	// powETAHeader is the header which shows when the proof-of-work of a
+	// message in the Outbox is expected to be done.
+	powETAHeader = "X-Bitmessage-PoW-ETA"
+
+	// powWarningHeader is the header which warns that the proof-of-work of
+	// a message is not expected to be done before the message expires.
+	powWarningHeader = "X-Bitmessage-PoW-Warning"
+
+	// ttlHeader is the header which gives the time to live of a message
+	// in seconds, or as a duration such as 72h.
+	ttlHeader = "X-Bitmessage-TTL"
+
+	// streamHeader is the header which gives the stream in which a message
+	// is sent.
+	streamHeader = "X-Bitmessage-Stream"
+
+	// ackHeader is the header which says whether an ack is requested for
+	// a message. Its value is yes or no.
+	ackHeader = "X-Bitmessage-Ack"
+
+	// maxTTL is the longest time to live allowed by the protocol.
+	maxTTL = time.Hour * 24 * 28
+
+	// minTTL is the shortest time to live that is accepted for a message. 
+	// Other clients do not send objects which expire sooner than this.
+	minTTL = time.Minute * 5
 )
 
 var (
@@ -56,6 +89,14 @@ var (
 	// commandRegex is used for detecting an email intended as a 
 	// command to bmagent. 
 	commandRegex = regexp.MustCompile(commandRegexString)
+
+	// contactsRegex is used for detecting an e-mail address which refers
+	// to a contact or identity by its label.
+	contactsRegex = regexp.MustCompile("^[^@]+@bm\\.contacts$")
+
+	// displayNameRegex is used for detecting a bare display name, such as
+	// Alice, which refers to a contact or identity by its label.
+	displayNameRegex = regexp.MustCompile("^[^@<>,\"]+$")
 )
 
 // bmToEmail converts a Bitmessage address to an e-mail address.
@@ -82,6 +123,80 @@ func emailToBM(emailAddr string) (string, error) {
 	return bm, nil
 }
 
+// parseAddress returns the address in an e-mail header, or the display name
+// if it is a bare display name without an address.
+func parseAddress(header string) (string, error) {
+	addr, err := mail.ParseAddress(header)
+	if err == nil {
+		return addr.Address, nil
+	}
+
+	name := strings.TrimSpace(header)
+	if displayNameRegex.MatchString(name) {
+		return name, nil
+	}
+	return "", err
+}
+
+// isLabel returns whether an address refers to a contact or identity by its
+// label, either as label@bm.contacts or as a bare display name.
+func isLabel(emailAddr string) bool {
+	return contactsRegex.MatchString(emailAddr) ||
+		displayNameRegex.MatchString(emailAddr)
+}
+
+// resolveAddress returns the Bitmessage address of an e-mail address, which
+// is of the form BM-...@bm.addr or label@bm.contacts or is a bare display
+// name. Labels are matched, ignoring case, against the names of the user's
+// identities and, if contacts is not nil, the labels of the contacts in the
+// address book.
+func resolveAddress(emailAddr string, names map[string]string,
+	contacts *store.Contacts) (string, error) {
+
+	if !isLabel(emailAddr) {
+		return emailToBM(emailAddr)
+	}
+	label := emailAddr
+	if i := strings.LastIndex(emailAddr, "@"); i >= 0 {
+		label = emailAddr[:i]
+	}
+
+	matches := make(map[string]struct{})
+	for address, name := range names {
+		if strings.EqualFold(name, label) {
+			matches[address] = struct{}{}
+		}
+	}
+	if contacts != nil {
+		err := contacts.ForEach(func(address string, contact *store.Contact) error {
+			if contact.AddressBook && strings.EqualFold(contact.Label, label) {
+				matches[address] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("No contact or identity has the label %s.", label)
+	case 1:
+		for address := range matches {
+			return address, nil
+		}
+	}
+
+	addresses := make([]string, 0, len(matches))
+	for address := range matches {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return "", fmt.Errorf("The label %s is ambiguous. It could be any of %s.",
+		label, strings.Join(addresses, ", "))
+}
+
 // ImapData provides a Bitmessage with extra information to make it
 // compatible with imap.
 type ImapData struct {
@@ -110,6 +225,14 @@ type MessageState struct {
 	AckReceived bool
 	// Whether the message was received over the bitmessage network.
 	Received bool
+	// The time to live requested for the message, or zero for the default.
+	TTL time.Duration
+	// The stream requested for the message, or zero for the default.
+	Stream uint64
+	// The expiration requested for the message with the Expires header, or
+	// zero for the default. Unlike the Expiration of the message, it is not
+	// changed when the object is generated.
+	Expires time.Time
 }
 
 // Bitmessage represents a message compatible with a bitmessage format
@@ -150,6 +273,10 @@ func (m *Bitmessage) Serialize() ([]byte, error) {
 	var state *serialize.MessageState
 	if m.state != nil {
 		lastsend := m.state.LastSend.Format(dateFormat)
+		var expires string
+		if !m.state.Expires.IsZero() {
+			expires = m.state.Expires.Format(dateFormat)
+		}
 		state = &serialize.MessageState{
 			SendTries:       m.state.SendTries,
 			AckExpected:     m.state.AckExpected,
@@ -159,6 +286,9 @@ func (m *Bitmessage) Serialize() ([]byte, error) {
 			AckPowIndex:     m.state.AckPowIndex,
 			LastSend:        lastsend,
 			Received:        m.state.Received,
+			Ttl:             uint64(m.state.TTL / time.Second),
+			Stream:          m.state.Stream,
+			Expires:         expires,
 		}
 	}
 	
@@ -183,6 +313,149 @@ func (m *Bitmessage) Serialize() ([]byte, error) {
 	return data, nil
 }
 
+// expiry returns the time to live of the object generated from the message,
+// given the default for its type. It is given by the X-Bitmessage-TTL header
+// or else by the Expires header, if they were set.
+func (m *Bitmessage) expiry(def time.Duration) time.Duration {
+	if m.state == nil {
+		return def
+	}
+
+	if m.state.TTL > 0 {
+		return m.state.TTL
+	}
+
+	if !m.state.Expires.IsZero() {
+		// If the message is being sent again after it expired, use the
+		// default instead.
+		if ttl := m.state.Expires.Sub(time.Now()); ttl > 0 {
+			if ttl > maxTTL {
+				return maxTTL
+			}
+			return ttl
+		}
+	}
+
+	return def
+}
+
+// stream returns the stream in which the message is sent, given the
+// default.
+func (m *Bitmessage) stream(def uint64) uint64 {
+	if m.state != nil && m.state.Stream != 0 {
+		return m.state.Stream
+	}
+	return def
+}
+
+// checkStream checks that the stream requested for the message, if any, is
+// the given one. Messages must be sent in the stream of the recipient and
+// broadcasts in the stream of the sender.
+func (m *Bitmessage) checkStream(stream uint64) error {
+	if m.state == nil || m.state.Stream == 0 || m.state.Stream == stream {
+		return nil
+	}
+
+	if m.To == broadcastAddress {
+		return fmt.Errorf("Invalid headers: %s must be %d, the stream of the sender",
+			streamHeader, stream)
+	}
+	return fmt.Errorf("Invalid headers: %s must be %d, the stream of the recipient",
+		streamHeader, stream)
+}
+
+// parseDate parses the date in an e-mail header. Dates from older versions
+// of bmagent are in dateFormat rather than that of RFC 5322.
+func parseDate(date string) (time.Time, error) {
+	t, err := mail.Header{"Date": []string{date}}.Date()
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(dateFormat, date)
+}
+
+// parseTTL parses the value of the X-Bitmessage-TTL header, which is either
+// a number of seconds or a duration such as 72h.
+func parseTTL(ttl string) (time.Duration, error) {
+	ttl = strings.TrimSpace(ttl)
+	if seconds, err := strconv.ParseUint(ttl, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(ttl)
+}
+
+// readSendOptions reads the headers which control how the message is sent
+// over the Bitmessage network.
+func (m *Bitmessage) readSendOptions(header map[string][]string) error {
+	// Expires is a rarely-used header that is relevant to Bitmessage.
+	// If it is set, use it to generate the expire time of the message.
+	// Otherwise, use the default.
+	if value, ok := header["Expires"]; ok && len(value) > 0 {
+		exp, err := parseDate(value[0])
+		if err != nil {
+			return err
+		}
+		m.state.Expires = exp
+	}
+
+	if value, ok := header[ttlHeader]; ok && len(value) > 0 {
+		ttl, err := parseTTL(value[0])
+		if err != nil {
+			return fmt.Errorf("Invalid headers: %s: %v", ttlHeader, err)
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("Invalid headers: %s must be positive", ttlHeader)
+		}
+		m.state.TTL = ttl
+	}
+
+	if value, ok := header[streamHeader]; ok && len(value) > 0 {
+		stream, err := strconv.ParseUint(strings.TrimSpace(value[0]), 10, 32)
+		if err != nil || stream == 0 {
+			return fmt.Errorf("Invalid headers: %s must be a positive number", streamHeader)
+		}
+		m.state.Stream = stream
+	}
+
+	if value, ok := header[ackHeader]; ok && len(value) > 0 {
+		switch strings.ToLower(strings.TrimSpace(value[0])) {
+		case "no":
+			m.state.AckExpected = false
+		case "yes":
+		default:
+			return fmt.Errorf("Invalid headers: %s must be yes or no", ackHeader)
+		}
+	}
+
+	return nil
+}
+
+// CheckSendOptions checks that the time to live that was requested for a new
+// message is allowed by the protocol.
+func (m *Bitmessage) CheckSendOptions() error {
+	if m.state != nil && m.state.TTL != 0 {
+		if m.state.TTL > maxTTL {
+			return fmt.Errorf("Invalid headers: %s cannot be more than %s", ttlHeader, maxTTL)
+		}
+		if m.state.TTL < minTTL {
+			return fmt.Errorf("Invalid headers: %s cannot be less than %s", ttlHeader, minTTL)
+		}
+		return nil
+	}
+
+	if m.state != nil && !m.state.Expires.IsZero() {
+		ttl := m.state.Expires.Sub(time.Now())
+		if ttl <= 0 {
+			return errors.New("Invalid headers: Expires is in the past")
+		}
+		if ttl > maxTTL {
+			return fmt.Errorf("Invalid headers: Expires cannot be more than %s away", maxTTL)
+		}
+	}
+
+	return nil
+}
+
 // generateBroadcast generates a wire.MsgBroadcast from a Bitmessage.
 func (m *Bitmessage) generateBroadcast(from *identity.Private, expiry time.Duration) (*wire.MsgObject, uint64, uint64, error) {
 	// TODO make a separate function in bmutil that does this.
@@ -210,8 +483,8 @@ func (m *Bitmessage) generateBroadcast(from *identity.Private, expiry time.Durat
 	broadcast := &wire.MsgBroadcast{
 		ObjectType:         wire.ObjectTypeBroadcast,
 		Version:            version,
-		ExpiresTime:        time.Now().Add(expiry),
-		StreamNumber:       from.Address.Stream,
+		ExpiresTime:        time.Now().Add(m.expiry(expiry)),
+		StreamNumber:       m.stream(from.Address.Stream),
 		FromStreamNumber:   from.Address.Stream,
 		FromAddressVersion: from.Address.Version,
 		NonceTrials:        from.NonceTrialsPerByte,
@@ -249,9 +522,9 @@ func (m *Bitmessage) generateMsg(from *identity.Private, to *identity.Public, ex
 
 	message := &wire.MsgMsg{
 		ObjectType:         wire.ObjectTypeMsg,
-		ExpiresTime:        time.Now().Add(expiry),
+		ExpiresTime:        time.Now().Add(m.expiry(expiry)),
 		Version:            1,
-		StreamNumber:       from.Address.Stream,
+		StreamNumber:       m.stream(to.Address.Stream),
 		FromStreamNumber:   from.Address.Stream,
 		FromAddressVersion: from.Address.Version,
 		NonceTrials:        from.NonceTrialsPerByte,
@@ -283,7 +556,7 @@ func (m *Bitmessage) GenerateObject(s ServerOps) (object *wire.MsgObject,
 	nonceTrials, extraBytes uint64, genErr error) {
 		
 	smtpLog.Debug("GenerateObject: about to serialize bmsg from " + m.From + " to " + m.To)
-	fromAddr, err := emailToBM(m.From)
+	fromAddr, err := resolveAddress(m.From, s.Names(), nil)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -293,10 +566,13 @@ func (m *Bitmessage) GenerateObject(s ServerOps) (object *wire.MsgObject,
 		return nil, 0, 0, errors.New("Private id not found")
 	}
 
-	if m.To == "broadcast@bm.agent" {
+	if m.To == broadcastAddress {
+		if err = m.checkStream(from.Private.Address.Stream); err != nil {
+			return nil, 0, 0, err
+		}
 		object, nonceTrials, extraBytes, genErr = m.generateBroadcast(&(from.Private), s.GetObjectExpiry(wire.ObjectTypeBroadcast))
 	} else {
-		bmTo, err := emailToBM(m.To)
+		bmTo, err := resolveAddress(m.To, s.Names(), s.Contacts())
 		if err != nil {
 			return nil, 0, 0, err
 		}
@@ -311,6 +587,10 @@ func (m *Bitmessage) GenerateObject(s ServerOps) (object *wire.MsgObject,
 			return nil, 0, 0, nil
 		}
 
+		if err = m.checkStream(to.Address.Stream); err != nil {
+			return nil, 0, 0, err
+		}
+
 		id := s.GetPrivateID(bmTo)
 		if id != nil {
 			m.OfChannel = id.IsChan
@@ -326,6 +606,7 @@ func (m *Bitmessage) GenerateObject(s ServerOps) (object *wire.MsgObject,
 		return nil, 0, 0, genErr
 	}
 	m.object = object
+	m.Expiration = object.ExpiresTime
 	return object, nonceTrials, extraBytes, nil
 }
 
@@ -357,6 +638,12 @@ func (m *Bitmessage) SubmitPow(s ServerOps) error {
 
 	m.state.PowIndex = index
 
+	smtpLog.Debugf("SubmitPow: pow #%d has target %d.", index, target)
+	if eta, ok := s.PowEstimate(index); ok && time.Now().Add(eta).After(obj.ExpiresTime) {
+		smtpLog.Warnf("Proof-of-work for message from %s to %s is expected to take %s, "+
+			"longer than the message's time to live.", m.From, m.To, eta)
+	}
+
 	return nil
 }
 
@@ -404,8 +691,8 @@ func BroadcastRead(msg *wire.MsgBroadcast) (*Bitmessage, error) {
 	}
 
 	return &Bitmessage{
-		From:       "broadcast@bm.agent",
-		To:         bmToEmail(fromAddress),
+		From:       bmToEmail(fromAddress),
+		To:         broadcastAddress,
 		Expiration: msg.ExpiresTime,
 		Message:    message,
 	}, nil
@@ -486,6 +773,13 @@ func DecodeBitmessage(data []byte) (*Bitmessage, error) {
 		if err != nil {
 			return nil, err
 		}
+		var expires time.Time
+		if msg.State.Expires != "" {
+			expires, err = time.Parse(dateFormat, msg.State.Expires)
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		l.state = &MessageState{
 			PubkeyRequestOutstanding: msg.State.PubkeyRequested,
@@ -496,14 +790,52 @@ func DecodeBitmessage(data []byte) (*Bitmessage, error) {
 			AckExpected:              msg.State.AckExpected,
 			AckReceived:              msg.State.AckReceived,
 			Received:                 msg.State.Received,
+			TTL:                      time.Duration(msg.State.Ttl) * time.Second,
+			Stream:                   msg.State.Stream,
+			Expires:                  expires,
 		}
 	}
 
 	return l, nil
 }
 
+// displayAddress formats an e-mail address along with the name or label
+// that the mailbox of the message has for it, if there is one.
+func (m *Bitmessage) displayAddress(addr string) string {
+	box, ok := m.ImapData.Mailbox.(*mailbox)
+	if !ok || box == nil {
+		return addr
+	}
+
+	bmAddr, err := emailToBM(addr)
+	if err != nil {
+		return addr
+	}
+
+	name := box.addresses[bmAddr]
+	if name == "" {
+		label := box.label
+		if label == nil && box.base != nil {
+			label = box.base.label
+		}
+		if label != nil {
+			name = label(bmAddr)
+		}
+	}
+	if name == "" {
+		return addr
+	}
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
 // ToEmail converts a Bitmessage into an IMAPEmail.
 func (m *Bitmessage) ToEmail() (*IMAPEmail, error) {
+	return m.toEmail(nil)
+}
+
+// toEmail converts a Bitmessage into an IMAPEmail with some extra headers,
+// which can be nil.
+func (m *Bitmessage) toEmail(extra map[string][]string) (*IMAPEmail, error) {
 	var payload *format.Encoding2
 	switch m := m.Message.(type) {
 	// Only encoding 2 is considered to be compatible with email.
@@ -522,21 +854,40 @@ func (m *Bitmessage) ToEmail() (*IMAPEmail, error) {
 
 	headers["Subject"] = []string{payload.Subject}
 
-	headers["From"] = []string{m.From}
+	headers["From"] = []string{m.displayAddress(m.From)}
 
 	if m.To == "" {
-		headers["To"] = []string{"broadcast@bm.agent"}
+		headers["To"] = []string{broadcastAddress}
 	} else {
 		headers["To"] = []string{m.To}
 	}
 
 	headers["Date"] = []string{m.ImapData.TimeReceived.Format(dateFormat)}
-	headers["Expires"] = []string{m.Expiration.Format(dateFormat)}
+	if !m.Expiration.IsZero() {
+		headers["Expires"] = []string{m.Expiration.Format(time.RFC1123Z)}
+	} else if m.state != nil && !m.state.Expires.IsZero() {
+		headers["Expires"] = []string{m.state.Expires.Format(time.RFC1123Z)}
+	}
+	if m.state != nil && !m.state.Received {
+		if m.state.TTL != 0 {
+			headers[ttlHeader] = []string{
+				strconv.FormatUint(uint64(m.state.TTL/time.Second), 10)}
+		}
+		if m.state.Stream != 0 {
+			headers[streamHeader] = []string{strconv.FormatUint(m.state.Stream, 10)}
+		}
+		if m.To != broadcastAddress && !m.state.AckExpected {
+			headers[ackHeader] = []string{"no"}
+		}
+	}
 	if m.OfChannel {
 		headers["Reply-To"] = []string{m.To}
 	}
 	headers["Content-Type"] = []string{`text/plain; charset="UTF-8"`}
 	headers["Content-Transfer-Encoding"] = []string{"8bit"}
+	for key, value := range extra {
+		headers[key] = value
+	}
 
 	content := &data.Content{
 		Headers: headers,
@@ -586,12 +937,13 @@ func NewBitmessageFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 	if !(validateEmail(fromList[0]) || validateEmail(toList[0])) {
 		return nil, ErrInvalidEmail
 	} else {
-		// No errors because this must have succeeded when the
-		// address was validated above.
-		fromAddr, _ := mail.ParseAddress(fromList[0])
-		toAddr, _ := mail.ParseAddress(toList[0])
-		from = fromAddr.Address
-		to = toAddr.Address
+		var err error
+		if from, err = parseAddress(fromList[0]); err != nil {
+			return nil, ErrInvalidEmail
+		}
+		if to, err = parseAddress(toList[0]); err != nil {
+			return nil, ErrInvalidEmail
+		}
 	}
 
 	// If CC or BCC are set, give an error because these headers cannot
@@ -603,18 +955,6 @@ func NewBitmessageFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 		return nil, errors.New("Invalid headers: do not use CC or BCC with Bitmessage")
 	}
 
-	// Expires is a rarely-used header that is relevant to Bitmessage.
-	// If it is set, use it to generate the expire time of the message.
-	// Otherwise, use the default.
-	var expiration time.Time
-	if expireStr, ok := header["Expires"]; ok {
-		exp, err := time.Parse(dateFormat, expireStr[0])
-		if err != nil {
-			return nil, err
-		}
-		expiration = exp
-	}
-
 	var subject string
 	if subj, ok := header["Subject"]; ok {
 		subject = subj[0]
@@ -627,10 +967,9 @@ func NewBitmessageFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 		return nil, err
 	}
 
-	return &Bitmessage{
+	bm := &Bitmessage{
 		From:       from,
 		To:         to,
-		Expiration: expiration,
 		Ack:        nil,
 		Message: &format.Encoding2{
 			Subject: subject,
@@ -641,7 +980,12 @@ func NewBitmessageFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 			// channel/self is in GenerateObject.
 			AckExpected: to != "",
 		},
-	}, nil
+	}
+
+	if err = bm.readSendOptions(header); err != nil {
+		return nil, err
+	}
+	return bm, nil
 }
 
 // NewBitmessageDraftFromSMTP takes an SMTP e-mail and turns it into a Bitmessage, 
@@ -666,18 +1010,6 @@ func NewBitmessageDraftFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 		from = fromList[0]
 	}
 
-	// Expires is a rarely-used header that is relevant to Bitmessage.
-	// If it is set, use it to generate the expire time of the message.
-	// Otherwise, use the default.
-	var expiration time.Time
-	if expireStr, ok := header["Expires"]; ok {
-		exp, err := time.Parse(dateFormat, expireStr[0])
-		if err != nil {
-			return nil, err
-		}
-		expiration = exp
-	}
-
 	var subject string
 	if subj, ok := header["Subject"]; ok {
 		subject = subj[0]
@@ -690,10 +1022,9 @@ func NewBitmessageDraftFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 		return nil, err
 	}
 
-	return &Bitmessage{
+	bm := &Bitmessage{
 		From:       from,
 		To:         to,
-		Expiration: expiration,
 		Ack:        nil,
 		Message: &format.Encoding2{
 			Subject: subject,
@@ -704,5 +1035,12 @@ func NewBitmessageDraftFromSMTP(smtp *data.Content) (*Bitmessage, error) {
 			// channel/self is in GenerateObject.
 			AckExpected: to != "",
 		},
-	}, nil
+	}
+
+	// Drafts may be incomplete, so invalid send options are ignored
+	// until the message is sent.
+	if err = bm.readSendOptions(header); err != nil {
+		smtpLog.Debugf("Draft has invalid headers: %v", err)
+	}
+	return bm, nil
 }
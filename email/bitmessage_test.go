@@ -7,6 +7,9 @@ package email
 
 import (
 	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/message/format"
 )
 
 func TestEmailAddressConversion(t *testing.T) {
@@ -60,3 +63,228 @@ func TestEmailAddressConversion(t *testing.T) {
 		}
 	}
 }
+
+func TestDisplayAddress(t *testing.T) {
+	addr := "BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP"
+	box := &mailbox{
+		addresses: map[string]string{addr: "Bitmessage news"},
+	}
+
+	tests := []struct {
+		mailbox  Mailbox
+		from     string
+		expected string
+	}{
+		{box, bmToEmail(addr), `"Bitmessage news" <BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP@bm.addr>`},
+		{box, "BM-NBddNS6ZagzjNbMMkVBpecuSAPU1EgyQ@bm.addr", "BM-NBddNS6ZagzjNbMMkVBpecuSAPU1EgyQ@bm.addr"},
+		{box, "addresses@bm.agent", "addresses@bm.agent"},
+		{nil, bmToEmail(addr), bmToEmail(addr)},
+	}
+
+	for i, test := range tests {
+		m := &Bitmessage{ImapData: &ImapData{Mailbox: test.mailbox}}
+		if got := m.displayAddress(test.from); got != test.expected {
+			t.Errorf("Test %d: expected %s got %s", i, test.expected, got)
+		}
+	}
+
+	// Addresses which the mailbox has no name for are shown with their
+	// labels from the address book.
+	contact := "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+	box.label = func(address string) string {
+		if address == contact {
+			return "Alice"
+		}
+		return ""
+	}
+	m := &Bitmessage{ImapData: &ImapData{Mailbox: box}}
+	if got := m.displayAddress(bmToEmail(contact)); got != `"Alice" <`+bmToEmail(contact)+`>` {
+		t.Errorf("Wrong display address %s", got)
+	}
+
+	if name := subscriptionFolderName(addr, "a/b"); name != "Subscriptions/a b" {
+		t.Errorf("Wrong folder name %s", name)
+	}
+	if name := subscriptionFolderName(addr, ""); name != "Subscriptions/"+addr {
+		t.Errorf("Wrong folder name %s", name)
+	}
+}
+
+func TestSendOptions(t *testing.T) {
+	future := time.Now().Add(time.Hour * 48).Truncate(time.Second)
+
+	tests := []struct {
+		header  map[string][]string
+		invalid bool // readSendOptions fails.
+		reject  bool // CheckSendOptions fails.
+		ttl     time.Duration
+		stream  uint64
+		ack     bool
+	}{
+		{map[string][]string{}, false, false, 0, 0, true},
+		{map[string][]string{ttlHeader: {"3600"}}, false, false, time.Hour, 0, true},
+		{map[string][]string{ttlHeader: {"72h"}}, false, false, time.Hour * 72, 0, true},
+		{map[string][]string{ttlHeader: {"672h1s"}}, false, true, maxTTL + time.Second, 0, true},
+		{map[string][]string{ttlHeader: {"soon"}}, true, false, 0, 0, true},
+		{map[string][]string{ttlHeader: {"-1h"}}, true, false, 0, 0, true},
+		{map[string][]string{ttlHeader: {"0"}}, true, false, 0, 0, true},
+		{map[string][]string{ttlHeader: {"0s"}}, true, false, 0, 0, true},
+		{map[string][]string{ttlHeader: {"1"}}, false, true, time.Second, 0, true},
+		{map[string][]string{ttlHeader: {"299"}}, false, true, minTTL - time.Second, 0, true},
+		{map[string][]string{ttlHeader: {"300"}}, false, false, minTTL, 0, true},
+		{map[string][]string{streamHeader: {"2"}}, false, false, 0, 2, true},
+		{map[string][]string{streamHeader: {"0"}}, true, false, 0, 0, true},
+		{map[string][]string{ackHeader: {"no"}}, false, false, 0, 0, false},
+		{map[string][]string{ackHeader: {"Yes"}}, false, false, 0, 0, true},
+		{map[string][]string{ackHeader: {"maybe"}}, true, false, 0, 0, true},
+		{map[string][]string{"Expires": {future.Format(time.RFC1123Z)}}, false, false, 0, 0, true},
+		{map[string][]string{"Expires": {future.Format(dateFormat)}}, false, false, 0, 0, true},
+		{map[string][]string{"Expires": {"Mon, 02 Jan 2006 15:04:05 -0700"}}, false, true, 0, 0, true},
+		{map[string][]string{"Expires": {future.Add(maxTTL).Format(time.RFC1123Z)}}, false, true, 0, 0, true},
+		{map[string][]string{"Expires": {"tomorrow"}}, true, false, 0, 0, true},
+	}
+
+	for i, test := range tests {
+		m := &Bitmessage{state: &MessageState{AckExpected: true}}
+		err := m.readSendOptions(test.header)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("Test %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+
+		if err = m.CheckSendOptions(); (err != nil) != test.reject {
+			t.Errorf("Test %d: CheckSendOptions returned %v", i, err)
+		}
+		if m.state.TTL != test.ttl {
+			t.Errorf("Test %d: expected ttl %s got %s", i, test.ttl, m.state.TTL)
+		}
+		if m.state.Stream != test.stream {
+			t.Errorf("Test %d: expected stream %d got %d", i, test.stream, m.state.Stream)
+		}
+		if m.state.AckExpected != test.ack {
+			t.Errorf("Test %d: expected ack %v got %v", i, test.ack, m.state.AckExpected)
+		}
+		if _, ok := test.header["Expires"]; ok && !m.state.Expires.Equal(future) && !test.reject {
+			t.Errorf("Test %d: expected expiration %s got %s", i, future, m.state.Expires)
+		}
+	}
+
+	// The TTL takes precedence over Expires, which is limited by maxTTL.
+	m := &Bitmessage{state: &MessageState{TTL: time.Hour, Expires: future}}
+	if ttl := m.expiry(time.Minute); ttl != time.Hour {
+		t.Errorf("Expected expiry %s got %s", time.Hour, ttl)
+	}
+	m.state.TTL = 0
+	if ttl := m.expiry(time.Minute); ttl <= time.Hour*47 || ttl > time.Hour*48 {
+		t.Errorf("Expected expiry of about 48h got %s", ttl)
+	}
+	m.state.Expires = time.Now().Add(maxTTL * 2)
+	if ttl := m.expiry(time.Minute); ttl != maxTTL {
+		t.Errorf("Expected expiry %s got %s", maxTTL, ttl)
+	}
+	m.state.Expires = time.Now().Add(-time.Hour)
+	if ttl := m.expiry(time.Minute); ttl != time.Minute {
+		t.Errorf("Expected expiry %s got %s", time.Minute, ttl)
+	}
+	if stream := m.stream(1); stream != 1 {
+		t.Errorf("Expected stream 1 got %d", stream)
+	}
+
+	// The expiration of the generated object does not replace the one
+	// that was requested.
+	m.state.Expires = future
+	m.Expiration = time.Now().Add(time.Minute)
+	m.Message = &format.Encoding2{Subject: "subject", Body: "body"}
+	if ttl := m.expiry(time.Minute); ttl <= time.Hour*47 || ttl > time.Hour*48 {
+		t.Errorf("Expected expiry of about 48h got %s", ttl)
+	}
+
+	// The requested expiration is kept when the message is stored.
+	data, err := m.Serialize()
+	if err != nil {
+		t.Fatal("Serialize failed: ", err)
+	}
+	m, err = DecodeBitmessage(data)
+	if err != nil {
+		t.Fatal("DecodeBitmessage failed: ", err)
+	}
+	if !m.state.Expires.Equal(future) {
+		t.Errorf("Expected expiration %s got %s", future, m.state.Expires)
+	}
+
+	// A message must be sent in the stream of the recipient and a broadcast
+	// in that of the sender.
+	m.state.Stream = 2
+	if err = m.checkStream(2); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err = m.checkStream(1); err == nil {
+		t.Error("Expected error for the wrong stream")
+	}
+	m.state.Stream = 0
+	if err = m.checkStream(1); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestResolveAddress(t *testing.T) {
+	addr1 := "BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP"
+	addr2 := "BM-NBddNS6ZagzjNbMMkVBpecuSAPU1EgyQ"
+	addr3 := "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+	names := map[string]string{
+		addr1: "Work",
+		addr2: "Chan",
+		addr3: "chan",
+	}
+
+	tests := []struct {
+		email    string
+		expected string
+	}{
+		{bmToEmail(addr1), addr1},
+		{"work@bm.contacts", addr1},
+		{"WORK@bm.contacts", addr1},
+		{"chan@bm.contacts", ""},   // ambiguous
+		{"nobody@bm.contacts", ""}, // unknown
+		{"work@bm.addr", ""},
+		{"Work", addr1},  // display name
+		{"Chan", ""},     // ambiguous
+		{"Nobody", ""},   // unknown
+	}
+
+	for i, test := range tests {
+		addr, err := resolveAddress(test.email, names, nil)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got %s", i, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if addr != test.expected {
+			t.Errorf("Test %d: expected %s got %s", i, test.expected, addr)
+		}
+	}
+
+	// Labels and display names are accepted as recipients, but not other
+	// e-mail addresses.
+	for _, to := range []string{"Alice", "alice@bm.contacts", `"Alice" <alice@bm.contacts>`} {
+		if !validateEmail(to) {
+			t.Errorf("Recipient %s should be accepted.", to)
+		}
+	}
+	for _, to := range []string{"alice@example.com", "Alice <alice@example.com>", ""} {
+		if validateEmail(to) {
+			t.Errorf("Recipient %s should not be accepted.", to)
+		}
+	}
+}
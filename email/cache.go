@@ -0,0 +1,104 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"container/list"
+	"sync"
+)
+
+// bitmessageCacheSize is the number of decoded Bitmessages kept in memory
+// for each folder.
+const bitmessageCacheSize = 256
+
+// cacheEntry is an element of a bitmessageCache.
+type cacheEntry struct {
+	uid  uint64
+	bmsg *Bitmessage
+}
+
+// bitmessageCache is a least-recently-used cache of decoded Bitmessages,
+// indexed by uid. It is shared by a mailbox and its views, which have
+// different read locks, so it has its own mutex.
+type bitmessageCache struct {
+	size    int
+	mtx     sync.Mutex // Protects the following fields.
+	order   *list.List // Most recently used at the front.
+	entries map[uint64]*list.Element
+}
+
+// newBitmessageCache creates a cache which holds up to size messages.
+func newBitmessageCache(size int) *bitmessageCache {
+	return &bitmessageCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+// copyBitmessage returns a copy of a Bitmessage which can be modified
+// without affecting the original.
+func copyBitmessage(bmsg *Bitmessage) *Bitmessage {
+	c := *bmsg
+	if bmsg.ImapData != nil {
+		imapData := *bmsg.ImapData
+		c.ImapData = &imapData
+	}
+	if bmsg.state != nil {
+		state := *bmsg.state
+		c.state = &state
+	}
+	return &c
+}
+
+// get returns a copy of the cached Bitmessage with the given uid, or nil if
+// it is not in the cache.
+func (c *bitmessageCache) get(uid uint64) *Bitmessage {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[uid]
+	if !ok {
+		return nil
+	}
+
+	c.order.MoveToFront(e)
+	return copyBitmessage(e.Value.(*cacheEntry).bmsg)
+}
+
+// put adds a copy of a Bitmessage to the cache, replacing any previous
+// version and removing the least recently used message if the cache is full.
+func (c *bitmessageCache) put(uid uint64, bmsg *Bitmessage) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.entries[uid]; ok {
+		e.Value.(*cacheEntry).bmsg = copyBitmessage(bmsg)
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[uid] = c.order.PushFront(&cacheEntry{
+		uid:  uid,
+		bmsg: copyBitmessage(bmsg),
+	})
+
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).uid)
+	}
+}
+
+// remove removes the Bitmessage with the given uid from the cache.
+func (c *bitmessageCache) remove(uid uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.entries[uid]; ok {
+		c.order.Remove(e)
+		delete(c.entries, uid)
+	}
+}
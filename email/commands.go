@@ -0,0 +1,921 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/keymgr"
+	"github.com/DanielKrawisz/bmagent/message/format"
+	"github.com/DanielKrawisz/bmagent/sieve"
+	"github.com/DanielKrawisz/bmagent/store"
+	"github.com/DanielKrawisz/bmutil/pow"
+	"github.com/jordwest/imap-server/types"
+)
+
+// command is an operation which can be performed by sending an e-mail
+// to <name>@bm.agent. The arguments are taken from the subject of the
+// e-mail, or from its body if the subject is empty.
+type command struct {
+	// The arguments that the command takes.
+	usage string
+
+	// Whether the command takes the whole body of the e-mail as its only
+	// argument instead.
+	wholeBody bool
+
+	// A short description of the command.
+	description string
+
+	// execute performs the command and returns the text of the reply.
+	execute func(u *User, args []string) (string, error)
+}
+
+// commands is the set of commands that bmagent understands, indexed by
+// name. It is filled in by init to avoid an initialization loop with the
+// help command.
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"help": &command{
+			description: "Show this list of commands.",
+			execute:     helpCommand,
+		},
+		"subscribe": &command{
+			usage:       "<address> [label]",
+			description: "Receive broadcasts from the given address.",
+			execute:     subscribeCommand,
+		},
+		"unsubscribe": &command{
+			usage:       "<address>",
+			description: "Stop receiving broadcasts from the given address.",
+			execute:     unsubscribeCommand,
+		},
+		"listsubscriptions": &command{
+			description: "List the addresses whose broadcasts are received.",
+			execute:     listSubscriptionsCommand,
+		},
+		"addcontact": &command{
+			usage:       "<address> [label]",
+			description: "Add an address to the address book. Messages from it are accepted whatever their proof-of-work.",
+			execute:     addContactCommand,
+		},
+		"removecontact": &command{
+			usage:       "<address>",
+			description: "Remove an address from the address book.",
+			execute:     removeContactCommand,
+		},
+		"listcontacts": &command{
+			description: "List the addresses in the address book.",
+			execute:     listContactsCommand,
+		},
+		"blacklist": &command{
+			usage:       "<address> [label]",
+			description: "Add an address to the blacklist. Its messages are blocked in blacklist mode.",
+			execute:     blacklistCommand,
+		},
+		"unblacklist": &command{
+			usage:       "<address>",
+			description: "Remove an address from the blacklist.",
+			execute:     unblacklistCommand,
+		},
+		"whitelist": &command{
+			usage:       "<address> [label]",
+			description: "Add an address to the whitelist. In whitelist mode, only its messages and those of the other addresses on the whitelist are accepted.",
+			execute:     whitelistCommand,
+		},
+		"unwhitelist": &command{
+			usage:       "<address>",
+			description: "Remove an address from the whitelist.",
+			execute:     unwhitelistCommand,
+		},
+		"filter": &command{
+			usage:       "[blacklist|whitelist] [drop|junk]",
+			description: "Show the blacklist and the whitelist, or set which of them decides whose messages are blocked and whether blocked messages are dropped or put in the Junk folder.",
+			execute:     filterCommand,
+		},
+		"difficulty": &command{
+			usage:       "<address> [<nonce trials per byte> <extra bytes>]",
+			description: "Show or set the proof-of-work that one of your addresses demands of messages sent to it.",
+			execute:     difficultyCommand,
+		},
+		"sieve": &command{
+			description: "Show the Sieve script which files incoming messages.",
+			execute:     sieveCommand,
+		},
+		"setsieve": &command{
+			usage:       "(the script goes in the body)",
+			description: "Replace the Sieve script which files incoming messages. The script supports the commands require, if, keep, discard, stop, fileinto and addflag and the tests header, address, envelope, exists, allof, anyof, not, true and false.",
+			wholeBody:   true,
+			execute:     setSieveCommand,
+		},
+		"removesieve": &command{
+			description: "Remove the Sieve script. Incoming messages go to the Inbox.",
+			execute:     removeSieveCommand,
+		},
+		"createchan": &command{
+			usage:       "<passphrase>",
+			description: "Create the chan with the given passphrase, the same way as PyBitmessage.",
+			execute:     createChanCommand,
+		},
+		"joinchan": &command{
+			usage:       "<address> <passphrase>",
+			description: "Join the chan with the given address and passphrase. The passphrase must generate the address.",
+			execute:     joinChanCommand,
+		},
+		"disable": &command{
+			usage:       "<address>",
+			description: "Stop receiving messages for one of your addresses and publishing its pubkey. Its keys are kept.",
+			execute:     disableCommand,
+		},
+		"enable": &command{
+			usage:       "<address>",
+			description: "Start receiving messages for a disabled address again.",
+			execute:     enableCommand,
+		},
+		"removeidentity": &command{
+			usage:       "<address>",
+			description: "Permanently remove an imported address or chan and its keys. Its messages are kept.",
+			execute:     removeIdentityCommand,
+		},
+		"retire": &command{
+			usage:       "<address>",
+			description: "Permanently disable an address derived from your seed, which cannot be removed.",
+			execute:     retireCommand,
+		},
+		"autoreply": &command{
+			usage:       "[address]",
+			description: "Show the automatic replies of your addresses.",
+			execute:     autoReplyCommand,
+		},
+		"setautoreply": &command{
+			usage:       "(the reply goes in the body)",
+			description: "Set the automatic reply of one of your addresses. The body begins with the lines Address: <address>, and optionally Subject: <subject>, Start: <date>, End: <date> and Window: <duration>, such as 7d, during which each sender is replied to only once. The text of the reply follows after an empty line.",
+			wholeBody:   true,
+			execute:     setAutoReplyCommand,
+		},
+		"removeautoreply": &command{
+			usage:       "<address>",
+			description: "Remove the automatic reply of one of your addresses.",
+			execute:     removeAutoReplyCommand,
+		},
+	}
+}
+
+// commandArgs returns the arguments of a command e-mail.
+func commandArgs(bmsg *Bitmessage) []string {
+	msg, ok := bmsg.Message.(*format.Encoding2)
+	if !ok {
+		return nil
+	}
+
+	args := strings.Fields(msg.Subject)
+	if len(args) == 0 {
+		args = strings.Fields(msg.Body)
+	}
+	return args
+}
+
+// commandBody returns the body of a command e-mail as its only argument.
+func commandBody(bmsg *Bitmessage) []string {
+	msg, ok := bmsg.Message.(*format.Encoding2)
+	if !ok {
+		return nil
+	}
+	return []string{msg.Body}
+}
+
+// commandAddress reads a Bitmessage address from a command argument, which
+// may be given either as a plain address or as an e-mail address.
+func commandAddress(arg string) (string, error) {
+	if bitmessageRegex.MatchString(arg) {
+		return arg, nil
+	}
+	return emailToBM(arg)
+}
+
+// executeCommand performs the command that an e-mail was sent to and puts
+// the reply in the Commands folder.
+func (u *User) executeCommand(bmsg *Bitmessage) error {
+	name := strings.Split(bmsg.To, "@")[0]
+	smtpLog.Debug("Command ", name, " received from ", bmsg.From)
+
+	var body string
+	cmd, ok := commands[name]
+	if !ok {
+		body = fmt.Sprintf("Unknown command %s. Send an e-mail to help@bm.agent for a list of commands.", name)
+	} else {
+		args := commandArgs(bmsg)
+		if cmd.wholeBody {
+			args = commandBody(bmsg)
+		}
+
+		var err error
+		body, err = cmd.execute(u, args)
+		if err != nil {
+			body = fmt.Sprintf("Error: %v\n\nUsage: %s@bm.agent %s", err, name, cmd.usage)
+		}
+	}
+
+	box := u.boxes[CommandsFolderName]
+	if box == nil {
+		return errors.New("Could not find commands folder.")
+	}
+
+	return box.AddNew(&Bitmessage{
+		From: bmsg.To,
+		To:   bmsg.From,
+		Message: &format.Encoding2{
+			Subject: fmt.Sprintf("Re: %s", name),
+			Body:    body,
+		},
+	}, types.FlagRecent)
+}
+
+func helpCommand(u *User, args []string) (string, error) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := ""
+	for _, name := range names {
+		cmd := commands[name]
+		list = fmt.Sprint(list, fmt.Sprintf("\t%s@bm.agent %s\n\t\t%s\n",
+			name, cmd.usage, cmd.description))
+	}
+
+	return fmt.Sprintf(commandWelcomeMsg, list), nil
+}
+
+func subscribeCommand(u *User, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+	label := strings.Join(args[1:], " ")
+
+	err = u.Subscribe(address, label)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Subscribed to %s. Broadcasts will be placed in %s.",
+		address, subscriptionFolderName(address, label)), nil
+}
+
+func unsubscribeCommand(u *User, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = u.Unsubscribe(address)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Unsubscribed from %s.", address), nil
+}
+
+func listSubscriptionsCommand(u *User, args []string) (string, error) {
+	subs, err := u.Subscriptions()
+	if err != nil {
+		return "", err
+	}
+	if len(subs) == 0 {
+		return "You are not subscribed to any addresses.", nil
+	}
+
+	addresses := make([]string, 0, len(subs))
+	for address := range subs {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	list := ""
+	for _, address := range addresses {
+		list = fmt.Sprint(list, fmt.Sprintf("\t%s %s\n", address, subs[address]))
+	}
+	return fmt.Sprintf("You are subscribed to the following addresses:\n\n%s", list), nil
+}
+
+func addContactCommand(u *User, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = u.server.Contacts().Add(address, strings.Join(args[1:], " "))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Added %s to the address book.", address), nil
+}
+
+func removeContactCommand(u *User, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = u.server.Contacts().Remove(address)
+	if err == store.ErrNotFound {
+		return "", fmt.Errorf("%s is not in the address book.", address)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Removed %s from the address book.", address), nil
+}
+
+func listContactsCommand(u *User, args []string) (string, error) {
+	contacts := make(map[string]string)
+	err := u.server.Contacts().ForEach(func(address string, contact *store.Contact) error {
+		if contact.AddressBook {
+			contacts[address] = contact.Label
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(contacts) == 0 {
+		return "Your address book is empty.", nil
+	}
+
+	addresses := make([]string, 0, len(contacts))
+	for address := range contacts {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	list := ""
+	for _, address := range addresses {
+		list = fmt.Sprint(list, fmt.Sprintf("\t%s %s\n", address, contacts[address]))
+	}
+	return fmt.Sprintf("Your address book contains the following addresses:\n\n%s", list), nil
+}
+
+// parseDifficulty reads the nonce trials per byte and extra bytes given to
+// the difficulty command. Neither may be less than the network minimum.
+func parseDifficulty(args []string) (nonceTrials, extraBytes uint64, err error) {
+	if len(args) != 2 {
+		return 0, 0, errors.New("Both nonce trials per byte and extra bytes are required.")
+	}
+
+	nonceTrials, err = strconv.ParseUint(args[0], 10, 64)
+	if err != nil || nonceTrials < pow.DefaultNonceTrialsPerByte {
+		return 0, 0, fmt.Errorf("Nonce trials per byte must be a number at least %d.",
+			pow.DefaultNonceTrialsPerByte)
+	}
+
+	extraBytes, err = strconv.ParseUint(args[1], 10, 64)
+	if err != nil || extraBytes < pow.DefaultExtraBytes {
+		return 0, 0, fmt.Errorf("Extra bytes must be a number at least %d.",
+			pow.DefaultExtraBytes)
+	}
+
+	return nonceTrials, extraBytes, nil
+}
+
+func difficultyCommand(u *User, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	if len(args) == 1 {
+		nonceTrials, extraBytes, err := u.keys.Difficulty(address)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s demands %d nonce trials per byte and %d extra bytes.",
+			address, nonceTrials, extraBytes), nil
+	}
+
+	nonceTrials, extraBytes, err := parseDifficulty(args[1:])
+	if err != nil {
+		return "", err
+	}
+
+	err = u.keys.SetDifficulty(address, nonceTrials, extraBytes)
+	if err != nil {
+		return "", err
+	}
+
+	// The new difficulty must be published in a new pubkey.
+	err = u.server.PublishPubkey(address)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s now demands %d nonce trials per byte and %d extra bytes. A new pubkey will be published.",
+		address, nonceTrials, extraBytes), nil
+}
+
+// addToList adds the address given in the arguments of a command to a
+// blacklist or whitelist.
+func addToList(list *store.AddressList, name string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = list.Add(address, strings.Join(args[1:], " "))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Added %s to the %s.", address, name), nil
+}
+
+// removeFromList removes the address given in the arguments of a command
+// from a blacklist or whitelist.
+func removeFromList(list *store.AddressList, name string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = list.Remove(address)
+	if err == store.ErrNotFound {
+		return "", fmt.Errorf("%s is not on the %s.", address, name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Removed %s from the %s.", address, name), nil
+}
+
+func blacklistCommand(u *User, args []string) (string, error) {
+	return addToList(u.server.SenderFilter().Blacklist, "blacklist", args)
+}
+
+func unblacklistCommand(u *User, args []string) (string, error) {
+	return removeFromList(u.server.SenderFilter().Blacklist, "blacklist", args)
+}
+
+func whitelistCommand(u *User, args []string) (string, error) {
+	return addToList(u.server.SenderFilter().Whitelist, "whitelist", args)
+}
+
+func unwhitelistCommand(u *User, args []string) (string, error) {
+	return removeFromList(u.server.SenderFilter().Whitelist, "whitelist", args)
+}
+
+// listAddresses returns the addresses in a blacklist or whitelist with their
+// labels, one per line.
+func listAddresses(list *store.AddressList) (string, error) {
+	labels := make(map[string]string)
+	err := list.ForEach(func(address, label string) error {
+		labels[address] = label
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(labels) == 0 {
+		return "\t(empty)\n", nil
+	}
+
+	addresses := make([]string, 0, len(labels))
+	for address := range labels {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	text := ""
+	for _, address := range addresses {
+		text = fmt.Sprint(text, fmt.Sprintf("\t%s %s\n", address, labels[address]))
+	}
+	return text, nil
+}
+
+// parseFilter reads the mode and action given to the filter command, which
+// may be given in either order. Those which are not given are nil.
+func parseFilter(args []string) (*store.FilterMode, *store.FilterAction, error) {
+	if len(args) > 2 {
+		return nil, nil, errors.New("Too many arguments.")
+	}
+
+	var mode *store.FilterMode
+	var action *store.FilterAction
+	for _, arg := range args {
+		if m, err := store.ParseFilterMode(arg); err == nil && mode == nil {
+			mode = &m
+		} else if a, err := store.ParseFilterAction(arg); err == nil && action == nil {
+			action = &a
+		} else {
+			return nil, nil, fmt.Errorf("Invalid argument %s.", arg)
+		}
+	}
+
+	return mode, action, nil
+}
+
+func filterCommand(u *User, args []string) (string, error) {
+	filter := u.server.SenderFilter()
+
+	mode, action, err := parseFilter(args)
+	if err != nil {
+		return "", err
+	}
+	if mode != nil {
+		if err = filter.SetMode(*mode); err != nil {
+			return "", err
+		}
+	}
+	if action != nil {
+		if err = filter.SetAction(*action); err != nil {
+			return "", err
+		}
+	}
+
+	m, err := filter.Mode()
+	if err != nil {
+		return "", err
+	}
+	a, err := filter.Action()
+	if err != nil {
+		return "", err
+	}
+	blacklist, err := listAddresses(filter.Blacklist)
+	if err != nil {
+		return "", err
+	}
+	whitelist, err := listAddresses(filter.Whitelist)
+	if err != nil {
+		return "", err
+	}
+
+	var blocked, fate string
+	if m == store.WhitelistMode {
+		blocked = "Messages from addresses which are not on the whitelist are blocked."
+	} else {
+		blocked = "Messages from addresses on the blacklist are blocked."
+	}
+	if a == store.JunkBlocked {
+		fate = "They are put in the Junk folder and are not acknowledged."
+	} else {
+		fate = "They are dropped and are not acknowledged."
+	}
+
+	return fmt.Sprintf("The filter is in %s mode. %s %s\n\nBlacklist:\n%s\nWhitelist:\n%s",
+		m, blocked, fate, blacklist, whitelist), nil
+}
+
+func sieveCommand(u *User, args []string) (string, error) {
+	script, err := u.server.SieveScript().Get()
+	if err != nil {
+		return "", err
+	}
+	if script == "" {
+		return "There is no Sieve script. Incoming messages go to the Inbox.", nil
+	}
+	return script, nil
+}
+
+func setSieveCommand(u *User, args []string) (string, error) {
+	if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+		return "", errors.New("A script is required.")
+	}
+
+	if _, err := sieve.Parse(args[0]); err != nil {
+		return "", err
+	}
+
+	err := u.server.SieveScript().Set(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	return "The Sieve script has been saved.", nil
+}
+
+func removeSieveCommand(u *User, args []string) (string, error) {
+	err := u.server.SieveScript().Set("")
+	if err != nil {
+		return "", err
+	}
+
+	return "The Sieve script has been removed. Incoming messages go to the Inbox.", nil
+}
+
+// autoReplyDateFormats are the formats in which the dates of an automatic
+// reply may be given, in local time.
+var autoReplyDateFormats = []string{
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseAutoReplyDate reads the start or end date of an automatic reply. If
+// the end is given as a day, the reply is sent until the end of that day.
+func parseAutoReplyDate(value string, end bool) (time.Time, error) {
+	for _, layout := range autoReplyDateFormats {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if end && len(layout) == len("2006-01-02") {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid date %s. Use the form YYYY-MM-DD [hh:mm].", value)
+}
+
+// parseWindow reads the window of an automatic reply, which is either a
+// number of days, such as 7d, or a duration such as 12h.
+func parseWindow(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(value, "d"), 10, 16)
+		if err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("Invalid window %s.", value)
+}
+
+// parseAutoReply reads the body of a setautoreply e-mail, which begins with
+// lines of the form <field>: <value> followed by an empty line and the text
+// of the reply.
+func parseAutoReply(text string) (string, *store.AutoReply, error) {
+	var address string
+	reply := &store.AutoReply{}
+
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	lines := strings.Split(text, "\n")
+	var i int
+	for i = 0; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+		field := strings.SplitN(lines[i], ":", 2)
+		if len(field) != 2 {
+			return "", nil, fmt.Errorf("Invalid line %s.", lines[i])
+		}
+		value := strings.TrimSpace(field[1])
+
+		var err error
+		switch strings.ToLower(strings.TrimSpace(field[0])) {
+		case "address":
+			address, err = commandAddress(value)
+		case "subject":
+			reply.Subject = value
+		case "start":
+			reply.Start, err = parseAutoReplyDate(value, false)
+		case "end":
+			reply.End, err = parseAutoReplyDate(value, true)
+		case "window":
+			reply.Window, err = parseWindow(value)
+		default:
+			err = fmt.Errorf("Unknown field %s.", field[0])
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if address == "" {
+		return "", nil, errors.New("An address is required.")
+	}
+	if !reply.Start.IsZero() && !reply.End.IsZero() && !reply.End.After(reply.Start) {
+		return "", nil, errors.New("The end must be after the start.")
+	}
+	if i < len(lines) {
+		reply.Body = strings.TrimSpace(strings.Join(lines[i+1:], "\n"))
+	}
+	if reply.Body == "" {
+		return "", nil, errors.New("The text of the reply is required.")
+	}
+
+	return address, reply, nil
+}
+
+// describeAutoReply describes the automatic reply of one of the user's
+// addresses.
+func describeAutoReply(address string, reply *store.AutoReply) string {
+	var when string
+	switch {
+	case reply.Start.IsZero() && reply.End.IsZero():
+		when = "always"
+	case reply.End.IsZero():
+		when = fmt.Sprintf("from %s", reply.Start.Format(autoReplyDateFormats[0]))
+	case reply.Start.IsZero():
+		when = fmt.Sprintf("until %s", reply.End.Format(autoReplyDateFormats[0]))
+	default:
+		when = fmt.Sprintf("from %s until %s", reply.Start.Format(autoReplyDateFormats[0]),
+			reply.End.Format(autoReplyDateFormats[0]))
+	}
+
+	often := "once"
+	if reply.Window != 0 {
+		often = fmt.Sprintf("once every %s", reply.Window)
+	}
+
+	subject := reply.Subject
+	if subject == "" {
+		subject = "(the subject of the message)"
+	}
+
+	return fmt.Sprintf("%s replies %s to each sender, %s.\nSubject: %s\n\n%s\n",
+		address, often, when, subject, reply.Body)
+}
+
+func autoReplyCommand(u *User, args []string) (string, error) {
+	replies := u.server.AutoReplies()
+
+	if len(args) > 0 {
+		address, err := commandAddress(args[0])
+		if err != nil {
+			return "", err
+		}
+		reply, err := replies.Get(address)
+		if err == store.ErrNotFound {
+			return fmt.Sprintf("%s has no automatic reply.", address), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return describeAutoReply(address, reply), nil
+	}
+
+	text := ""
+	err := replies.ForEach(func(address string, reply *store.AutoReply) error {
+		text = fmt.Sprint(text, describeAutoReply(address, reply), "\n")
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if text == "" {
+		return "None of your addresses has an automatic reply.", nil
+	}
+	return text, nil
+}
+
+func setAutoReplyCommand(u *User, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, reply, err := parseAutoReply(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	id := u.server.GetPrivateID(address)
+	if id == nil {
+		return "", fmt.Errorf("%s is not one of your addresses.", address)
+	}
+	if id.IsChan {
+		return "", errors.New("Chans cannot reply automatically.")
+	}
+
+	err = u.server.AutoReplies().Set(address, reply)
+	if err != nil {
+		return "", err
+	}
+
+	return describeAutoReply(address, reply), nil
+}
+
+func removeAutoReplyCommand(u *User, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = u.server.AutoReplies().Remove(address)
+	if err == store.ErrNotFound {
+		return "", fmt.Errorf("%s has no automatic reply.", address)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("The automatic reply of %s has been removed.", address), nil
+}
+
+// chanJoined returns the reply to the createchan and joinchan commands.
+func chanJoined(id *keymgr.PrivateID, err error) (string, error) {
+	if err == keymgr.ErrDuplicateIdentity {
+		return fmt.Sprintf("You are already in chan %s.", id.Address()), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Joined chan %s. Its messages appear in %s.", id.Address(),
+		ChansFolderName+FolderDelimiter+folderLabel(id.Name, id.Address())), nil
+}
+
+func createChanCommand(u *User, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("A passphrase is required.")
+	}
+
+	return chanJoined(u.keys.CreateChan(strings.Join(args, " ")))
+}
+
+func joinChanCommand(u *User, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("An address and a passphrase are required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	return chanJoined(u.keys.JoinChan(strings.Join(args[1:], " "), address))
+}
+
+// identityCommand performs one of the commands which change the state of
+// one of the user's identities and returns the reply.
+func identityCommand(args []string, f func(address string) error, reply string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("An address is required.")
+	}
+
+	address, err := commandAddress(args[0])
+	if err != nil {
+		return "", err
+	}
+
+	err = f(address)
+	switch err {
+	case nil:
+		return fmt.Sprintf(reply, address), nil
+	case keymgr.ErrDerivedIdentity:
+		return "", fmt.Errorf("%s is derived from your seed and cannot be removed. Send it to retire@bm.agent instead.", address)
+	case keymgr.ErrImportedIdentity:
+		return "", fmt.Errorf("%s is imported. Send it to removeidentity@bm.agent instead.", address)
+	default:
+		return "", err
+	}
+}
+
+func disableCommand(u *User, args []string) (string, error) {
+	return identityCommand(args, u.keys.DisableIdentity,
+		"%s has been disabled.")
+}
+
+func enableCommand(u *User, args []string) (string, error) {
+	return identityCommand(args, u.keys.EnableIdentity,
+		"%s has been enabled.")
+}
+
+func removeIdentityCommand(u *User, args []string) (string, error) {
+	return identityCommand(args, u.keys.RemoveImported,
+		"%s and its keys have been removed.")
+}
+
+func retireCommand(u *User, args []string) (string, error) {
+	return identityCommand(args, u.keys.RetireIdentity,
+		"%s has been retired.")
+}
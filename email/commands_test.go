@@ -0,0 +1,323 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/keymgr"
+	"github.com/DanielKrawisz/bmagent/message/format"
+	"github.com/DanielKrawisz/bmagent/store"
+	"github.com/DanielKrawisz/bmagent/store/mem"
+	"github.com/jordwest/imap-server/types"
+)
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		subject  string
+		body     string
+		expected []string
+	}{
+		{"BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP Bitmessage news", "ignored",
+			[]string{"BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP", "Bitmessage", "news"}},
+		{"  ", "BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP\n",
+			[]string{"BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP"}},
+		{"", "", []string{}},
+	}
+
+	for i, test := range tests {
+		args := commandArgs(&Bitmessage{
+			Message: &format.Encoding2{Subject: test.subject, Body: test.body},
+		})
+		if len(args) != len(test.expected) ||
+			(len(args) > 0 && !reflect.DeepEqual(args, test.expected)) {
+			t.Errorf("Test %d: expected %v got %v", i, test.expected, args)
+		}
+	}
+}
+
+func TestCommandAddress(t *testing.T) {
+	tests := []struct {
+		arg   string
+		valid bool
+	}{
+		{"BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP", true},
+		{"BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP@bm.addr", true},
+		{"moo@zork.com", false},
+		{"label", false},
+	}
+
+	for i, test := range tests {
+		addr, err := commandAddress(test.arg)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if test.valid && addr != "BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP" {
+			t.Errorf("Test %d: got address %s", i, addr)
+		}
+	}
+}
+
+func TestParseDifficulty(t *testing.T) {
+	tests := []struct {
+		args        []string
+		valid       bool
+		nonceTrials uint64
+		extraBytes  uint64
+	}{
+		{[]string{"1000", "1000"}, true, 1000, 1000},
+		{[]string{"4000", "2000"}, true, 4000, 2000},
+		{[]string{"999", "1000"}, false, 0, 0},
+		{[]string{"1000", "10"}, false, 0, 0},
+		{[]string{"lots", "1000"}, false, 0, 0},
+		{[]string{"1000"}, false, 0, 0},
+	}
+
+	for i, test := range tests {
+		nonceTrials, extraBytes, err := parseDifficulty(test.args)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if nonceTrials != test.nonceTrials || extraBytes != test.extraBytes {
+			t.Errorf("Test %d: expected %d, %d got %d, %d", i,
+				test.nonceTrials, test.extraBytes, nonceTrials, extraBytes)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	white, black := store.WhitelistMode, store.BlacklistMode
+	drop, junk := store.DropBlocked, store.JunkBlocked
+	tests := []struct {
+		args   []string
+		valid  bool
+		mode   *store.FilterMode
+		action *store.FilterAction
+	}{
+		{[]string{}, true, nil, nil},
+		{[]string{"whitelist"}, true, &white, nil},
+		{[]string{"Junk"}, true, nil, &junk},
+		{[]string{"blacklist", "drop"}, true, &black, &drop},
+		{[]string{"junk", "whitelist"}, true, &white, &junk},
+		{[]string{"whitelist", "blacklist"}, false, nil, nil},
+		{[]string{"greylist"}, false, nil, nil},
+		{[]string{"whitelist", "junk", "drop"}, false, nil, nil},
+	}
+
+	for i, test := range tests {
+		mode, action, err := parseFilter(test.args)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(mode, test.mode) || !reflect.DeepEqual(action, test.action) {
+			t.Errorf("Test %d: expected %v, %v got %v, %v", i,
+				test.mode, test.action, mode, action)
+		}
+	}
+}
+
+func TestCommandBody(t *testing.T) {
+	script := "require \"fileinto\";\r\nfileinto \"Archive\";\r\n"
+	args := commandBody(&Bitmessage{
+		Message: &format.Encoding2{Subject: "ignored", Body: script},
+	})
+	if !reflect.DeepEqual(args, []string{script}) {
+		t.Errorf("Expected %q got %q", []string{script}, args)
+	}
+}
+
+func TestSieveFlags(t *testing.T) {
+	tests := []struct {
+		flags    []string
+		expected types.Flags
+	}{
+		{nil, types.FlagRecent},
+		{[]string{"\\Seen"}, types.FlagRecent | types.FlagSeen},
+		{[]string{"\\FLAGGED", "$Friend", "\\answered"},
+			types.FlagRecent | types.FlagFlagged | types.FlagAnswered},
+		{[]string{"\\Deleted", "\\Draft", "Seen"},
+			types.FlagRecent | types.FlagDeleted | types.FlagDraft},
+	}
+
+	for i, test := range tests {
+		flags := sieveFlags(test.flags)
+		if flags != test.expected {
+			t.Errorf("Test %d: expected %v got %v", i, test.expected, flags)
+		}
+	}
+}
+
+// sieveOps provides a Sieve script to a User.
+type sieveOps struct {
+	ServerOps
+	script *store.SieveScript
+}
+
+func (s *sieveOps) SieveScript() *store.SieveScript {
+	return s.script
+}
+
+func TestSieveFolder(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	data, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		folder   string
+		expected string
+	}{
+		{"INBOX", InboxFolderName},
+		{"Junk", JunkFolderName},
+		{"Archive", "Archive"},
+		{"Sent", InboxFolderName},
+		{"Trash", InboxFolderName},
+		{"Outbox", InboxFolderName},
+		{"Nowhere", InboxFolderName},
+	}
+
+	for i, test := range tests {
+		err = data.SieveScript.Set("require \"fileinto\";\r\nfileinto \"" + test.folder + "\";\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u := &User{
+			boxes:  make(map[string]*mailbox),
+			server: &sieveOps{script: data.SieveScript},
+		}
+		for _, name := range []string{InboxFolderName, OutboxFolderName,
+			SentFolderName, TrashFolderName, JunkFolderName, "Archive"} {
+			box, err := NewMailbox(mem.NewFolder(name), make(map[string]string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.boxes[name] = box
+		}
+
+		err = u.DeliverFromBMNet(&Bitmessage{
+			From:    "BM-2cUJvFYHhXpBHyd96KHfjxsgTYi44BajdE@bm.addr",
+			To:      "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq@bm.addr",
+			Message: &format.Encoding2{Subject: "subject", Body: "body"},
+		})
+		if err != nil {
+			t.Errorf("Test %d: got error %v", i, err)
+			continue
+		}
+
+		for name, box := range u.boxes {
+			expected := uint32(0)
+			if name == test.expected {
+				expected = 1
+			}
+			if box.Messages() != expected {
+				t.Errorf("Test %d: expected %d messages in %s, got %d",
+					i, expected, name, box.Messages())
+			}
+		}
+	}
+}
+
+func TestParseAutoReply(t *testing.T) {
+	address := "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq"
+	tests := []struct {
+		text  string
+		valid bool
+		reply *store.AutoReply
+	}{
+		{"Address: " + address + "\r\n\r\nI am away.\r\n", true,
+			&store.AutoReply{Body: "I am away."}},
+		{"address: " + address + "@bm.addr\nSUBJECT: Out of office\nStart: 2016-07-01\n" +
+			"End: 2016-07-15\nWindow: 7d\n\nI am away.\n\nBack soon.", true,
+			&store.AutoReply{
+				Subject: "Out of office",
+				Body:    "I am away.\n\nBack soon.",
+				Start:   time.Date(2016, time.July, 1, 0, 0, 0, 0, time.Local),
+				End:     time.Date(2016, time.July, 16, 0, 0, 0, 0, time.Local),
+				Window:  7 * 24 * time.Hour,
+			}},
+		{"Address: " + address + "\nEnd: 2016-07-15 12:30\nWindow: 36h\n\nAway.", true,
+			&store.AutoReply{
+				Body:   "Away.",
+				End:    time.Date(2016, time.July, 15, 12, 30, 0, 0, time.Local),
+				Window: 36 * time.Hour,
+			}},
+		{"Subject: No address\n\nI am away.", false, nil},
+		{"Address: " + address + "\n\n", false, nil},
+		{"Address: " + address + "\nStart: July\n\nAway.", false, nil},
+		{"Address: " + address + "\nWindow: a week\n\nAway.", false, nil},
+		{"Address: " + address + "\nStart: 2016-07-15\nEnd: 2016-07-01\n\nAway.", false, nil},
+		{"Address: " + address + "\nColor: blue\n\nAway.", false, nil},
+		{"Address: " + address + "\nI am away.", false, nil},
+	}
+
+	for i, test := range tests {
+		addr, reply, err := parseAutoReply(test.text)
+		if test.valid != (err == nil) {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		if addr != address {
+			t.Errorf("Test %d: expected address %s got %s", i, address, addr)
+		}
+		if !reflect.DeepEqual(reply, test.reply) {
+			t.Errorf("Test %d: expected %v got %v", i, test.reply, reply)
+		}
+	}
+}
+
+func TestIdentityCommand(t *testing.T) {
+	address := "BM-NBPVwY5A26MtyfbHyh4UfA4Hn76DamAP"
+	var got string
+	f := func(err error) func(string) error {
+		return func(a string) error {
+			got = a
+			return err
+		}
+	}
+
+	reply, err := identityCommand([]string{address}, f(nil), "%s done.")
+	if err != nil || reply != address+" done." || got != address {
+		t.Errorf("Unexpected reply %q, %v for %s", reply, err, got)
+	}
+	if _, err = identityCommand(nil, f(nil), "%s"); err == nil {
+		t.Error("Expected error without an address.")
+	}
+	if _, err = identityCommand([]string{"not an address"}, f(nil), "%s"); err == nil {
+		t.Error("Expected error for an invalid address.")
+	}
+	if _, err = identityCommand([]string{address}, f(keymgr.ErrDerivedIdentity), "%s"); err == nil ||
+		!strings.Contains(err.Error(), "retire@bm.agent") {
+		t.Errorf("Expected to be told to retire the address, got %v", err)
+	}
+}
@@ -14,7 +14,8 @@ You have the following addresses available:
 %s
 
 To send a bitmessage, write an email with an address of the
-form <destination bitmessage address>@bm.addr. For sending out a broadcast,
+form <destination bitmessage address>@bm.addr, or <label>@bm.contacts for
+a contact in your address book. For sending out a broadcast,
 shoot an e-mail to broadcast@bm.addr. Don't forget to add valid From addresses
 in your e-mail client! From addresses are considered valid if bmagent holds
 private keys for them. You can also send commands to bmagent via the address
@@ -31,7 +32,11 @@ You have generated the following new addresses:
 You can now receive and send messages with these addresses.`
 
 const commandWelcomeMsg = `
-(put a list of commands here.)`
+You can control bmagent by sending e-mails to the following addresses. The
+arguments of a command are written in the subject of the e-mail. The reply
+will appear in the Commands folder.
+
+%s`
 
 const (
 	// InboxFolderName is the default name for the inbox folder.
@@ -57,7 +62,26 @@ const (
 	// DraftsFolderName is the default name for the drafts folder.
 	DraftsFolderName = "Drafts"
 
+	// JunkFolderName is the default name for the folder containing messages
+	// from blocked senders.
+	JunkFolderName = "Junk"
+
 	// CommandsFolderName is the default name for the folder containing
 	// responses to sent commands.
 	CommandsFolderName = "Commands"
+
+	// IdentitiesFolderName is the name of the parent of the virtual folders
+	// which show the messages belonging to each identity.
+	IdentitiesFolderName = "Identities"
+
+	// ChansFolderName is the name of the parent of the virtual folders
+	// which show the messages belonging to each chan.
+	ChansFolderName = "Chans"
+
+	// SubscriptionsFolderName is the name of the parent of the folders
+	// which contain the broadcasts from each subscription.
+	SubscriptionsFolderName = "Subscriptions"
+
+	// FolderDelimiter separates the parts of a hierarchical folder name.
+	FolderDelimiter = "/"
 )
@@ -73,6 +73,10 @@ func InitializeUser(u *store.UserData, keys *keymgr.Manager, GenKeys int16) erro
 	if err != nil {
 		return err
 	}
+	_, err = u.NewFolder(JunkFolderName)
+	if err != nil {
+		return err
+	}
 	_, err = u.NewFolder(CommandsFolderName)
 	if err != nil {
 		return err
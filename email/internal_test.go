@@ -8,3 +8,19 @@ package email
 func TstGetContentType(contentType string) (content, subtype string, param map[string]string, err error) {
 	return getContentType(contentType)
 }
+
+func TstNewView(base Mailbox, name string, sub func(*Bitmessage) bool) (Mailbox, error) {
+	return newView(base.(*mailbox), name, sub, "", nil)
+}
+
+func TstNewSenderView(base Mailbox, name string, sub func(*Bitmessage) bool, sender string) (Mailbox, error) {
+	return newView(base.(*mailbox), name, sub, senderIndex, addressIndexKey(sender))
+}
+
+func TstSetExpunged(box Mailbox, expunged func(*Bitmessage)) {
+	box.(*mailbox).expunged = expunged
+}
+
+func TstSetHeaders(box Mailbox, headers func(*Bitmessage) map[string][]string) {
+	box.(*mailbox).headers = headers
+}
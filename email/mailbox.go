@@ -6,8 +6,8 @@
 package email
 
 import (
-	"bytes"
 	"container/list"
+	"encoding/binary"
 	"errors"
 	"math"
 	"sync"
@@ -119,28 +119,151 @@ type mailbox struct {
 	addresses    map[string]string
 	drafts       bool // Whether this is a drafts folder. 
 	
-	sync.RWMutex // Protect the following fields.
+	// name overrides the name of mbox. It is used for virtual mailboxes,
+	// which present a filtered view of another mailbox's folder.
+	name         string
+	
+	// base is the mailbox that this virtual mailbox is a view of. It is
+	// nil for ordinary mailboxes.
+	base         *mailbox
+	
+	// expunged is called for every message that the user deletes from
+	// the mailbox or from one of its views. Can be nil. 
+	expunged     func(*Bitmessage)
+	
+	// headers returns extra headers to show in a message of the mailbox 
+	// or of one of its views. Can be nil. 
+	headers      func(*Bitmessage) map[string][]string
+	
+	// label returns the name to show for a Bitmessage address which is 
+	// not in addresses, or the empty string if there is none. Can be nil. 
+	label        func(string) string
+	
+	// The mutex is shared between a mailbox and all of its views since 
+	// they read and write the same folder. 
+	*sync.RWMutex // Protect the following fields.
+	cache        *bitmessageCache // Shared with the views.
+	views        []*mailbox // The virtual mailboxes based on this one.
 	uids         MessageSequence
 	numRecent    uint32
 	numUnseen    uint32
 	nextUID      uint32
 }
 
-func (box *mailbox) decodeBitmessageForImap(uid uint64, seqno uint32, msg []byte) *Bitmessage {
-	b, err := DecodeBitmessage(msg)
+// Names of the secondary indexes kept in the folder of every mailbox.
+const (
+	powIndex       = "pow"
+	recipientIndex = "recipient"
+	senderIndex    = "sender"
+	ackIndex       = "ack"
+)
+
+// indexKeys returns the keys under which a Bitmessage is found in each of
+// the secondary indexes. 
+func indexKeys(bmsg *Bitmessage) map[string][]byte {
+	keys := map[string][]byte{
+		powIndex:       nil,
+		recipientIndex: nil,
+		senderIndex:    nil,
+		ackIndex:       bmsg.Ack,
+	}
+	
+	if bmsg.state != nil && bmsg.state.PowIndex != 0 {
+		keys[powIndex] = powIndexKey(bmsg.state.PowIndex)
+	}
+	
+	if bmsg.To != "" {
+		keys[recipientIndex] = addressIndexKey(bmsg.To)
+	}
+	
+	if bmsg.From != "" {
+		keys[senderIndex] = addressIndexKey(bmsg.From)
+	}
+	
+	return keys
+}
+
+// powIndexKey returns the key of a pow index in the secondary index. 
+func powIndexKey(index uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+	return k
+}
+
+// addressIndexKey returns the key of a recipient or a sender in the 
+// secondary indexes. Bitmessage addresses are indexed without the e-mail 
+// domain.
+func addressIndexKey(address string) []byte {
+	if addr, err := emailToBM(address); err == nil {
+		return []byte(addr)
+	}
+	return []byte(address)
+}
+
+// index updates the secondary indexes of the folder for a message.
+func (box *mailbox) index(uid uint64, bmsg *Bitmessage) error {
+	for index, key := range indexKeys(bmsg) {
+		if err := box.mbox.SetIndex(index, uid, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the uids of the messages in the mailbox which are found
+// under the given key in a secondary index. 
+func (box *mailbox) lookup(index string, key []byte) ([]uint64, error) {
+	ids, err := box.mbox.Lookup(index, key)
+	if err != nil {
+		return nil, err
+	}
+	
+	uids := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		if box.contains(id) {
+			uids = append(uids, id)
+		}
+	}
+	return uids, nil
+}
+
+// fetch returns the Bitmessage with the given uid from the folder, whether
+// or not it belongs to this mailbox. Decoded messages are kept in the cache,
+// and the message returned may be modified freely. 
+func (box *mailbox) fetch(uid uint64) *Bitmessage {
+	if bmsg := box.cache.get(uid); bmsg != nil {
+		return bmsg
+	}
+	
+	suffix, msg, err := box.mbox.GetMessage(uid)
+	if err != nil {
+		imapLog.Errorf("Mailbox(%s).GetMessage gave error: %v", box.Name(), err)
+		return nil
+	}
+	if suffix != 2 {
+		imapLog.Errorf("For message #%d expected suffix %d got %d", uid, 2, suffix)
+		return nil
+	}
+	
+	bmsg, err := DecodeBitmessage(msg)
 	if err != nil {
 		imapLog.Errorf("DecodeBitmessage for #%d failed: %v", uid, err)
 		return nil
 	}
-	b.ImapData.UID = uid
-	b.ImapData.SequenceNumber = seqno
-	b.ImapData.Mailbox = box
-	return b
+	if bmsg.ImapData == nil {
+		bmsg.ImapData = &ImapData{}
+	}
+	
+	box.cache.put(uid, bmsg)
+	return bmsg
 }
 
 // Name returns the name of the mailbox.
 // This is part of the mailstore.Mailbox interface.
 func (box *mailbox) Name() string {
+	if box.name != "" {
+		return box.name
+	}
 	return box.mbox.Name()
 }
 
@@ -155,10 +278,62 @@ func (box *mailbox) updateMailboxStats(entry *Bitmessage, id uint64) {
 	}
 }
 
-// refresh updates cached statistics like number of messages in inbox,
-// next UID, last UID, number of recent/unread messages etc. It is meant to
-// be called after the mailbox has been modified by an agent other than the
-// IMAP server. This could be the SMTP server, or new message from bmd.
+// removeMailboxStats undoes updateMailboxStats for a message which is 
+// removed from the mailbox. 
+func (box *mailbox) removeMailboxStats(entry *Bitmessage) {
+	if entry.ImapData.Flags.HasFlags(types.FlagRecent) {
+		box.numRecent--
+	}
+	if !entry.ImapData.Flags.HasFlags(types.FlagSeen) {
+		box.numUnseen--
+	}
+}
+
+// belongs returns whether a message in the folder belongs in this mailbox.
+func (box *mailbox) belongs(bmsg *Bitmessage) bool {
+	return box.sub == nil || box.sub(bmsg)
+}
+
+// added updates the state of the mailbox for a message which has been 
+// saved in the folder. 
+func (box *mailbox) added(uid uint64, bmsg *Bitmessage) {
+	box.nextUID = uint32(box.mbox.NextID())
+	
+	if !box.belongs(bmsg) {
+		return
+	}
+	
+	box.updateMailboxStats(bmsg, uid)
+	
+	// New messages almost always have the highest uid.
+	i := len(box.uids)
+	if i > 0 && box.uids[i-1] > uid {
+		i = int(box.uids.GetSequenceNumber(uid)) - 1
+	}
+	
+	box.uids = append(box.uids, 0)
+	copy(box.uids[i+1:], box.uids[i:])
+	box.uids[i] = uid
+}
+
+// removed updates the state of the mailbox for a message which has been 
+// removed from the folder or replaced by a new version. 
+func (box *mailbox) removed(uid uint64, bmsg *Bitmessage) {
+	if !box.contains(uid) {
+		return
+	}
+	
+	box.removeMailboxStats(bmsg)
+	
+	i := box.uids.GetSequenceNumber(uid) - 1
+	box.uids = append(box.uids[:i], box.uids[i+1:]...)
+}
+
+// refresh reads the whole folder to find the uids of the messages in the
+// mailbox and count the recent and unseen messages. It is called when the 
+// mailbox is created; after that, the state of the mailbox is kept up to 
+// date as messages are saved and deleted. If the secondary indexes of the 
+// folder have not been built, refresh builds them. 
 func (box *mailbox) refresh() error {
 
 	// Set NextUID
@@ -167,6 +342,15 @@ func (box *mailbox) refresh() error {
 	box.numRecent = 0
 	box.numUnseen = 0
 	list := list.New()
+	
+	reindex := false
+	if box.base == nil {
+		for index := range indexKeys(&Bitmessage{}) {
+			if !box.mbox.HasIndex(index) {
+				reindex = true
+			}
+		}
+	}
 
 	// Run through every message to get the uids, count the recent and
 	// unseen messages, and to update pkrequests and powqueue.
@@ -176,8 +360,14 @@ func (box *mailbox) refresh() error {
 			return imapLog.Errorf("Failed to decode message #%d: %v", id, err)
 		}
 		
+		if reindex {
+			if err := box.index(id, entry); err != nil {
+				return err
+			}
+		}
+		
 		// Only include messages that belong in this mailbox. 
-		if box.sub != nil && !box.sub(entry) {
+		if !box.belongs(entry) {
 			return nil
 		}
 
@@ -201,6 +391,17 @@ func (box *mailbox) refresh() error {
 	return nil
 }
 
+// group returns the mailboxes which read from the same folder as this one, 
+// including this one. 
+func (box *mailbox) group() []*mailbox {
+	base := box
+	if box.base != nil {
+		base = box.base
+	}
+	
+	return append([]*mailbox{base}, base.views...)
+}
+
 // NextUID returns the unique identifier that will LIKELY be assigned
 // to the next mail that is added to this mailbox.
 // This is part of the mailstore.Mailbox interface.
@@ -218,9 +419,19 @@ func (box *mailbox) LastUID() uint32 {
 	box.RLock()
 	defer box.RUnlock()
 
+	if len(box.uids) == 0 {
+		return box.nextUID
+	}
 	return uint32(box.uids[len(box.uids)-1])
 }
 
+// contains returns whether the message with the given uid belongs to the 
+// mailbox.
+func (box *mailbox) contains(uid uint64) bool {
+	seq := box.uids.GetSequenceNumber(uid)
+	return int(seq) <= len(box.uids) && box.uids[seq-1] == uid
+}
+
 // Recent returns the number of recent messages in the mailbox.
 // This is part of the mailstore.Mailbox interface.
 func (box *mailbox) Recent() uint32 {
@@ -274,7 +485,7 @@ func (box *mailbox) MessageBySequenceNumber(seqno uint32) mailstore.Message {
 	if bm == nil {
 		return nil
 	}
-	email, err := bm.ToEmail()
+	email, err := box.toEmail(bm)
 	if err != nil {
 		imapLog.Errorf("MessageBySequenceNumber(%d) gave error %v", seqno, err)
 		return nil
@@ -291,17 +502,15 @@ func (box *mailbox) bmsgByUID(uid uint64) *Bitmessage {
 		return nil
 	}
 	
-	suffix, msg, err := box.mbox.GetMessage(uid)
-	if err != nil {
-		imapLog.Errorf("Mailbox(%s).GetMessage gave error: %v", box.Name(), err)
-		return nil
-	}
-	if suffix != 2 {
-		imapLog.Errorf("For message #%d expected suffix %d got %d", uid, 2, suffix)
+	bmsg := box.fetch(uid)
+	if bmsg == nil {
 		return nil
 	}
-
-	return box.decodeBitmessageForImap(uid, seqno, msg)
+	
+	bmsg.ImapData.UID = uid
+	bmsg.ImapData.SequenceNumber = seqno
+	bmsg.ImapData.Mailbox = box
+	return bmsg
 }
 
 // BitmessageByUID returns a Bitmessage by its uid.
@@ -322,13 +531,26 @@ func (box *mailbox) MessageByUID(uid uint32) mailstore.Message {
 	if letter == nil {
 		return nil
 	}
-	email, err := letter.ToEmail()
+	email, err := box.toEmail(letter)
 	if err != nil {
 		imapLog.Errorf("Failed to convert message #%d to e-mail: %v", uid, err)
 	}
 	return email
 }
 
+// toEmail converts a Bitmessage in the mailbox into an IMAPEmail.
+func (box *mailbox) toEmail(bmsg *Bitmessage) (*IMAPEmail, error) {
+	headers := box.headers
+	if box.base != nil {
+		headers = box.base.headers
+	}
+	
+	if headers == nil {
+		return bmsg.ToEmail()
+	}
+	return bmsg.toEmail(headers(bmsg))
+}
+
 // lastBitmessage returns the last Bitmessage in the mailbox.
 func (box *mailbox) lastBitmessage() *Bitmessage {
 	if box.messages() == 0 {
@@ -343,27 +565,27 @@ func (box *mailbox) lastBitmessage() *Bitmessage {
 // startUID to endUID. It does not check whether the given sequence numbers make
 // sense.
 func (box *mailbox) getRange(startUID, endUID uint64, startSequence, endSequence uint32) []*Bitmessage {
+	if endSequence > box.messages() {
+		endSequence = box.messages()
+	}
+	if startSequence < 1 || startSequence > endSequence {
+		return []*Bitmessage{}
+	}
+	
 	bitmessages := make([]*Bitmessage, 0, endSequence-startSequence+1)
 
-	i := uint32(0)
-	err := box.mbox.ForEachMessage(startUID, endUID, 2, func(id, suffix uint64, msg []byte) error {
-		
-		bm := box.decodeBitmessageForImap(id, startSequence+i, msg)
-		if bm == nil {
-			return nil // Skip this message, error has already been logged.
+	for seqno := startSequence; seqno <= endSequence; seqno++ {
+		uid := box.uids[seqno-1]
+		if uid < startUID || (endUID != 0 && uid > endUID) {
+			continue
 		}
 		
-		if box.sub != nil && !box.sub(bm) {
-			return nil
+		bm := box.bitmessageBySequenceNumber(seqno)
+		if bm == nil {
+			continue // Skip this message, error has already been logged.
 		}
 		
 		bitmessages = append(bitmessages, bm)
-		
-		i++
-		return nil
-	})
-	if err != nil {
-		return nil
 	}
 	return bitmessages
 }
@@ -555,7 +777,7 @@ func (box *mailbox) MessageSetByUID(set types.SequenceSet) []mailstore.Message {
 		if msg == nil {
 			panic("nil bitmessage returned!")
 		}
-		email[i], err = msg.ToEmail()
+		email[i], err = box.toEmail(msg)
 		if err != nil {
 			imapLog.Errorf("Failed to convert message #%d to e-mail: %v",
 				msg.ImapData.UID, err)
@@ -576,7 +798,7 @@ func (box *mailbox) MessageSetBySequenceNumber(set types.SequenceSet) []mailstor
 	msgs := box.bitmessageSetBySequenceNumber(set)
 	email := make([]mailstore.Message, len(msgs))
 	for i, msg := range msgs {
-		email[i], err = msg.ToEmail()
+		email[i], err = box.toEmail(msg)
 		if err != nil {
 			imapLog.Errorf("Failed to convert message #%d to e-mail: %v",
 				msg.ImapData.UID, err)
@@ -600,24 +822,12 @@ func (box *mailbox) DeleteBitmessageByUID(id uint64) error {
 	if err != nil {
 		return err
 	}
+	
+	box.cache.remove(id)
 
-	// Update the box's state based on the information in the message deleted.
-	if bmsg.ImapData != nil {
-
-		if bmsg.ImapData.Flags&types.FlagRecent == types.FlagRecent {
-			box.numRecent--
-		}
-
-		if bmsg.ImapData.Flags&types.FlagSeen != types.FlagSeen {
-			box.numUnseen--
-		}
-	}
-
-	for i, uid := range box.uids {
-		if uid == id {
-			box.uids = append(box.uids[0:i], box.uids[i+1:]...)
-			break
-		}
+	// Update the state of every mailbox which reads from the same folder.
+	for _, b := range box.group() {
+		b.removed(id, bmsg)
 	}
 	return nil
 }
@@ -631,26 +841,18 @@ func (box *mailbox) saveBitmessage(msg *Bitmessage) error {
 	}
 
 	// Insert the new version of the message.
+	var previous *Bitmessage
 	if (msg.ImapData.UID == 0) {
 		msg.ImapData.UID, err = box.mbox.InsertNewMessage(encode, msg.Message.Encoding())
 	} else {
-		// Delete the old message from the database.
-		err := box.mbox.DeleteMessage(uint64(msg.ImapData.UID))
-		if err != nil {
-			imapLog.Errorf("Mailbox(%s).DeleteMessage(%d) gave error %v",
-				box.Name(), msg.ImapData.UID, err)
-			return err
-		}
-		
-		_, _, err = box.mbox.GetMessage(msg.ImapData.UID) 
-		if err == nil {
-			// There is still a message there despite our attempts to delete it. 
-			// That indicates that an entry exists in the folder which does not 
-			// belong to this mailbox. 
+		previous = box.fetch(msg.ImapData.UID)
+		if previous == nil {
 			return errors.New("Unable to save.")
 		}
 		
-		err = box.mbox.InsertMessage(msg.ImapData.UID, encode, msg.Message.Encoding())
+		// Replace the old message in place so that it keeps its UID and
+		// its modseq shows that it has changed. 
+		err = box.mbox.UpdateMessage(msg.ImapData.UID, encode, msg.Message.Encoding())
 	}
 	
 	if err != nil {
@@ -659,14 +861,23 @@ func (box *mailbox) saveBitmessage(msg *Bitmessage) error {
 		return err
 	}
 
-	// TODO: don't refresh the whole thing every time we save. Jeez that's 
-	// a lot of extra work! 
-	err = box.refresh()
+	uid := msg.ImapData.UID
+	box.cache.put(uid, msg)
+	
+	err = box.index(uid, msg)
 	if err != nil {
-		imapLog.Errorf("Mailbox(%s).Refresh gave error %v", box.Name(), err)
+		imapLog.Errorf("Mailbox(%s).index(%d) gave error %v", box.Name(), uid, err)
 		return err
 	}
 
+	// Update the state of every mailbox which reads from the same folder.
+	for _, b := range box.group() {
+		if previous != nil {
+			b.removed(uid, previous)
+		}
+		b.added(uid, msg)
+	}
+
 	return nil
 }
 
@@ -692,6 +903,10 @@ func (box *mailbox) Save(email *IMAPEmail) error {
 		Mailbox:        box,
 	}
 
+	if msg.ImapData.UID == 0 && box.base != nil {
+		return errors.New("Cannot add new messages to a virtual folder.")
+	}
+
 	if msg.ImapData.UID != 0 { // The message already exists and needs to be replaced.
 		// Check that the uid, date, and sequence number are consistent with one another.
 		previous := box.BitmessageByUID(msg.ImapData.UID)
@@ -729,11 +944,16 @@ func (box *mailbox) DeleteFlaggedMessages() ([]mailstore.Message, error) {
 		}
 	}
 	box.RUnlock()
+	
+	expunged := box.expunged
+	if box.base != nil {
+		expunged = box.base.expunged
+	}
 
 	// Delete them.
 	msgs := make([]mailstore.Message, 0, len(delBMsgs))
 	for _, b := range delBMsgs {
-		msg, err := b.ToEmail()
+		msg, err := box.toEmail(b)
 		if err != nil {
 			imapLog.Errorf("Failed to convert #%d to e-mail: %v", b.ImapData.UID,
 				err)
@@ -746,48 +966,34 @@ func (box *mailbox) DeleteFlaggedMessages() ([]mailstore.Message, error) {
 		if err != nil {
 			return nil, err
 		}
+		
+		if expunged != nil {
+			expunged(b)
+		}
 	}
 
 	return msgs, nil
 }
 
-// This error is used to cause mailbox.ForEachMessage to stop looping through
-// every message once an ack is found, but is not really an error.
-var errAckFound = errors.New("Ack Found")
-
 // ReceiveAck takes an object payload and tests it against messages in the
 // folder to see if it matches the ack of any sent message in the folder.
 // The first such message found is returned.
 func (box *mailbox) ReceiveAck(ack []byte) *Bitmessage {
-	var ackMatch *Bitmessage
-
-	box.mbox.ForEachMessage(0, 0, 2, func(id, suffix uint64, msg []byte) error {
-		entry, err := DecodeBitmessage(msg)
-		if err != nil {
-			return err
-		}
-		
-		if box.sub != nil && !box.sub(entry) {
-			return nil
-		}
-
-		if bytes.Equal(entry.Ack, ack) {
-			ackMatch = entry
-
-			// Stop ForEachMessage from searching the rest of the messages.
-			return errAckFound
-		}
+	box.Lock()
+	defer box.Unlock()
+	
+	uids, err := box.lookup(ackIndex, ack)
+	if err != nil || len(uids) == 0 {
 		return nil
-	})
+	}
+	
+	ackMatch := box.bmsgByUID(uids[0])
 	if ackMatch == nil {
 		return nil
 	}
 
 	ackMatch.state.AckReceived = true
-
-	box.Lock()
 	box.saveBitmessage(ackMatch)
-	box.Unlock()
 
 	return ackMatch
 }
@@ -812,6 +1018,8 @@ func NewMailbox(mbox store.Folder, addresses map[string]string) (*mailbox, error
 	m := &mailbox{
 		mbox: mbox,
 		addresses: addresses, 
+		RWMutex: &sync.RWMutex{},
+		cache: newBitmessageCache(bitmessageCacheSize),
 	}
 
 	// Populate various data fields.
@@ -831,6 +1039,8 @@ func NewDrafts(mbox store.Folder, addresses map[string]string) (*mailbox, error)
 		mbox: mbox,
 		addresses: addresses, 
 		drafts: true,
+		RWMutex: &sync.RWMutex{},
+		cache: newBitmessageCache(bitmessageCacheSize),
 	}
 
 	// Populate various data fields.
@@ -838,4 +1048,82 @@ func NewDrafts(mbox store.Folder, addresses map[string]string) (*mailbox, error)
 		return nil, err
 	}
 	return m, nil
-}
\ No newline at end of file
+}
+
+// newView creates a virtual mailbox with the given name which contains 
+// those messages in base for which sub returns true. If index is not empty,
+// the messages are found under key in that secondary index, which must 
+// only hold messages for which sub returns true, so that the other 
+// messages of base are not read. 
+func newView(base *mailbox, name string, sub func(*Bitmessage) bool, 
+	index string, key []byte) (*mailbox, error) {
+	if base.base != nil {
+		return nil, errors.New("Cannot create a view of a virtual mailbox.")
+	}
+	
+	base.Lock()
+	defer base.Unlock()
+	
+	m := &mailbox{
+		mbox: base.mbox,
+		sub: sub, 
+		addresses: base.addresses, 
+		name: name, 
+		base: base, 
+		RWMutex: base.RWMutex,
+		cache: base.cache,
+	}
+
+	if err := m.filter(index, key); err != nil {
+		return nil, err
+	}
+	
+	base.views = append(base.views, m)
+	return m, nil
+}
+
+// filter finds the messages of a new view among those of its base, which 
+// are already known, instead of reading the whole folder like refresh. 
+func (box *mailbox) filter(index string, key []byte) error {
+	box.nextUID = box.base.nextUID
+	
+	candidates := []uint64(box.base.uids)
+	if index != "" {
+		var err error
+		candidates, err = box.base.lookup(index, key)
+		if err != nil {
+			return err
+		}
+	}
+	
+	box.uids = make([]uint64, 0, len(candidates))
+	for _, uid := range candidates {
+		bmsg := box.fetch(uid)
+		if bmsg == nil || !box.belongs(bmsg) {
+			continue
+		}
+		
+		box.updateMailboxStats(bmsg, uid)
+		box.uids = append(box.uids, uid)
+	}
+	
+	return nil
+}
+
+// removeView removes a virtual mailbox from the mailbox it is based on. 
+func removeView(view *mailbox) {
+	base := view.base
+	if base == nil {
+		return
+	}
+	
+	base.Lock()
+	defer base.Unlock()
+	
+	for i, v := range base.views {
+		if v == view {
+			base.views = append(base.views[:i], base.views[i+1:]...)
+			return
+		}
+	}
+}
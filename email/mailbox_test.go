@@ -257,7 +257,7 @@ func (tc *mailboxTestContext) T() *testing.T {
 
 func (tc *mailboxTestContext) MakeMailbox(name string, emails []uint64, nextId uint64) email.Mailbox {
 
-	mb, err := email.NewMailbox(mem.NewFolder(name), make(map[string]*string))
+	mb, err := email.NewMailbox(mem.NewFolder(name), make(map[string]string))
 	if err != nil {
 		fmt.Println("Err constructing mailbox: ", err)
 		return nil
@@ -274,4 +274,256 @@ func TestInterface(t *testing.T) {
 	for _, tc := range boxes {
 		testMessageSetByUID(tc)
 	}
-}
\ No newline at end of file
+}
+
+func TestView(t *testing.T) {
+	base, err := email.NewMailbox(mem.NewFolder("Inbox"), make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	
+	view, err := email.TstNewView(base, "Identities/a", func(bm *email.Bitmessage) bool {
+		return bm.To == "BM-a@bm.addr"
+	})
+	if err != nil {
+		t.Fatal("Err constructing view: ", err)
+	}
+	
+	for _, to := range []string{"BM-a@bm.addr", "BM-b@bm.addr", "BM-a@bm.addr"} {
+		err = base.AddNew(MakeTestBitmessage("BM-From", to, "subject", "body"), 0)
+		if err != nil {
+			t.Fatal("Err adding message: ", err)
+		}
+	}
+	
+	if view.Name() != "Identities/a" {
+		t.Errorf("Wrong name: got %s", view.Name())
+	}
+	if base.Messages() != 3 {
+		t.Errorf("Base mailbox: expected 3 messages, got %d", base.Messages())
+	}
+	if view.Messages() != 2 {
+		t.Errorf("View: expected 2 messages, got %d", view.Messages())
+	}
+	if view.MessageByUID(2) != nil {
+		t.Error("View returned a message which does not belong to it.")
+	}
+	
+	// Deleting from the view should delete from the base and vice versa. 
+	if err = view.DeleteBitmessageByUID(1); err != nil {
+		t.Fatal("Err deleting message: ", err)
+	}
+	if base.Messages() != 2 {
+		t.Errorf("Base mailbox: expected 2 messages, got %d", base.Messages())
+	}
+	if err = base.DeleteBitmessageByUID(3); err != nil {
+		t.Fatal("Err deleting message: ", err)
+	}
+	if view.Messages() != 0 {
+		t.Errorf("View: expected 0 messages, got %d", view.Messages())
+	}
+}
+
+func TestIndexedView(t *testing.T) {
+	base, err := email.NewMailbox(mem.NewFolder("Sent"), make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	
+	a := "BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN@bm.addr"
+	b := "BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK@bm.addr"
+	
+	// Messages saved before the view is created are found in the index. 
+	for _, from := range []string{a, b, a} {
+		err = base.AddNew(MakeTestBitmessage(from, b, "subject", "body"), 0)
+		if err != nil {
+			t.Fatal("Err adding message: ", err)
+		}
+	}
+	
+	view, err := email.TstNewSenderView(base, "Identities/a/Sent", func(bm *email.Bitmessage) bool {
+		return bm.From == a
+	}, a)
+	if err != nil {
+		t.Fatal("Err constructing view: ", err)
+	}
+	if view.Messages() != 2 || view.MessageByUID(2) != nil {
+		t.Errorf("View: expected 2 messages, got %d", view.Messages())
+	}
+	
+	// Later messages are added as they are saved. 
+	if err = base.AddNew(MakeTestBitmessage(a, b, "subject", "body"), 0); err != nil {
+		t.Fatal("Err adding message: ", err)
+	}
+	if view.Messages() != 3 || view.Unseen() != 3 {
+		t.Errorf("View: expected 3 unseen messages, got %d of %d", 
+			view.Unseen(), view.Messages())
+	}
+}
+
+func TestExpunged(t *testing.T) {
+	base, err := email.NewMailbox(mem.NewFolder("Outbox"), make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	
+	a := "BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN@bm.addr"
+	b := "BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK@bm.addr"
+	
+	view, err := email.TstNewView(base, "Identities/a", func(bm *email.Bitmessage) bool {
+		return bm.To == a
+	})
+	if err != nil {
+		t.Fatal("Err constructing view: ", err)
+	}
+	
+	var expunged []uint64
+	email.TstSetExpunged(base, func(bm *email.Bitmessage) {
+		expunged = append(expunged, bm.ImapData.UID)
+	})
+	
+	for _, to := range []string{a, b, a} {
+		err = base.AddNew(MakeTestBitmessage(b, to, "subject", "body"), 0)
+		if err != nil {
+			t.Fatal("Err adding message: ", err)
+		}
+	}
+	
+	// Messages which are deleted internally are not reported. 
+	if err = base.DeleteBitmessageByUID(3); err != nil {
+		t.Fatal("Err deleting message: ", err)
+	}
+	
+	// Messages expunged by the user are reported, even through a view. 
+	_, err = view.MessageByUID(1).AddFlags(types.FlagDeleted).Save()
+	if err != nil {
+		t.Fatal("Err saving message: ", err)
+	}
+	if _, err = view.DeleteFlaggedMessages(); err != nil {
+		t.Fatal("Err deleting messages: ", err)
+	}
+	
+	if len(expunged) != 1 || expunged[0] != 1 {
+		t.Errorf("Expected uid 1 expunged, got %v", expunged)
+	}
+	if base.Messages() != 1 {
+		t.Errorf("Expected 1 message, got %d", base.Messages())
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	base, err := email.NewMailbox(mem.NewFolder("Outbox"), make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	
+	a := "BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN@bm.addr"
+	b := "BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK@bm.addr"
+	
+	view, err := email.TstNewView(base, "Identities/a", func(bm *email.Bitmessage) bool {
+		return bm.To == a
+	})
+	if err != nil {
+		t.Fatal("Err constructing view: ", err)
+	}
+	
+	email.TstSetHeaders(base, func(bm *email.Bitmessage) map[string][]string {
+		return map[string][]string{"X-Test": []string{bm.To}}
+	})
+	
+	if err = base.AddNew(MakeTestBitmessage(b, a, "subject", "body"), 0); err != nil {
+		t.Fatal("Err adding message: ", err)
+	}
+	
+	for _, box := range []email.Mailbox{base, view} {
+		msg := box.MessageByUID(1)
+		if msg == nil {
+			t.Fatalf("%s: message not found", box.Name())
+		}
+		if header := msg.Header().Get("X-Test"); header != a {
+			t.Errorf("%s: expected header %s, got %s", box.Name(), a, header)
+		}
+	}
+}
+
+func TestMailboxState(t *testing.T) {
+	folder := mem.NewFolder("Inbox")
+	box, err := email.NewMailbox(folder, make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	
+	from := "BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK@bm.addr"
+	to := "BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN@bm.addr"
+	
+	for i, flags := range []types.Flags{types.FlagRecent, 0, types.FlagSeen} {
+		bmsg := MakeTestBitmessage(from, to, "subject", "body")
+		bmsg.Ack = []byte{byte(i + 1)}
+		if err = box.AddNew(bmsg, flags); err != nil {
+			t.Fatal("Err adding message: ", err)
+		}
+	}
+	
+	check := func(note string, messages, recent, unseen uint32) {
+		if box.Messages() != messages || box.Recent() != recent || box.Unseen() != unseen {
+			t.Errorf("%s: expected %d messages, %d recent, %d unseen; got %d, %d, %d", note,
+				messages, recent, unseen, box.Messages(), box.Recent(), box.Unseen())
+		}
+	}
+	
+	check("A", 3, 1, 2)
+	
+	// Mark the first message as seen. 
+	_, err = box.MessageByUID(1).AddFlags(types.FlagSeen).Save()
+	if err != nil {
+		t.Fatal("Err saving message: ", err)
+	}
+	check("B", 3, 1, 1)
+	
+	if err = box.DeleteBitmessageByUID(2); err != nil {
+		t.Fatal("Err deleting message: ", err)
+	}
+	check("C", 2, 1, 0)
+	if box.LastUID() != 3 || box.MessageBySequenceNumber(2).UID() != 3 {
+		t.Error("Wrong uids after deletion.")
+	}
+	
+	// Acks are found through the index. 
+	if box.ReceiveAck([]byte{2}) != nil {
+		t.Error("Ack of deleted message found.")
+	}
+	if bmsg := box.ReceiveAck([]byte{3}); bmsg == nil || bmsg.ImapData.UID != 3 {
+		t.Errorf("Wrong message for ack: %v", bmsg)
+	}
+	
+	// A mailbox created from the same folder has the same state.
+	box, err = email.NewMailbox(folder, make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	check("D", 2, 1, 0)
+}
+
+func TestSaveInPlace(t *testing.T) {
+	box, err := email.NewMailbox(mem.NewFolder("Inbox"), make(map[string]string))
+	if err != nil {
+		t.Fatal("Err constructing mailbox: ", err)
+	}
+	
+	for i := 0; i < 2; i++ {
+		err = box.AddNew(MakeTestBitmessage("BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK@bm.addr",
+			"BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN@bm.addr", "subject", "body"), 0)
+		if err != nil {
+			t.Fatal("Err adding message: ", err)
+		}
+	}
+	
+	// Changing the flags of a message keeps its uid.
+	_, err = box.MessageByUID(1).AddFlags(types.FlagSeen).Save()
+	if err != nil {
+		t.Fatal("Err saving message: ", err)
+	}
+	if box.Messages() != 2 || box.MessageByUID(1) == nil {
+		t.Error("Message was not updated in place.")
+	}
+}
@@ -27,6 +27,9 @@ type ServerOps interface {
 	// given address.
 	GetPrivateID(string) *keymgr.PrivateID
 
+	// Names returns the names of the user's identities indexed by address.
+	Names() map[string]string
+
 	// GetObjectExpiry returns the time duration after which an object of the
 	// given type will expire on the network. It's used for POW calculations.
 	GetObjectExpiry(wire.ObjectType) time.Duration
@@ -34,6 +37,42 @@ type ServerOps interface {
 	// RunPow submits some data to have the pow calculated and submitted to the network.
 	RunPow(uint64, []byte) (uint64, error)
 
+	// CancelPow removes the object with the given index from the pow queue,
+	// stopping the calculation if it has already begun. 
+	CancelPow(uint64) error
+
+	// PowEstimate returns the expected time until the pow of the object with
+	// the given index is done, if it can be estimated.
+	PowEstimate(uint64) (time.Duration, bool)
+
 	// Mailboxes returns the set of mailboxes in the store.
 	Folders() []store.Folder
+
+	// NewFolder creates a new folder in the store, or returns the
+	// existing folder with the given name.
+	NewFolder(name string) (store.Folder, error)
+
+	// RenameFolder changes the name of a folder in the store.
+	RenameFolder(oldName, newName string) error
+
+	// BroadcastAddresses returns the broadcast addresses that the user is
+	// subscribed to.
+	BroadcastAddresses() *store.BroadcastAddresses
+
+	// Contacts returns the user's address book.
+	Contacts() *store.Contacts
+
+	// SenderFilter returns the user's blacklist and whitelist.
+	SenderFilter() *store.SenderFilter
+
+	// SieveScript returns the script which files the user's incoming
+	// messages.
+	SieveScript() *store.SieveScript
+
+	// AutoReplies returns the automatic replies of the user's identities.
+	AutoReplies() *store.AutoReplies
+
+	// PublishPubkey queues the pubkey of one of the user's identities to be
+	// published.
+	PublishPubkey(string) error
 }
@@ -12,9 +12,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"net/mail"
 	"regexp"
 
+	"github.com/DanielKrawisz/bmutil"
 	"github.com/mailhog/data"
 	"github.com/mailhog/smtp"
 )
@@ -120,16 +120,21 @@ func (serv *SMTPServer) validateAuth(mechanism string, args ...string) (*smtp.Re
 
 // validateEmail validates an email TO header entry.
 func validateEmail(to string) bool {
-	addr, err := mail.ParseAddress(to)
+	addr, err := parseAddress(to)
 	if err != nil {
 		return false
 	}
 	
-	if emailRegex.Match([]byte(addr.Address)) {
+	if emailRegex.Match([]byte(addr)) {
 		return true
 	}
 	
-	if commandRegex.Match([]byte(addr.Address)) {
+	if commandRegex.Match([]byte(addr)) {
+		return true
+	}
+	
+	// Labels and display names are resolved when the message is received. 
+	if isLabel(addr) {
 		return true
 	}
 	
@@ -138,13 +143,14 @@ func validateEmail(to string) bool {
 
 // validateSender validates an email FROM header entry
 func (s *SMTPServer) validateSender(from string) bool {
-	addr, err := mail.ParseAddress(from)
+	addr, err := parseAddress(from)
 	if err != nil {
 		return false
 	}
 
-	bmAddr, err := emailToBM(addr.Address)
+	bmAddr, err := resolveAddress(addr, s.user.keys.Names(), nil)
 	if err != nil {
+		smtpLog.Infof("Invalid sender %s: %v", from, err)
 		return false
 	}
 
@@ -154,6 +160,53 @@ func (s *SMTPServer) validateSender(from string) bool {
 	return true
 }
 
+// resolveAddresses replaces labels in the From and To addresses of a message
+// with the Bitmessage addresses they refer to.
+func (s *SMTPServer) resolveAddresses(bm *Bitmessage) error {
+	names := s.user.keys.Names()
+	if isLabel(bm.From) {
+		from, err := resolveAddress(bm.From, names, nil)
+		if err != nil {
+			return err
+		}
+		bm.From = bmToEmail(from)
+	}
+
+	if isLabel(bm.To) {
+		to, err := resolveAddress(bm.To, names, s.user.server.Contacts())
+		if err != nil {
+			return err
+		}
+		bm.To = bmToEmail(to)
+	}
+
+	return nil
+}
+
+// checkStream checks that the stream requested for a message is that of the
+// recipient, or of the sender if it is a broadcast. The addresses of the
+// message must already have been resolved.
+func checkStream(bm *Bitmessage) error {
+	if bm.state == nil || bm.state.Stream == 0 {
+		return nil
+	}
+
+	addr := bm.To
+	if addr == broadcastAddress {
+		addr = bm.From
+	}
+	bmAddr, err := emailToBM(addr)
+	if err != nil {
+		return err
+	}
+	address, err := bmutil.DecodeAddress(bmAddr)
+	if err != nil {
+		return err
+	}
+
+	return bm.checkStream(address.Stream)
+}
+
 // smtpLogHandler handles logging for the SMTP protocol.
 func smtpLogHandler(message string, args ...interface{}) {
 	smtpLog.Debugf(message, args...)
@@ -173,6 +226,21 @@ func (s *SMTPServer) messageReceived(smtpMessage *data.SMTPMessage) (string, err
 		return "", err
 	}
 
+	if err = bm.CheckSendOptions(); err != nil {
+		smtpLog.Error("CheckSendOptions gave error: ", err)
+		return "", err
+	}
+
+	if err = s.resolveAddresses(bm); err != nil {
+		smtpLog.Error("resolveAddresses gave error: ", err)
+		return "", err
+	}
+
+	if err = checkStream(bm); err != nil {
+		smtpLog.Error("checkStream gave error: ", err)
+		return "", err
+	}
+
 	return string(message.ID), s.user.DeliverFromSMTP(bm)
 }
 
@@ -9,14 +9,18 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jordwest/imap-server/mailstore"
 	"github.com/jordwest/imap-server/types"
+	"github.com/DanielKrawisz/bmutil"
 	"github.com/DanielKrawisz/bmutil/identity"
 	"github.com/DanielKrawisz/bmutil/wire"
 	"github.com/DanielKrawisz/bmagent/keymgr"
 	"github.com/DanielKrawisz/bmagent/message/format"
+	"github.com/DanielKrawisz/bmagent/sieve"
+	"github.com/DanielKrawisz/bmagent/store"
 )
 
 // User implements the mailstore.User interface and represents
@@ -26,6 +30,21 @@ type User struct {
 	boxes    map[string]*mailbox
 	keys     *keymgr.Manager
 	server   ServerOps
+	
+	// mtx protects the following fields, which can change while the user
+	// is online. 
+	mtx       sync.RWMutex
+	
+	// Virtual folders which show the messages in the Inbox and Sent
+	// folders that belong to a particular identity or chan. 
+	views     map[string]*mailbox // Indexed by folder name.
+	viewNames map[string][]string // Folder names indexed by address.
+	
+	// The folders of the broadcast addresses the user is subscribed to,
+	// indexed by address. A folder which was created before the user 
+	// went online is also in boxes. Folders remain here after the user
+	// unsubscribes so that their messages can still be read. 
+	subscriptions map[string]*mailbox
 }
 
 // NewUser creates a User object from the store.
@@ -42,6 +61,9 @@ func NewUser(username string, server ServerOps, keys *keymgr.Manager) (*User, er
 		boxes:  make(map[string]*mailbox),
 		server: server,
 		keys: keys, 
+		views: make(map[string]*mailbox), 
+		viewNames: make(map[string][]string), 
+		subscriptions: make(map[string]*mailbox), 
 	}
 	
 	// The user is allowed to save in some mailboxes but not others.
@@ -60,10 +82,217 @@ func NewUser(username string, server ServerOps, keys *keymgr.Manager) (*User, er
 		}
 		u.boxes[name] = mb
 	}
+	
+	// Users created before there was a Junk folder need one for the 
+	// messages of blocked senders. 
+	if _, ok := u.boxes[JunkFolderName]; !ok {
+		folder, err := server.NewFolder(JunkFolderName)
+		if err != nil {
+			return nil, err
+		}
+		u.boxes[JunkFolderName], err = NewMailbox(folder, keys.Names())
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	// Messages show the labels of the contacts they are from or to. 
+	for _, box := range u.boxes {
+		box.label = u.contactLabel
+	}
+	
+	// Messages deleted from the Outbox must not be sent, and the messages
+	// in the Outbox show when they are expected to be sent. 
+	if outbox, ok := u.boxes[OutboxFolderName]; ok {
+		outbox.expunged = u.cancelPow
+		outbox.headers = u.powHeaders
+	}
+	
+	// Find the folders for the broadcast addresses we are subscribed to. 
+	err := server.BroadcastAddresses().ForEach(func(addr *bmutil.Address) error {
+		address, err := addr.Encode()
+		if err != nil {
+			return err
+		}
+		
+		label, err := server.BroadcastAddresses().Label(address)
+		if err != nil {
+			return err
+		}
+		
+		_, err = u.subscriptionMailbox(address, label)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	// Create virtual folders for the identities that we already have and
+	// keep them up to date as identities are added or renamed. 
+	for address := range keys.Names() {
+		if err := u.updateViews(address); err != nil {
+			return nil, err
+		}
+	}
+	keys.AddListener(func(address string) {
+		if err := u.updateViews(address); err != nil {
+			imapLog.Errorf("Unable to update virtual folders for %s: %v", 
+				address, err)
+		}
+	})
 
 	return u, nil
 }
 
+// updateViews creates or replaces the virtual folders which belong to 
+// the identity with the given address. Identities are listed under 
+// Identities and chans under Chans, by name if they have one. The folders
+// are kept if their name has not changed. 
+func (u *User) updateViews(address string) error {
+	id := u.keys.LookupByAddress(address)
+	
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	
+	// Messages sent by an identity are from its address, but those
+	// sent to a chan are addressed to the chan. 
+	parent := IdentitiesFolderName
+	fromIndex := senderIndex
+	if id != nil && id.IsChan {
+		parent = ChansFolderName
+		fromIndex = recipientIndex
+	}
+	
+	var name string
+	if id != nil {
+		name = parent + FolderDelimiter + folderLabel(id.Name, address)
+		if names := u.viewNames[address]; len(names) > 0 && names[0] == name {
+			return nil
+		}
+	}
+	
+	// Remove the old folders. 
+	for _, name := range u.viewNames[address] {
+		removeView(u.views[name])
+		delete(u.views, name)
+	}
+	delete(u.viewNames, address)
+	
+	if id == nil {
+		return nil
+	}
+	
+	addr := bmToEmail(address)
+	toAddr := func(bm *Bitmessage) bool {
+		return bm.To == addr
+	}
+	fromAddr := func(bm *Bitmessage) bool {
+		return bm.From == addr
+	}
+	if id.IsChan {
+		fromAddr = toAddr
+	}
+	
+	if _, ok := u.views[name]; ok {
+		// Another identity already has this name. 
+		name = parent + FolderDelimiter + address
+	}
+	
+	inboxBase, sentBase := u.boxes[InboxFolderName], u.boxes[SentFolderName]
+	if inboxBase == nil || sentBase == nil {
+		return errors.New("Could not find inbox or sent folder.")
+	}
+	
+	// The messages of the folders are found in the secondary indexes 
+	// rather than by reading the whole Inbox and Sent folders. 
+	key := addressIndexKey(address)
+	inbox, err := newView(inboxBase, name, toAddr, recipientIndex, key)
+	if err != nil {
+		return err
+	}
+	sent, err := newView(sentBase, 
+		name + FolderDelimiter + SentFolderName, fromAddr, fromIndex, key)
+	if err != nil {
+		removeView(inbox)
+		return err
+	}
+	
+	for _, box := range []*mailbox{inbox, sent} {
+		u.views[box.Name()] = box
+		u.viewNames[address] = append(u.viewNames[address], box.Name())
+	}
+	
+	return nil
+}
+
+// folderLabel returns the part of a folder name which identifies the
+// given address. This is its name if it has one, and otherwise the address. 
+func folderLabel(name, address string) string {
+	label := strings.Replace(name, FolderDelimiter, " ", -1)
+	if label == "" {
+		return address
+	}
+	return label
+}
+
+// subscriptionFolderName returns the name of the folder in which 
+// broadcasts from the given address are stored. 
+func subscriptionFolderName(address, label string) string {
+	return SubscriptionsFolderName + FolderDelimiter + folderLabel(label, address)
+}
+
+// subscriptionMailbox returns the folder for broadcasts from the given
+// address, creating it if it does not exist and renaming it if the 
+// label has changed. The label of the address is shown alongside it in 
+// the From header of its messages. 
+func (u *User) subscriptionMailbox(address, label string) (*mailbox, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	
+	name := subscriptionFolderName(address, label)
+	box, ok := u.subscriptions[address]
+	if ok && box.Name() != name {
+		box.Lock()
+		err := u.server.RenameFolder(box.Name(), name)
+		box.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else if !ok {
+		box, ok = u.boxes[name]
+		if !ok {
+			folder, err := u.server.NewFolder(name)
+			if err != nil {
+				return nil, err
+			}
+			
+			box, err = NewMailbox(folder, nil)
+			if err != nil {
+				return nil, err
+			}
+			box.label = u.contactLabel
+		}
+		
+		u.subscriptions[address] = box
+	}
+	
+	box.Lock()
+	box.addresses = map[string]string{address: label}
+	box.Unlock()
+	
+	return box, nil
+}
+
+// contactLabel returns the label of an address in the user's address book,
+// or the empty string if it is not there.
+func (u *User) contactLabel(address string) string {
+	label, err := u.server.Contacts().Label(address)
+	if err != nil {
+		return ""
+	}
+	return label
+}
+
 // NewMailbox adds a new mailbox.
 func (u *User) NewMailbox(name string) (Mailbox, error) {
 	return nil, errors.New("Not yet implemented.")
@@ -71,10 +300,24 @@ func (u *User) NewMailbox(name string) (Mailbox, error) {
 
 // Mailboxes returns all the mailboxes. It is part of the IMAPMailbox interface.
 func (u *User) Mailboxes() []mailstore.Mailbox {
-	mboxes := make([]mailstore.Mailbox, 0, len(u.boxes))
-	for _, mbox := range u.boxes {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	
+	mboxes := make([]mailstore.Mailbox, 0, len(u.boxes) + len(u.views))
+	for name, mbox := range u.boxes {
+		// Skip subscription folders that have been renamed.
+		if mbox.Name() == name {
+			mboxes = append(mboxes, mbox)
+		}
+	}
+	for _, mbox := range u.views {
 		mboxes = append(mboxes, mbox)
 	}
+	for _, mbox := range u.subscriptions {
+		if u.boxes[mbox.Name()] != mbox {
+			mboxes = append(mboxes, mbox)
+		}
+	}
 	return mboxes
 }
 
@@ -87,17 +330,219 @@ func (u *User) MailboxByName(name string) (mailstore.Mailbox, error) {
 	}
 	
 	mbox, ok := u.boxes[name]
-	if !ok {
-		return nil, errors.New("Not found")
+	if ok && mbox.Name() == name {
+		return mbox, nil
 	}
-	return mbox, nil
+	
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	
+	mbox, ok = u.views[name]
+	if ok {
+		return mbox, nil
+	}
+	
+	for _, mbox := range u.subscriptions {
+		if mbox.Name() == name {
+			return mbox, nil
+		}
+	}
+	return nil, errors.New("Not found")
 }
 
 // DeliverFromBMNet adds a message received from bmd into the appropriate
-// folder.
+// folders. If the user has a Sieve script, it decides which folders the
+// message is filed in and which flags it is given. Otherwise, the message
+// goes to the Inbox.
 func (u *User) DeliverFromBMNet(bm *Bitmessage) error {
-	// Put message in the right folder.
-	return u.boxes[InboxFolderName].AddNew(bm, types.FlagRecent)
+	deliveries, err := u.runSieve(bm)
+	if err != nil {
+		imapLog.Errorf("Unable to run Sieve script: %v", err)
+		deliveries = []sieve.Delivery{{Folder: sieve.Inbox}}
+	}
+
+	if len(deliveries) == 0 {
+		imapLog.Debugf("Sieve script discarded message from %s to %s.", bm.From, bm.To)
+		return nil
+	}
+
+	kept := false
+	for i, d := range deliveries {
+		box := u.sieveFolder(d.Folder)
+		if box == nil {
+			imapLog.Errorf("Sieve script files message in %s, which is not a folder that can receive messages.", d.Folder)
+			box = u.boxes[InboxFolderName]
+		}
+
+		// Like Sieve's implicit keep, a message that could not be filed
+		// where the script said goes to the Inbox, but only once.
+		if box.Name() == InboxFolderName {
+			if kept {
+				continue
+			}
+			kept = true
+		}
+
+		msg := bm
+		if i > 0 {
+			// Each folder needs its own copy of the message.
+			cp := *bm
+			msg = &cp
+			msg.ImapData = nil
+			msg.state = nil
+		}
+		if err = box.AddNew(msg, sieveFlags(d.Flags)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSieve runs the user's Sieve script on a message received from bmd and
+// returns the folders that it should be filed in. The script sees the
+// message's headers as they will appear in the Inbox, and its envelope is
+// the sender and the receiving identity or chan.
+func (u *User) runSieve(bm *Bitmessage) ([]sieve.Delivery, error) {
+	src, err := u.server.SieveScript().Get()
+	if err != nil {
+		return nil, err
+	}
+	if src == "" {
+		return []sieve.Delivery{{Folder: sieve.Inbox}}, nil
+	}
+
+	script, err := sieve.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	inbox := u.boxes[InboxFolderName]
+	rendered := *bm
+	rendered.ImapData = &ImapData{
+		TimeReceived: time.Now(),
+		Mailbox:      inbox,
+	}
+	email, err := inbox.toEmail(&rendered)
+	if err != nil {
+		return nil, err
+	}
+
+	return script.Run(&sieve.Message{
+		Header: email.Content.Headers,
+		From:   bm.From,
+		To:     bm.To,
+	}).Deliveries, nil
+}
+
+// sieveFolder returns the folder that a Sieve script files a message in, or
+// nil if there is no such folder or it cannot receive incoming messages. Only
+// the Inbox, Junk and the user's own and subscription folders can.
+func (u *User) sieveFolder(name string) *mailbox {
+	if name == sieve.Inbox || strings.ToLower(name) == strings.ToLower(InboxFolderName) {
+		return u.boxes[InboxFolderName]
+	}
+
+	switch name {
+	case OutboxFolderName, LimboFolderName, DraftsFolderName, CommandsFolderName,
+		SentFolderName, TrashFolderName:
+		return nil
+	}
+
+	if box, ok := u.boxes[name]; ok && box.Name() == name {
+		return box
+	}
+
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+
+	for _, box := range u.subscriptions {
+		if box.Name() == name {
+			return box
+		}
+	}
+	return nil
+}
+
+// sieveFlags converts the IMAP flags set by a Sieve script. Flags other than
+// the system flags are not supported by the store and are ignored.
+func sieveFlags(flags []string) types.Flags {
+	f := types.FlagRecent
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case "\\seen":
+			f |= types.FlagSeen
+		case "\\answered":
+			f |= types.FlagAnswered
+		case "\\flagged":
+			f |= types.FlagFlagged
+		case "\\deleted":
+			f |= types.FlagDeleted
+		case "\\draft":
+			f |= types.FlagDraft
+		}
+	}
+	return f
+}
+
+// DeliverJunk adds a message from a blocked sender to the Junk folder.
+func (u *User) DeliverJunk(bm *Bitmessage) error {
+	return u.boxes[JunkFolderName].AddNew(bm, types.FlagRecent)
+}
+
+// DeliverBroadcast adds a broadcast received from bmd to the folder of the 
+// subscription which it was sent from. 
+func (u *User) DeliverBroadcast(address string, bm *Bitmessage) error {
+	label, err := u.server.BroadcastAddresses().Label(address)
+	if err != nil {
+		return err
+	}
+	
+	box, err := u.subscriptionMailbox(address, label)
+	if err != nil {
+		return err
+	}
+	
+	return box.AddNew(bm, types.FlagRecent)
+}
+
+// Subscribe adds a broadcast address to the user's subscriptions with
+// an optional label and creates a folder for its broadcasts. If the user
+// is already subscribed, the label is changed. 
+func (u *User) Subscribe(address, label string) error {
+	err := u.server.BroadcastAddresses().Add(address, label)
+	if err != nil {
+		return err
+	}
+	
+	_, err = u.subscriptionMailbox(address, label)
+	return err
+}
+
+// Unsubscribe removes a broadcast address from the user's subscriptions.
+// Its folder is kept. 
+func (u *User) Unsubscribe(address string) error {
+	return u.server.BroadcastAddresses().Remove(address)
+}
+
+// Subscriptions returns the broadcast addresses that the user is 
+// subscribed to and their labels. 
+func (u *User) Subscriptions() (map[string]string, error) {
+	broadcasts := u.server.BroadcastAddresses()
+	subs := make(map[string]string)
+	
+	err := broadcasts.ForEach(func(addr *bmutil.Address) error {
+		address, err := addr.Encode()
+		if err != nil {
+			return err
+		}
+		
+		subs[address], err = broadcasts.Label(address)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
 }
 
 // DeliverFromSMTP adds a message received via SMTP to the POW queue, if needed,
@@ -107,9 +552,14 @@ func (u *User) DeliverFromSMTP(bmsg *Bitmessage) error {
 	
 	// Check for command. 
 	if commandRegex.Match([]byte(bmsg.To)) {
-		return errors.New("Commands not yet supported.")
+		return u.executeCommand(bmsg)
 	} 
 	
+	return u.send(bmsg)
+}
+
+// send puts a message in the Outbox and submits it for proof-of-work.
+func (u *User) send(bmsg *Bitmessage) error {
 	outbox := u.boxes[OutboxFolderName]
 
 	// Put message in outbox.
@@ -148,30 +598,22 @@ func (u *User) DeliverPublicKey(bmaddr string, public *identity.Public) error {
 	}
 	
 	outbox := u.boxes[OutboxFolderName]
-	var ids []uint64
 
-	// Go through all messages in the Outbox and get IDs of all the matches.
-	err := outbox.mbox.ForEachMessage(0, 0, 2, func(id, _ uint64, msg []byte) error {
-		bmsg, err := DecodeBitmessage(msg)
-		if err != nil { // (Almost) impossible error.
-			return err
-		}
-		
-		// We have a match!
-		if bmsg.state.PubkeyRequestOutstanding && strings.Contains(bmsg.To, bmaddr) {
-			ids = append(ids, id)
-		}
-		return nil
-	})
+	outbox.Lock()
+	defer outbox.Unlock()
+
+	// Get the IDs of all messages in the Outbox to this address. 
+	ids, err := outbox.lookup(recipientIndex, addressIndexKey(bmaddr))
 	if err != nil {
 		return err
 	}
-
-	outbox.Lock()
-	defer outbox.Unlock()
 	
 	for _, id := range ids {
-		bmsg := outbox.BitmessageByUID(id)
+		bmsg := outbox.bmsgByUID(id)
+		if bmsg == nil || !bmsg.state.PubkeyRequestOutstanding {
+			continue
+		}
+		
 		bmsg.state.PubkeyRequestOutstanding = false
 
 		if bmsg.state.AckExpected {
@@ -194,39 +636,69 @@ func (u *User) DeliverPublicKey(bmaddr string, public *identity.Public) error {
 	return nil
 }
 
+// cancelPow cancels the proof-of-work of a message that has been deleted
+// from the Outbox.
+func (u *User) cancelPow(bmsg *Bitmessage) {
+	if bmsg.state == nil {
+		return
+	}
+	
+	for _, index := range []uint64{bmsg.state.PowIndex, bmsg.state.AckPowIndex} {
+		if index == 0 {
+			continue
+		}
+		
+		err := u.server.CancelPow(index)
+		if err != nil && err != store.ErrNotFound {
+			imapLog.Errorf("Unable to cancel pow #%d: %v", index, err)
+		}
+	}
+}
+
+// powHeaders returns headers which show when the proof-of-work of a message
+// in the Outbox is expected to be done, and warn if that is after the
+// message expires.
+func (u *User) powHeaders(bmsg *Bitmessage) map[string][]string {
+	if bmsg.state == nil || bmsg.state.PowIndex == 0 {
+		return nil
+	}
+	
+	eta, ok := u.server.PowEstimate(bmsg.state.PowIndex)
+	if !ok {
+		return nil
+	}
+	
+	done := time.Now().Add(eta)
+	headers := map[string][]string{
+		powETAHeader: []string{done.Format(dateFormat)},
+	}
+	if !bmsg.Expiration.IsZero() && done.After(bmsg.Expiration) {
+		headers[powWarningHeader] = []string{
+			"Proof-of-work is not expected to be done before the message expires."}
+	}
+	return headers
+}
+
 // DeliverPow delivers an object that has had pow done on it.
 func (u *User) DeliverPow(index uint64, obj *wire.MsgObject) error {
 	outbox := u.boxes[OutboxFolderName]
 
+	// Find the message in the Outbox with the given pow index.
+	outbox.RLock()
+	ids, err := outbox.lookup(powIndex, powIndexKey(index))
 	var bmsg *Bitmessage
-	var idMsg uint64
-	
-	// The error returned by the inner func which signifies that 
-	// a message was found successfully. This error is used to represent
-	// a success case for the query. 
-	var errMessageFound = errors.New("Message found.")
-
-	// Go through all messages in the Outbox and get IDs of all the matches.
-	err := outbox.mbox.ForEachMessage(0, 0, 2, func(id, _ uint64, msg []byte) error {
-		var dbErr error
-		bmsg, dbErr = DecodeBitmessage(msg)
-		if dbErr != nil { // (Almost) impossible error.
-			return dbErr
-		}
-		// We have a match!
-		if bmsg.state.PowIndex == index {
-			idMsg = id
-			return errMessageFound
-		}
-		return nil
-	})
-	if err == nil {
-		return fmt.Errorf("Unable to find message in outbox with POW index %d",
-			index)
+	if err == nil && len(ids) > 0 {
+		bmsg = outbox.bmsgByUID(ids[0])
 	}
-	if err != errMessageFound {
+	outbox.RUnlock()
+	if err != nil {
 		return err
 	}
+	if bmsg == nil {
+		return fmt.Errorf("Unable to find message in outbox with POW index %d",
+			index)
+	}
+	idMsg := bmsg.ImapData.UID
 
 	smtpLog.Trace("pow delivered for messege from " + bmsg.From + " to " + bmsg.To)
 
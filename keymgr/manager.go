@@ -54,8 +54,31 @@ var (
 	// ErrNonexistentIdentity is returned when the identity doesn't exist in the
 	// key manager.
 	ErrNonexistentIdentity = errors.New("identity doesn't exist")
+
+	// ErrChanMismatch is returned by JoinChan when the passphrase does not
+	// generate the address of the chan.
+	ErrChanMismatch = errors.New("passphrase does not match chan address")
+
+	// ErrUnsupportedVersion is returned when deterministic identities are
+	// requested with an address version other than 3 or 4.
+	ErrUnsupportedVersion = errors.New("unsupported address version")
+
+	// ErrDerivedIdentity is returned by RemoveImported when the identity was
+	// derived from the master key. Such identities are retired instead.
+	ErrDerivedIdentity = errors.New("identity is derived from the master key")
+
+	// ErrImportedIdentity is returned by RetireIdentity when the identity was
+	// imported. Such identities are removed instead.
+	ErrImportedIdentity = errors.New("identity is imported")
+
+	// ErrRetiredIdentity is returned by EnableIdentity when the identity has
+	// been retired.
+	ErrRetiredIdentity = errors.New("identity has been retired")
 )
 
+// ChanLabelPrefix begins the names that PyBitmessage gives to chans.
+const ChanLabelPrefix = "[chan] "
+
 // Manager is the key manager used for managing imported as well as
 // hierarchically deterministic keys. It is safe for access from multiple
 // goroutines.
@@ -69,6 +92,10 @@ type Manager struct {
 
 	// DerivedIDs contains all IDs derived from the master key.
 	derivedIDs []string 
+
+	// listeners are called whenever an identity is added, renamed, disabled,
+	// enabled or removed.
+	listeners []func(address string)
 }
 
 // New creates a new key manager and generates a master key from the provided
@@ -194,6 +221,32 @@ func (mgr *Manager) ExportPlaintext() ([]byte, error) {
 	return mgr.db.Serialize()
 }
 
+// AddListener registers a function which is called with the address of an
+// identity whenever that identity is added to the key manager, renamed,
+// disabled, enabled or removed. A removed identity can no longer be looked
+// up when the function is called.
+// Listeners are called after the key manager has been unlocked, so they may
+// safely call back into it.
+func (mgr *Manager) AddListener(f func(address string)) {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	mgr.listeners = append(mgr.listeners, f)
+}
+
+// notify calls all listeners with the given address. It must not be called
+// while the mutex is held.
+func (mgr *Manager) notify(address string) {
+	mgr.mutex.RLock()
+	listeners := make([]func(string), len(mgr.listeners))
+	copy(listeners, mgr.listeners)
+	mgr.mutex.RUnlock()
+
+	for _, f := range listeners {
+		f(address)
+	}
+}
+
 // ImportIdentity imports an existing identity into the key manager. It's useful
 // for users who have existing identities or want to subscribe to channels.
 func (mgr *Manager) ImportIdentity(privID PrivateID) {
@@ -202,34 +255,183 @@ func (mgr *Manager) ImportIdentity(privID PrivateID) {
 	str := privID.Address() 
 	
 	mgr.mutex.Lock()
-	defer mgr.mutex.Unlock()
 
 	// Check if the identity already exists.
 	if _, ok := mgr.db.IDs[str]; ok {
+		mgr.mutex.Unlock()
 		return
 	}
 	
 	// Insert a copy into database.
 	privID.Imported = true // Make sure it is marked as imported. 
+	privID.Retired = false // Imported identities are removed, not retired.
 	mgr.db.IDs[str] = &privID
 	mgr.importedIDs = append(mgr.importedIDs, str)
+	mgr.mutex.Unlock()
+
+	mgr.notify(str)
+}
+
+// newChan derives the keys of a chan from its passphrase the same way as
+// PyBitmessage, which makes a deterministic version 4 address in stream 1.
+func newChan(passphrase string) (*PrivateID, error) {
+	if passphrase == "" {
+		return nil, errors.New("chan passphrase is empty")
+	}
+
+	ids, err := identity.NewDeterministic(passphrase, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	ids[0].CreateAddress(4, 1)
+
+	return &PrivateID{
+		Private: *ids[0],
+		IsChan:  true,
+		Name:    ChanLabelPrefix + passphrase,
+	}, nil
+}
+
+// addChan adds a chan to the key manager unless it is already there, and
+// returns the identity that the key manager holds. ErrDuplicateIdentity is
+// returned with the existing identity if it was already there.
+func (mgr *Manager) addChan(id *PrivateID) (*PrivateID, error) {
+	address := id.Address()
+	if existing := mgr.LookupByAddress(address); existing != nil {
+		return existing, ErrDuplicateIdentity
+	}
 
-	return
+	mgr.ImportIdentity(*id)
+	return mgr.LookupByAddress(address), nil
 }
 
-// RemoveImported removes an imported identity from the key manager.
-/*func (mgr *Manager) RemoveImported(str string) {
+// CreateChan adds the chan with the given passphrase to the key manager and
+// returns it. Like PyBitmessage, it is named "[chan] <passphrase>".
+// ErrDuplicateIdentity is returned with the existing identity if the chan
+// is already in the key manager.
+func (mgr *Manager) CreateChan(passphrase string) (*PrivateID, error) {
+	id, err := newChan(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return mgr.addChan(id)
+}
+
+// JoinChan adds an existing chan to the key manager and returns it, after
+// checking that its passphrase generates its address. ErrChanMismatch is
+// returned if it does not. ErrDuplicateIdentity is returned with the
+// existing identity if the chan is already in the key manager.
+func (mgr *Manager) JoinChan(passphrase, address string) (*PrivateID, error) {
+	id, err := newChan(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if id.Address() != address {
+		return nil, ErrChanMismatch
+	}
+	return mgr.addChan(id)
+}
+
+// NewDeterministicIdentities recreates the first n identities that
+// PyBitmessage generates from a passphrase with createDeterministicAddresses,
+// adds them to the key manager and returns them. Their keys are derived from
+// SHA-512 hashes of the passphrase and a nonce until the ripe begins with one
+// zero byte, or two if eighteenByteRipe is set. The address version must be 3
+// or 4 and the stream is 1, as in PyBitmessage. Identities which are already
+// in the key manager are returned as they are.
+func (mgr *Manager) NewDeterministicIdentities(passphrase string, n int,
+	version uint64, eighteenByteRipe bool) ([]*PrivateID, error) {
+
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	if n <= 0 {
+		return nil, errors.New("number of identities must be positive")
+	}
+	if version != 3 && version != 4 {
+		return nil, ErrUnsupportedVersion
+	}
+
+	var initialZeros uint64 = 1
+	if eighteenByteRipe {
+		initialZeros = 2
+	}
+
+	privs, err := identity.NewDeterministic(passphrase, initialZeros, n)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]*PrivateID, len(privs))
+	for i, priv := range privs {
+		priv.CreateAddress(version, 1)
+
+		id := &PrivateID{Private: *priv}
+		address := id.Address()
+		if existing := mgr.LookupByAddress(address); existing != nil {
+			ids[i] = existing
+			continue
+		}
+
+		mgr.ImportIdentity(*id)
+		ids[i] = mgr.LookupByAddress(address)
+	}
+	return ids, nil
+}
+
+// setDisabled disables or enables an identity and notifies the listeners.
+func (mgr *Manager) setDisabled(address string, disabled bool) error {
 	mgr.mutex.Lock()
-	defer mgr.mutex.Unlock()
-	
-	if _, ok := mgr.db.IDs[str]; !ok {
-		return
+
+	id, ok := mgr.db.IDs[address]
+	if !ok {
+		mgr.mutex.Unlock()
+		return ErrNonexistentIdentity
 	}
-	
-	delete(mgr.db.IDs, str)
+	if id.Retired && !disabled {
+		mgr.mutex.Unlock()
+		return ErrRetiredIdentity
+	}
+	id.Disabled = disabled
+	mgr.mutex.Unlock()
+
+	mgr.notify(address)
+	return nil
+}
+
+// DisableIdentity marks an identity as inactive. Its private keys are kept,
+// but messages sent to it are no longer decrypted and its pubkey is no
+// longer published.
+func (mgr *Manager) DisableIdentity(address string) error {
+	return mgr.setDisabled(address, true)
+}
+
+// EnableIdentity makes a disabled identity active again.
+// ErrRetiredIdentity is returned if the identity has been retired.
+func (mgr *Manager) EnableIdentity(address string) error {
+	return mgr.setDisabled(address, false)
+}
+
+// RemoveImported permanently removes an imported identity from the key
+// manager. HD identities cannot be removed because they would be derived
+// again from the master key, so ErrDerivedIdentity is returned for them.
+func (mgr *Manager) RemoveImported(address string) error {
+	mgr.mutex.Lock()
+
+	id, ok := mgr.db.IDs[address]
+	if !ok {
+		mgr.mutex.Unlock()
+		return ErrNonexistentIdentity
+	}
+	if !id.Imported {
+		mgr.mutex.Unlock()
+		return ErrDerivedIdentity
+	}
+
+	delete(mgr.db.IDs, address)
 
 	for i, addr := range mgr.importedIDs {
-		if str == addr {
+		if address == addr {
 			// Delete element from slice.
 			a := mgr.importedIDs
 
@@ -237,25 +439,64 @@ func (mgr *Manager) ImportIdentity(privID PrivateID) {
 			copy(a[i:], a[i+1:])
 			a[len(a)-1] = ""
 			mgr.importedIDs = a[:len(a)-1]
+			break
 		}
 	}
-}*/
+	mgr.mutex.Unlock()
+
+	mgr.notify(address)
+	return nil
+}
+
+// RetireIdentity permanently disables an HD identity, which takes the place
+// of removing it. It stays in the key manager so that it is not derived
+// again, but it cannot be enabled. Imported identities are removed instead,
+// so ErrImportedIdentity is returned for them.
+func (mgr *Manager) RetireIdentity(address string) error {
+	mgr.mutex.Lock()
+
+	id, ok := mgr.db.IDs[address]
+	if !ok {
+		mgr.mutex.Unlock()
+		return ErrNonexistentIdentity
+	}
+	if id.Imported {
+		mgr.mutex.Unlock()
+		return ErrImportedIdentity
+	}
+	id.Disabled = true
+	id.Retired = true
+	mgr.mutex.Unlock()
+
+	mgr.notify(address)
+	return nil
+}
 
 // NewHDIdentity generates a new HD identity and numbers it based on previously
 // derived identities. If 2^32 identities have already been generated, new
 // identities would be duplicates because of overflow problems.
 func (mgr *Manager) NewHDIdentity(stream uint32, name string) *PrivateID {
+	id := mgr.newHDIdentity(stream, name)
+	if id != nil {
+		mgr.notify(id.Address())
+	}
+	return id
+}
+
+func (mgr *Manager) newHDIdentity(stream uint32, name string) *PrivateID {
 	mgr.mutex.Lock()
 	defer mgr.mutex.Unlock()
 
 	var privID *identity.Private
+	var index uint32
 	var err error
 
 	// We use a loop because identity generation might fail, although the odds
 	// may be extremely small.
 	for i := uint32(0); true; i++ {
+		index = mgr.db.NewIDIndex + i
 		privID, err = identity.NewHD((*hdkeychain.ExtendedKey)(mgr.db.MasterKey),
-			mgr.db.NewIDIndex+i, stream)
+			index, stream)
 		if err == nil {
 			mgr.db.NewIDIndex += i + 1
 			break
@@ -266,6 +507,7 @@ func (mgr *Manager) NewHDIdentity(stream uint32, name string) *PrivateID {
 		Private: *privID,
 		IsChan:  false,
 		Name: name,
+		HDIndex: index,
 	}
 	
 	// Encode address as string. 
@@ -362,35 +604,54 @@ func (mgr *Manager) Addresses() []string {
 
 // NameAddress names an address.
 func (mgr *Manager) NameAddress(address, name string) error {
-	mgr.mutex.RLock()
-	defer mgr.mutex.RUnlock()
+	mgr.mutex.Lock()
 	
 	// Does the address exist in the database? 
-	if id, ok := mgr.db.IDs[address]; !ok {
+	id, ok := mgr.db.IDs[address]
+	if !ok {
+		mgr.mutex.Unlock()
 		return ErrNonexistentIdentity
-	} else {
-		id.Name = name
-		mgr.db.IDs[address] = id
 	}
-	
+	id.Name = name
+	mgr.mutex.Unlock()
+
+	mgr.notify(address)
 	return nil
 } 
 
-// UnnameAddress removes a name from the address.
-func (mgr *Manager) UnnameAddress(address string) error {
-	mgr.mutex.RLock()
-	defer mgr.mutex.RUnlock()
-	
-	// Does the address exist in the database? 
-	if id, ok := mgr.db.IDs[address]; !ok {
+// SetDifficulty sets the proof-of-work difficulty that an identity demands
+// of messages sent to it. It is published in the identity's pubkey.
+func (mgr *Manager) SetDifficulty(address string, nonceTrials, extraBytes uint64) error {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+
+	id, ok := mgr.db.IDs[address]
+	if !ok {
 		return ErrNonexistentIdentity
-	} else {
-		id.Name = ""
-		mgr.db.IDs[address] = id
 	}
+	id.NonceTrialsPerByte = nonceTrials
+	id.ExtraBytes = extraBytes
 	return nil
 }
 
+// Difficulty returns the proof-of-work difficulty that an identity demands of
+// messages sent to it.
+func (mgr *Manager) Difficulty(address string) (nonceTrials, extraBytes uint64, err error) {
+	mgr.mutex.RLock()
+	defer mgr.mutex.RUnlock()
+
+	id, ok := mgr.db.IDs[address]
+	if !ok {
+		return 0, 0, ErrNonexistentIdentity
+	}
+	return id.NonceTrialsPerByte, id.ExtraBytes, nil
+}
+
+// UnnameAddress removes a name from the address.
+func (mgr *Manager) UnnameAddress(address string) error {
+	return mgr.NameAddress(address, "")
+}
+
 // Get the map of addresses to names. 
 func (mgr *Manager) Names() map[string]string {
 	
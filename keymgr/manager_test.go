@@ -7,6 +7,7 @@ package keymgr_test
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 	"io/ioutil"
 	"fmt"
@@ -115,24 +116,29 @@ func TestOperation(t *testing.T) {
 	}
 
 	// Remove an imported key and check if the operation is successful.
-	/*mgr1.RemoveImported(privacyChan.Address())
+	err = mgr1.RemoveImported(privacyChan.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
 	if n := mgr1.NumImported(); n != 0 {
 		t.Errorf("invalid numImported for no identity, expected %d got %d",
 			0, n)
 	}
-	err = mgr1.ForEach(func(id keymgr.PrivateID) error {
-		if bytes.Equal(id.Tag(), privacyChan.Tag()) {
+	err = mgr1.ForEach(func(id *keymgr.PrivateID) error {
+		if bytes.Equal(id.Private.Address.Ripe[:], privacyChan.Private.Address.Ripe[:]) {
 			return errors.New("should not happen")
 		}
 		return nil
 	})
 	if err != nil {
 		t.Error("imported key not removed from database")
-	}*/
+	}
 
 	// Try to remove a key that doesn't exist in the database. 
-	// Should not crash the program. (function removed)
-	//mgr1.RemoveImported(privacyChan.Address())
+	err = mgr1.RemoveImported(privacyChan.Address())
+	if err != keymgr.ErrNonexistentIdentity {
+		t.Errorf("expected ErrNonexistentIdentity, got %v", err)
+	}
 
 	// Try to retrieve non-existant private identity from address.
 	privacyRetrieved = mgr1.LookupByAddress("BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq")
@@ -155,6 +161,103 @@ func TestErrors(t *testing.T) {
 	}
 }
 
+func TestChans(t *testing.T) {
+	mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The address of PyBitmessage's general chan.
+	general := "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r"
+
+	if _, err = mgr.JoinChan("general", "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq"); err != keymgr.ErrChanMismatch {
+		t.Errorf("expected ErrChanMismatch, got %v", err)
+	}
+	if _, err = mgr.CreateChan(""); err == nil {
+		t.Error("expected error creating chan with empty passphrase")
+	}
+
+	id, err := mgr.JoinChan("general", general)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Address() != general || !id.IsChan || !id.Imported || id.Name != "[chan] general" {
+		t.Errorf("unexpected chan %s %s, chan: %v, imported: %v",
+			id.Address(), id.Name, id.IsChan, id.Imported)
+	}
+	if mgr.LookupByAddress(general) == nil {
+		t.Error("chan not found in key manager")
+	}
+
+	id, err = mgr.CreateChan("general")
+	if err != keymgr.ErrDuplicateIdentity {
+		t.Errorf("expected ErrDuplicateIdentity, got %v", err)
+	}
+	if id == nil || id.Address() != general {
+		t.Error("existing chan not returned")
+	}
+	if n := mgr.NumImported(); n != 1 {
+		t.Errorf("invalid numImported, expected %d got %d", 1, n)
+	}
+}
+func TestDeterministicIdentities(t *testing.T) {
+	// Test vectors from PyBitmessage.
+	pass := "TIGER, tiger, burning bright. In the forests of the night"
+	tests := []struct {
+		version uint64
+		address string
+	}{
+		{4, "BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK"},
+		{3, "BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN"},
+	}
+
+	for i, test := range tests {
+		mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := mgr.NewDeterministicIdentities(pass, 1, test.version, false)
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if len(ids) != 1 || ids[0].Address() != test.address {
+			t.Errorf("test %d: expected %s", i, test.address)
+			continue
+		}
+		if ids[0].IsChan || !ids[0].Imported || mgr.LookupByAddress(test.address) == nil {
+			t.Errorf("test %d: identity not imported correctly", i)
+		}
+
+		// Generating them again gives the same identities.
+		again, err := mgr.NewDeterministicIdentities(pass, 2, test.version, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != 2 || again[0].Address() != test.address ||
+			again[1].Address() == test.address {
+			t.Errorf("test %d: identities not regenerated correctly", i)
+		}
+		if n := mgr.NumImported(); n != 2 {
+			t.Errorf("test %d: invalid numImported, expected %d got %d", i, 2, n)
+		}
+	}
+
+	mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mgr.NewDeterministicIdentities(pass, 1, 2, false); err != keymgr.ErrUnsupportedVersion {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, err = mgr.NewDeterministicIdentities("", 1, 4, false); err == nil {
+		t.Error("expected error with empty passphrase")
+	}
+	if _, err = mgr.NewDeterministicIdentities(pass, 0, 4, false); err == nil {
+		t.Error("expected error generating no identities")
+	}
+}
 
 // Import a key file from pybitmessage or bmagent. 
 func testImportKeyFile(t *testing.T, testID int, file string, addresses map[string]string) {
@@ -218,4 +321,155 @@ func TestImportKeyFile(t *testing.T) {
 	for i, test := range testCases {
 		testImportKeyFile(t, i, test.file, nil)
 	}
-}
\ No newline at end of file
+}
+func TestListener(t *testing.T) {
+	mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	var notified []string
+	mgr.AddListener(func(address string) {
+		// The key manager must be unlocked when listeners are called. 
+		if mgr.LookupByAddress(address) == nil {
+			t.Errorf("Listener called with unknown address %s", address)
+		}
+		notified = append(notified, address)
+	})
+	
+	id := mgr.NewHDIdentity(1, "")
+	if err := mgr.NameAddress(id.Address(), "Zoidberg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.NameAddress("BM-nonexistent", "Zoidberg"); err != keymgr.ErrNonexistentIdentity {
+		t.Errorf("Expected ErrNonexistentIdentity, got %v", err)
+	}
+	
+	if len(notified) != 2 || notified[0] != id.Address() || notified[1] != id.Address() {
+		t.Errorf("Listener called with %v, expected address %s twice", 
+			notified, id.Address())
+	}
+	if mgr.Names()[id.Address()] != "Zoidberg" {
+		t.Error("Address was not named.")
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	
+	id := mgr.NewHDIdentity(1, "")
+	if err := mgr.SetDifficulty(id.Address(), 2000, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.SetDifficulty("BM-nonexistent", 2000, 3000); err != keymgr.ErrNonexistentIdentity {
+		t.Errorf("Expected ErrNonexistentIdentity, got %v", err)
+	}
+	
+	nonceTrials, extraBytes, err := mgr.Difficulty(id.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonceTrials != 2000 || extraBytes != 3000 {
+		t.Errorf("Expected difficulty 2000, 3000, got %d, %d", nonceTrials, extraBytes)
+	}
+	if _, _, err := mgr.Difficulty("BM-nonexistent"); err != keymgr.ErrNonexistentIdentity {
+		t.Errorf("Expected ErrNonexistentIdentity, got %v", err)
+	}
+	
+	// The difficulty should be kept when the keys are saved.
+	saved, err := mgr.ExportEncrypted([]byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr, err = keymgr.FromEncrypted(saved, []byte("pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = mgr.LookupByAddress(id.Address())
+	if id == nil || id.NonceTrialsPerByte != 2000 || id.ExtraBytes != 3000 {
+		t.Error("Difficulty was not saved.")
+	}
+}
+
+func TestDisableIdentities(t *testing.T) {
+	mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notified []string
+	mgr.AddListener(func(address string) {
+		notified = append(notified, address)
+	})
+
+	hd := mgr.NewHDIdentity(1, "").Address()
+	general, err := mgr.JoinChan("general", "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chan1 := general.Address()
+	notified = nil
+
+	// Disable and enable an imported identity.
+	if err = mgr.DisableIdentity(chan1); err != nil {
+		t.Fatal(err)
+	}
+	if !mgr.LookupByAddress(chan1).Disabled {
+		t.Error("identity not disabled")
+	}
+	if err = mgr.EnableIdentity(chan1); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.LookupByAddress(chan1).Disabled {
+		t.Error("identity not enabled")
+	}
+	if err = mgr.DisableIdentity("BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq"); err != keymgr.ErrNonexistentIdentity {
+		t.Errorf("expected ErrNonexistentIdentity, got %v", err)
+	}
+
+	// HD identities are retired rather than removed, and imported
+	// identities are removed rather than retired.
+	if err = mgr.RemoveImported(hd); err != keymgr.ErrDerivedIdentity {
+		t.Errorf("expected ErrDerivedIdentity, got %v", err)
+	}
+	if err = mgr.RetireIdentity(chan1); err != keymgr.ErrImportedIdentity {
+		t.Errorf("expected ErrImportedIdentity, got %v", err)
+	}
+	if err = mgr.RetireIdentity(hd); err != nil {
+		t.Fatal(err)
+	}
+	if id := mgr.LookupByAddress(hd); !id.Disabled || !id.Retired {
+		t.Error("identity not retired")
+	}
+	if err = mgr.EnableIdentity(hd); err != keymgr.ErrRetiredIdentity {
+		t.Errorf("expected ErrRetiredIdentity, got %v", err)
+	}
+
+	// A retired identity stays retired when the keys are saved and loaded.
+	plain, err := mgr.ExportPlaintext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr1, err := keymgr.FromPlaintext(bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := mgr1.LookupByAddress(hd); id == nil || !id.Retired {
+		t.Error("retired identity not saved")
+	}
+
+	if err = mgr.RemoveImported(chan1); err != nil {
+		t.Fatal(err)
+	}
+	if mgr.LookupByAddress(chan1) != nil || mgr.NumImported() != 0 {
+		t.Error("identity not removed")
+	}
+
+	expected := []string{chan1, chan1, hd, chan1}
+	if fmt.Sprint(notified) != fmt.Sprint(expected) {
+		t.Errorf("expected notifications %v, got %v", expected, notified)
+	}
+}
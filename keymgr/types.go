@@ -33,9 +33,17 @@ type PrivateID struct {
 	// we don't want to receive messages for anymore) or we want to store the
 	// private keys for an imported identity but not actively listen on it.
 	Disabled bool
+
+	// Retired tells whether the identity has been disabled permanently. Only
+	// HD identities are retired, since imported identities can be removed.
+	Retired bool
 	
 	// IsImported says whether the identity is imported or derived. 
 	Imported bool
+
+	// HDIndex is the index from which a derived identity was derived from
+	// the master key. It means nothing for imported identities.
+	HDIndex uint32
 	
 	// Name is a name for this id. 
 	Name string
@@ -86,7 +94,9 @@ func (id *PrivateID) MarshalJSON() ([]byte, error) {
 		"encryptionKey":      bmutil.EncodeWIF(id.EncryptionKey),
 		"isChan":             id.IsChan,
 		"disabled":           id.Disabled,
+		"retired":            id.Retired,
 		"imported":           id.Imported,
+		"hdIndex":            id.HDIndex,
 		"name":               id.Name, 
 	})
 }
@@ -100,7 +110,9 @@ type privateIDStore struct {
 	EncryptionKey      string `json:"encryptionKey"`
 	IsChan             bool   `json:"isChan"`
 	Disabled           bool   `json:"disabled"`
+	Retired            bool   `json:"retired"`
 	Imported           bool   `json:"imported"`
+	HDIndex            uint32 `json:"hdIndex"`
 	Name               string `json:"name"`
 }
 
@@ -138,7 +150,9 @@ func (id *PrivateID) UnmarshalJSON(in []byte) error {
 	id.ExtraBytes = stored.ExtraBytes
 	id.IsChan = stored.IsChan
 	id.Disabled = stored.Disabled
+	id.Retired = stored.Retired
 	id.Imported = stored.Imported
+	id.HDIndex = stored.HDIndex
 	id.Name = stored.Name
 
 	return nil
@@ -0,0 +1,295 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package keymgr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/DanielKrawisz/bmutil/identity"
+)
+
+const (
+	// base58Alphabet is the alphabet in which addresses are encoded.
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+	// vanityVersion and vanityStream are the address version and stream of
+	// the identities found by a vanity search.
+	vanityVersion = 4
+	vanityStream  = 1
+
+	// progressInterval is the number of identities that a thread of a vanity
+	// search tries between checks of the quit channel and reports of its
+	// progress.
+	progressInterval = 1 << 8
+)
+
+var (
+	// ErrSearchCancelled is returned when a vanity search is cancelled
+	// before an identity is found.
+	ErrSearchCancelled = errors.New("vanity search cancelled")
+)
+
+// VanitySearch describes a search for an identity whose address is easy to
+// recognize, either because it begins with a chosen prefix after "BM-" or
+// because its ripe begins with zero bytes, which makes it shorter.
+type VanitySearch struct {
+	// Prefix is what the address must begin with after "BM-".
+	Prefix string
+
+	// Zeros is the number of zero bytes that the ripe must begin with.
+	Zeros int
+
+	// Name is the name given to the identity that is found.
+	Name string
+
+	// HD is true if identities are derived from the master key. The
+	// identity that is found keeps its index and the indices that were
+	// skipped over are not used. Otherwise, random identities are tried
+	// and the one that is found is imported.
+	HD bool
+
+	// Threads is the number of threads to search in. If it is zero, there
+	// is one for each CPU.
+	Threads int
+
+	// Progress, if not nil, is called from time to time with the number of
+	// identities that have been tried.
+	Progress func(attempts uint64)
+}
+
+// validate checks that an address could match the search.
+func (s *VanitySearch) validate() error {
+	if s.Zeros < 0 || s.Zeros > 18 {
+		return errors.New("number of zero bytes must be between 0 and 18")
+	}
+	if s.Prefix == "" && s.Zeros == 0 {
+		return errors.New("a prefix or a number of zero bytes is required")
+	}
+	for _, c := range s.Prefix {
+		if !strings.ContainsRune(base58Alphabet, c) {
+			return fmt.Errorf("%q cannot appear in an address", c)
+		}
+	}
+	return nil
+}
+
+// matches returns whether an identity is the one that the search looks for.
+func (s *VanitySearch) matches(id *identity.Private) bool {
+	for _, b := range id.Address.Ripe[:s.Zeros] {
+		if b != 0 {
+			return false
+		}
+	}
+
+	address, err := id.Address.Encode()
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimPrefix(address, "BM-"), s.Prefix)
+}
+
+// ExpectedAttempts returns the number of identities that the search is
+// expected to try before it finds one. An error is returned if no address
+// can match the search.
+func (s *VanitySearch) ExpectedAttempts() (float64, error) {
+	if err := s.validate(); err != nil {
+		return 0, err
+	}
+
+	// An address is the base 58 encoding of its version, its stream, its
+	// ripe without leading zeros, and a four byte checksum. Apart from the
+	// first byte of the ripe, which is not zero, the bytes are uniformly
+	// distributed, so the probability that the address begins with the
+	// prefix is the fraction of the possible values that do. A ripe with
+	// more zero bytes than required gives a shorter address, but such
+	// ripes are rare enough that only a few more need to be considered.
+	header := big.NewInt(vanityVersion<<8 | vanityStream)
+	base := big.NewInt(256)
+	probability := new(big.Rat)
+	weight := big.NewRat(255, 256) // Probability of exactly z zero bytes.
+	for z := s.Zeros; z < s.Zeros+4 && z < 20; z++ {
+		n := int64(20 - z + 4)
+		size := new(big.Int).Exp(base, big.NewInt(n), nil)
+		lo := new(big.Int).Mul(header, size)
+		hi := new(big.Int).Add(lo, size)
+		lo.Add(lo, new(big.Int).Exp(base, big.NewInt(n-1), nil))
+
+		fraction := new(big.Rat).SetFrac(prefixCount(s.Prefix, lo, hi),
+			new(big.Int).Sub(hi, lo))
+		probability.Add(probability, fraction.Mul(fraction, weight))
+		weight = new(big.Rat).Mul(weight, big.NewRat(1, 256))
+	}
+
+	if probability.Sign() == 0 {
+		return 0, fmt.Errorf("no address can begin with BM-%s", s.Prefix)
+	}
+
+	// The probability of the zero bytes themselves.
+	p, _ := probability.Float64()
+	for i := 0; i < s.Zeros; i++ {
+		p /= 256
+	}
+	return 1 / p, nil
+}
+
+// prefixCount returns the number of integers in the range [lo, hi) whose
+// base 58 encodings begin with the given prefix.
+func prefixCount(prefix string, lo, hi *big.Int) *big.Int {
+	count := new(big.Int)
+	if prefix == "" {
+		return count.Sub(hi, lo)
+	}
+	if prefix[0] == base58Alphabet[0] {
+		// Leading zero digits are not part of the encoding of a number.
+		return count
+	}
+
+	fiftyEight := big.NewInt(58)
+	value := new(big.Int)
+	for _, c := range prefix {
+		value.Mul(value, fiftyEight)
+		value.Add(value, big.NewInt(int64(strings.IndexRune(base58Alphabet, c))))
+	}
+	next := new(big.Int).Add(value, big.NewInt(1))
+
+	// For each length of encoding, the numbers which begin with the prefix
+	// form a range.
+	scale := big.NewInt(1)
+	for start := new(big.Int).Set(value); start.Cmp(hi) < 0; {
+		end := new(big.Int).Mul(next, scale)
+		if end.Cmp(lo) > 0 {
+			a, b := start, end
+			if a.Cmp(lo) < 0 {
+				a = lo
+			}
+			if b.Cmp(hi) > 0 {
+				b = hi
+			}
+			count.Add(count, new(big.Int).Sub(b, a))
+		}
+
+		scale.Mul(scale, fiftyEight)
+		start = new(big.Int).Mul(value, scale)
+	}
+	return count
+}
+
+// NewVanityIdentity searches for an identity which matches the search, adds
+// it to the key manager and returns it. ErrSearchCancelled is returned if
+// quit is closed before one is found.
+func (mgr *Manager) NewVanityIdentity(s *VanitySearch, quit <-chan struct{}) (*PrivateID, error) {
+	if _, err := s.ExpectedAttempts(); err != nil {
+		return nil, err
+	}
+
+	threads := s.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	mgr.mutex.RLock()
+	master := (*hdkeychain.ExtendedKey)(mgr.db.MasterKey)
+	nextIndex := mgr.db.NewIDIndex
+	mgr.mutex.RUnlock()
+
+	type result struct {
+		id    *identity.Private
+		index uint32
+	}
+
+	var attempts uint64
+	done := make(chan struct{})
+	results := make(chan *result, threads)
+
+	for i := 0; i < threads; i++ {
+		go func() {
+			for n := 1; ; n++ {
+				if n%progressInterval == 0 {
+					select {
+					case <-quit:
+						results <- nil
+						return
+					case <-done:
+						results <- nil
+						return
+					default:
+					}
+
+					total := atomic.AddUint64(&attempts, progressInterval)
+					if s.Progress != nil {
+						s.Progress(total)
+					}
+				}
+
+				var id *identity.Private
+				var index uint32
+				var err error
+				if s.HD {
+					index = atomic.AddUint32(&nextIndex, 1) - 1
+					id, err = identity.NewHD(master, index, vanityStream)
+				} else {
+					id, err = identity.NewRandom(0)
+					if err == nil {
+						id.CreateAddress(vanityVersion, vanityStream)
+					}
+				}
+
+				if err == nil && s.matches(id) {
+					results <- &result{id, index}
+					return
+				}
+			}
+		}()
+	}
+
+	// Wait for every thread to stop.
+	var found *result
+	for i := 0; i < threads; i++ {
+		r := <-results
+		if r != nil && found == nil {
+			found = r
+			close(done)
+		}
+	}
+	if found == nil {
+		return nil, ErrSearchCancelled
+	}
+
+	id := &PrivateID{
+		Private: *found.id,
+		Name:    s.Name,
+	}
+	if s.HD {
+		id.HDIndex = found.index
+	}
+	address := id.Address()
+
+	if !s.HD {
+		mgr.ImportIdentity(*id)
+		return mgr.LookupByAddress(address), nil
+	}
+
+	mgr.mutex.Lock()
+	if mgr.db.NewIDIndex <= found.index {
+		mgr.db.NewIDIndex = found.index + 1
+	}
+	if existing, ok := mgr.db.IDs[address]; ok {
+		// The identity was derived while the search was running.
+		mgr.mutex.Unlock()
+		return existing, nil
+	}
+	mgr.derivedIDs = append(mgr.derivedIDs, address)
+	mgr.db.IDs[address] = id
+	mgr.mutex.Unlock()
+
+	mgr.notify(address)
+	return id, nil
+}
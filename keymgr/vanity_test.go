@@ -0,0 +1,125 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package keymgr_test
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/DanielKrawisz/bmagent/keymgr"
+)
+
+func TestVanityExpectedAttempts(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		zeros    int
+		expected float64 // Zero if no address can match.
+	}{
+		{"", 1, 256},
+		{"", 2, 65536},
+		{"2c", 1, 256},
+		{"87", 0, 1},
+		{"2c", 0, 256},
+		{"1", 0, 0},
+		{"zz", 0, 0},
+		{"2D", 1, 0},
+		{"2cl", 1, 0}, // Not in the alphabet.
+		{"", 0, 0},
+		{"", -1, 0},
+	}
+
+	for i, test := range tests {
+		s := &keymgr.VanitySearch{Prefix: test.prefix, Zeros: test.zeros}
+		attempts, err := s.ExpectedAttempts()
+		if test.expected == 0 {
+			if err == nil {
+				t.Errorf("test %d: expected error, got %f", i, attempts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if math.Abs(attempts-test.expected)/test.expected > 0.01 {
+			t.Errorf("test %d: expected about %f attempts, got %f", i,
+				test.expected, attempts)
+		}
+	}
+
+	// Each character of the prefix makes the search about 58 times longer.
+	short, _ := (&keymgr.VanitySearch{Prefix: "2cA", Zeros: 1}).ExpectedAttempts()
+	long, _ := (&keymgr.VanitySearch{Prefix: "2cAB", Zeros: 1}).ExpectedAttempts()
+	if ratio := long / short; ratio < 50 || ratio > 66 {
+		t.Errorf("unexpected ratio %f", ratio)
+	}
+}
+
+func TestNewVanityIdentity(t *testing.T) {
+	mgr, err := keymgr.New([]byte("a secure psuedorandom seed (clearly not)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A random identity is imported.
+	id, err := mgr.NewVanityIdentity(&keymgr.VanitySearch{
+		Prefix:  "2c",
+		Zeros:   1,
+		Name:    "Short",
+		Threads: 2,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id.Address(), "BM-2c") || id.Name != "Short" ||
+		!id.Imported || mgr.LookupByAddress(id.Address()) == nil {
+		t.Errorf("unexpected identity %s %s, imported: %v", id.Address(), id.Name, id.Imported)
+	}
+	if n := mgr.NumImported(); n != 1 {
+		t.Errorf("invalid numImported, expected %d got %d", 1, n)
+	}
+
+	// An HD identity keeps its index, so the next one is derived after it.
+	id, err = mgr.NewVanityIdentity(&keymgr.VanitySearch{Zeros: 1, HD: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Imported || id.Private.Address.Ripe[0] != 0 {
+		t.Errorf("unexpected identity %s, imported: %v", id.Address(), id.Imported)
+	}
+	if n := mgr.NumDeterministic(); n != 1 {
+		t.Errorf("invalid numDeterministic, expected %d got %d", 1, n)
+	}
+	next := mgr.NewHDIdentity(1, "")
+	if next.Address() == id.Address() {
+		t.Error("HD identity derived twice")
+	}
+	if next.HDIndex <= id.HDIndex {
+		t.Errorf("expected index after %d, got %d", id.HDIndex, next.HDIndex)
+	}
+
+	// The index is kept when the identity is saved.
+	data, err := json.Marshal(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &keymgr.PrivateID{}
+	if err = json.Unmarshal(data, saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.HDIndex != id.HDIndex {
+		t.Errorf("expected index %d, got %d", id.HDIndex, saved.HDIndex)
+	}
+
+	// A search which is cancelled returns an error.
+	quit := make(chan struct{})
+	close(quit)
+	_, err = mgr.NewVanityIdentity(&keymgr.VanitySearch{Zeros: 8}, quit)
+	if err != keymgr.ErrSearchCancelled {
+		t.Errorf("expected ErrSearchCancelled, got %v", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/btcsuite/btclog"
 	"github.com/btcsuite/seelog"
+	"github.com/DanielKrawisz/bmagent/carddav"
 	"github.com/DanielKrawisz/bmagent/email"
 	"github.com/DanielKrawisz/bmagent/powmgr"
 	"github.com/DanielKrawisz/bmagent/rpc"
@@ -32,6 +33,7 @@ var (
 	imapLog    = btclog.Disabled
 	smtpLog    = btclog.Disabled
 	powLog     = btclog.Disabled
+	davLog     = btclog.Disabled
 )
 
 // subsystemLoggers maps each subsystem identifier to its associated logger.
@@ -43,6 +45,7 @@ var subsystemLoggers = map[string]btclog.Logger{
 	"IMAP": imapLog,
 	"SMTP": smtpLog,
 	"POW":  powLog,
+	"DAV":  davLog,
 }
 
 // logClosure is used to provide a closure over expensive logging operations
@@ -96,6 +99,10 @@ func useLogger(subsystemID string, logger btclog.Logger) {
 	case "POW":
 		powLog = logger
 		powmgr.UseLogger(logger)
+
+	case "DAV":
+		davLog = logger
+		carddav.UseLogger(logger)
 	}
 }
 
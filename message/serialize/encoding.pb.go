@@ -69,6 +69,9 @@ type MessageState struct {
 	AckReceived     bool   `protobuf:"varint,6,opt,name=ack_received" json:"ack_received,omitempty"`
 	AckExpected     bool   `protobuf:"varint,7,opt,name=ack_expected" json:"ack_expected,omitempty"`
 	Received        bool   `protobuf:"varint,8,opt,name=received" json:"received,omitempty"`
+	Ttl             uint64 `protobuf:"varint,9,opt,name=ttl" json:"ttl,omitempty"`
+	Stream          uint64 `protobuf:"varint,10,opt,name=stream" json:"stream,omitempty"`
+	Expires         string `protobuf:"bytes,11,opt,name=expires" json:"expires,omitempty"`
 }
 
 func (m *MessageState) Reset()         { *m = MessageState{} }
@@ -0,0 +1,259 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package powmgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+var (
+	// ErrPowTimeout is returned by a Backend which takes too long.
+	ErrPowTimeout = errors.New("proof-of-work timed out")
+
+	// ErrPowCancelled is returned by a Backend whose calculation is
+	// abandoned.
+	ErrPowCancelled = errors.New("proof-of-work cancelled")
+)
+
+// Backend is a proof-of-work solver outside of this process, such as a
+// program or a service on another machine.
+type Backend interface {
+	// Pow returns a nonce for which the proof-of-work of an object with the
+	// given initial hash is at most target, trying nonces from start onward.
+	// The calculation is abandoned if quit is closed.
+	Pow(target uint64, hash []byte, start uint64, quit <-chan struct{}) (uint64, error)
+}
+
+// PowRequest is the request sent to a Backend, encoded as JSON.
+type PowRequest struct {
+	Target uint64 `json:"target"`
+	Hash   string `json:"hash"` // hex encoded.
+	Start  uint64 `json:"start"`
+}
+
+// PowResponse is the response expected from a Backend, encoded as JSON.
+type PowResponse struct {
+	Nonce uint64 `json:"nonce"`
+	Error string `json:"error,omitempty"`
+}
+
+// CheckNonce returns whether the nonce satisfies the target for an object
+// with the given initial hash.
+func CheckNonce(target uint64, hash []byte, nonce uint64) bool {
+	return trialValue(nonce, hash) <= target
+}
+
+// Remote returns a PowFunc which calculates the proof-of-work with the given
+// backend. If the backend fails or returns a nonce which does not satisfy the
+// target, the calculation is done by fallback instead. Backends do not
+// report their progress, but fallback does.
+func Remote(backend Backend, fallback PowFunc) PowFunc {
+	return func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		nonce, err := backend.Pow(target, hash, start, quit)
+		if err == nil {
+			if CheckNonce(target, hash, nonce) {
+				return nonce, true
+			}
+			err = fmt.Errorf("nonce %d does not satisfy target %d", nonce, target)
+		}
+
+		select {
+		case <-quit:
+			return start, false
+		default:
+		}
+
+		log.Warnf("Remote proof-of-work failed, using local solver instead: %v", err)
+		return fallback(target, hash, start, quit, progress)
+	}
+}
+
+// encodeRequest encodes the request for a backend.
+func encodeRequest(target uint64, hash []byte, start uint64) ([]byte, error) {
+	return json.Marshal(&PowRequest{
+		Target: target,
+		Hash:   hex.EncodeToString(hash),
+		Start:  start,
+	})
+}
+
+// decodeResponse decodes the response of a backend.
+func decodeResponse(b []byte) (uint64, error) {
+	var resp PowResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	return resp.Nonce, nil
+}
+
+// commandBackend runs a program which reads a PowRequest from stdin and
+// writes a PowResponse to stdout.
+type commandBackend struct {
+	command []string
+	timeout time.Duration
+}
+
+// NewCommandBackend returns a Backend which runs the given command for
+// every calculation. It is killed if it takes longer than timeout, unless
+// timeout is zero.
+func NewCommandBackend(command []string, timeout time.Duration) Backend {
+	return &commandBackend{
+		command: command,
+		timeout: timeout,
+	}
+}
+
+// Pow runs the command.
+func (c *commandBackend) Pow(target uint64, hash []byte, start uint64,
+	quit <-chan struct{}) (uint64, error) {
+
+	if len(c.command) == 0 {
+		return 0, errors.New("No proof-of-work command given.")
+	}
+
+	req, err := encodeRequest(target, hash, start)
+	if err != nil {
+		return 0, err
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &out
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			return 0, err
+		}
+	case <-quit:
+		cmd.Process.Kill()
+		<-done
+		return 0, ErrPowCancelled
+	case <-timeout:
+		cmd.Process.Kill()
+		<-done
+		return 0, ErrPowTimeout
+	}
+
+	return decodeResponse(out.Bytes())
+}
+
+// httpBackend posts a PowRequest to a web service, which responds with a
+// PowResponse.
+type httpBackend struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// NewHTTPBackend returns a Backend which uses the service at the given
+// url. Requests which take longer than timeout fail, unless timeout is zero.
+func NewHTTPBackend(url string, timeout time.Duration) Backend {
+	return &httpBackend{
+		url:     url,
+		timeout: timeout,
+		client:  &http.Client{},
+	}
+}
+
+// Pow sends a request to the service.
+func (h *httpBackend) Pow(target uint64, hash []byte, start uint64,
+	quit <-chan struct{}) (uint64, error) {
+
+	body, err := encodeRequest(target, hash, start)
+	if err != nil {
+		return 0, err
+	}
+
+	// The request is cancelled when quit is closed or when it takes too long.
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if h.timeout != 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), h.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, h.contextError(ctx, quit, err)
+	}
+	defer resp.Body.Close()
+
+	var b bytes.Buffer
+	if _, err = b.ReadFrom(resp.Body); err != nil {
+		return 0, h.contextError(ctx, quit, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var r PowResponse
+		if json.Unmarshal(b.Bytes(), &r) == nil && r.Error != "" {
+			return 0, errors.New(r.Error)
+		}
+		return 0, fmt.Errorf("Proof-of-work service returned %s", resp.Status)
+	}
+
+	return decodeResponse(b.Bytes())
+}
+
+// contextError returns the error for a request which failed, which is
+// ErrPowCancelled or ErrPowTimeout if the request was cut short.
+func (h *httpBackend) contextError(ctx context.Context, quit <-chan struct{},
+	err error) error {
+
+	select {
+	case <-quit:
+		return ErrPowCancelled
+	default:
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrPowTimeout
+	}
+	return err
+}
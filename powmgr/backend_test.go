@@ -0,0 +1,137 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package powmgr_test
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/powmgr"
+)
+
+// solve answers a PowRequest. If cheat is true, it returns a nonce which
+// does not satisfy the target.
+func solve(req *powmgr.PowRequest, cheat bool) *powmgr.PowResponse {
+	hash, err := hex.DecodeString(req.Hash)
+	if err != nil {
+		return &powmgr.PowResponse{Error: err.Error()}
+	}
+
+	for nonce := req.Start; ; nonce++ {
+		if powmgr.CheckNonce(req.Target, hash, nonce) != cheat {
+			return &powmgr.PowResponse{Nonce: nonce}
+		}
+	}
+}
+
+// TestHelperProcess is not a real test. It is run by TestCommandBackend as
+// a proof-of-work command.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("BMAGENT_POW_HELPER") != "1" {
+		return
+	}
+
+	var req powmgr.PowRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		os.Exit(1)
+	}
+	json.NewEncoder(os.Stdout).Encode(solve(&req, false))
+	os.Exit(0)
+}
+
+// fallback returns a PowFunc which records whether it was used.
+func fallback(used *bool) powmgr.PowFunc {
+	return func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		*used = true
+		return powmgr.Sequential(target, hash, start, quit, progress)
+	}
+}
+
+func TestHTTPBackend(t *testing.T) {
+	hash := sha512.Sum512([]byte("test object"))
+	target := uint64(1) << 56
+
+	tests := []struct {
+		handler  func(*powmgr.PowRequest) (int, *powmgr.PowResponse)
+		fallback bool
+	}{
+		// A working service.
+		{func(req *powmgr.PowRequest) (int, *powmgr.PowResponse) {
+			return http.StatusOK, solve(req, false)
+		}, false},
+		// A service which returns a wrong nonce.
+		{func(req *powmgr.PowRequest) (int, *powmgr.PowResponse) {
+			return http.StatusOK, solve(req, true)
+		}, true},
+		// A service which returns an error.
+		{func(req *powmgr.PowRequest) (int, *powmgr.PowResponse) {
+			return http.StatusServiceUnavailable, &powmgr.PowResponse{Error: "busy"}
+		}, true},
+		// A service which is too slow.
+		{func(req *powmgr.PowRequest) (int, *powmgr.PowResponse) {
+			time.Sleep(time.Second)
+			return http.StatusOK, solve(req, false)
+		}, true},
+	}
+
+	for i, test := range tests {
+		handler := test.handler
+		service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req powmgr.PowRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			status, resp := handler(&req)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(resp)
+		}))
+
+		var used bool
+		f := powmgr.Remote(powmgr.NewHTTPBackend(service.URL, 200*time.Millisecond), fallback(&used))
+		nonce, ok := f(target, hash[:], 0, make(chan struct{}), nil)
+		service.Close()
+
+		if !ok || !powmgr.CheckNonce(target, hash[:], nonce) {
+			t.Errorf("%d: invalid nonce %d returned", i, nonce)
+		}
+		if used != test.fallback {
+			t.Errorf("%d: expected fallback %v, got %v", i, test.fallback, used)
+		}
+	}
+}
+
+func TestCommandBackend(t *testing.T) {
+	hash := sha512.Sum512([]byte("test object"))
+	target := uint64(1) << 56
+
+	os.Setenv("BMAGENT_POW_HELPER", "1")
+	defer os.Unsetenv("BMAGENT_POW_HELPER")
+
+	var used bool
+	command := []string{os.Args[0], "-test.run=TestHelperProcess"}
+	f := powmgr.Remote(powmgr.NewCommandBackend(command, 10*time.Second), fallback(&used))
+	nonce, ok := f(target, hash[:], 0, make(chan struct{}), nil)
+	if !ok || !powmgr.CheckNonce(target, hash[:], nonce) {
+		t.Errorf("invalid nonce %d returned", nonce)
+	}
+	if used {
+		t.Error("fallback used for working command")
+	}
+
+	// A command which does not exist.
+	used = false
+	f = powmgr.Remote(powmgr.NewCommandBackend([]string{"/nonexistent/pow"}, time.Second), fallback(&used))
+	if nonce, ok = f(target, hash[:], 0, make(chan struct{}), nil); !ok || !used {
+		t.Errorf("expected fallback to be used, got %d, %v", nonce, ok)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package powmgr
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DanielKrawisz/bmutil/pow"
+)
+
+// PowFunc calculates a nonce for which the proof-of-work of an object with
+// the given initial hash is at most target, trying nonces from start onward.
+// The calculation is abandoned if quit is closed, in which case ok is false
+// and every nonce from start up to but not including the returned nonce has
+// been tried, so that the calculation can be resumed from there. While it
+// runs, progress is called from time to time with a nonce below which every
+// nonce has been tried. progress can be nil.
+type PowFunc func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+	progress func(next uint64)) (nonce uint64, ok bool)
+
+const (
+	// checkInterval is the number of nonces tried between checks of the quit
+	// channel.
+	checkInterval = 1 << 12
+
+	// minTTL is the shortest time to live used to calculate the target of an
+	// object that is being checked, as in PyBitmessage.
+	minTTL = time.Minute * 5
+)
+
+// trialValue returns the proof-of-work value of a nonce.
+func trialValue(nonce uint64, hash []byte) uint64 {
+	b := make([]byte, 8+len(hash))
+	binary.BigEndian.PutUint64(b, nonce)
+	copy(b[8:], hash)
+
+	first := sha512.Sum512(b)
+	second := sha512.Sum512(first[:])
+	return binary.BigEndian.Uint64(second[:8])
+}
+
+// CheckObject returns whether the proof-of-work of an encoded object,
+// including its nonce, is sufficient for the given nonce trials per byte and
+// extra bytes at the given time.
+func CheckObject(obj []byte, nonceTrials, extraBytes uint64, now time.Time) bool {
+	if len(obj) < 16 { // nonce and expiration time.
+		return false
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(obj[8:16])), 0)
+	ttl := expires.Sub(now)
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+
+	// As in the reference client, the length includes the nonce.
+	target := pow.CalculateTarget(uint64(len(obj)), uint64(ttl.Seconds()),
+		nonceTrials, extraBytes)
+	hash := sha512.Sum512(obj[8:])
+	return CheckNonce(target, hash[:], binary.BigEndian.Uint64(obj[:8]))
+}
+
+// search tries the nonces start, start + step, start + 2 * step... until
+// one is found which satisfies the target or until quit or done is closed,
+// in which case it returns the next nonce that it would have tried. The
+// next nonce is also passed to progress from time to time.
+func search(target uint64, hash []byte, start, step uint64,
+	quit, done <-chan struct{}, progress func(uint64)) (uint64, bool) {
+
+	for nonce := start; nonce <= math.MaxUint64-step; nonce += step {
+		if (nonce/step)%checkInterval == 0 {
+			select {
+			case <-quit:
+				return nonce, false
+			case <-done:
+				return nonce, false
+			default:
+			}
+
+			if progress != nil {
+				progress(nonce)
+			}
+		}
+
+		if trialValue(nonce, hash) <= target {
+			return nonce, true
+		}
+	}
+
+	return 0, false
+}
+
+// Sequential calculates the proof-of-work in a single thread.
+func Sequential(target uint64, hash []byte, start uint64, quit <-chan struct{},
+	progress func(uint64)) (uint64, bool) {
+	return search(target, hash, start, 1, quit, nil, progress)
+}
+
+// Parallel returns a PowFunc which calculates the proof-of-work in the
+// given number of threads.
+func Parallel(threads int) PowFunc {
+	return func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		type result struct {
+			nonce uint64
+			ok    bool
+		}
+
+		done := make(chan struct{})
+		results := make(chan result, threads)
+
+		// Every nonce below the lowest position of the threads has been
+		// tried.
+		var mtx sync.Mutex
+		positions := make([]uint64, threads)
+		for i := range positions {
+			positions[i] = start
+		}
+		report := func(thread int) func(uint64) {
+			if progress == nil {
+				return nil
+			}
+			return func(next uint64) {
+				mtx.Lock()
+				defer mtx.Unlock()
+
+				positions[thread] = next
+				lowest := next
+				for _, p := range positions {
+					if p < lowest {
+						lowest = p
+					}
+				}
+				progress(lowest)
+			}
+		}
+
+		for i := 0; i < threads; i++ {
+			go func(thread int) {
+				nonce, ok := search(target, hash, start+uint64(thread),
+					uint64(threads), quit, done, report(thread))
+				results <- result{nonce, ok}
+			}(i)
+		}
+
+		// Wait for every thread to stop. If the calculation was abandoned,
+		// the nonces below the lowest one returned have all been tried.
+		var nonce uint64
+		var found bool
+		next := uint64(math.MaxUint64)
+		for i := 0; i < threads; i++ {
+			r := <-results
+			if r.ok {
+				if !found {
+					nonce, found = r.nonce, true
+					close(done)
+				}
+			} else if r.nonce < next {
+				next = r.nonce
+			}
+		}
+
+		if found {
+			return nonce, true
+		}
+		return next, false
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package powmgr_test
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/powmgr"
+)
+
+func TestPowFuncs(t *testing.T) {
+	hash := sha512.Sum512([]byte("test object"))
+	target := uint64(1) << 52
+
+	for name, f := range map[string]powmgr.PowFunc{
+		"sequential": powmgr.Sequential,
+		"parallel":   powmgr.Parallel(4),
+	} {
+		nonce, ok := f(target, hash[:], 0, make(chan struct{}), nil)
+		if !ok {
+			t.Errorf("%s: pow was not found", name)
+			continue
+		}
+
+		b := make([]byte, 8+len(hash))
+		binary.BigEndian.PutUint64(b, nonce)
+		copy(b[8:], hash[:])
+		first := sha512.Sum512(b)
+		second := sha512.Sum512(first[:])
+		if binary.BigEndian.Uint64(second[:8]) > target {
+			t.Errorf("%s: nonce %d does not satisfy the target", name, nonce)
+		}
+
+		// A calculation which cannot succeed must report its progress
+		// and stop when cancelled, and it can be resumed from where it
+		// stopped.
+		quit := make(chan struct{})
+		var reported uint64
+		next, ok := f(0, hash[:], 100, quit, func(n uint64) {
+			if n < reported {
+				t.Errorf("%s: progress went backwards from %d to %d", name, reported, n)
+			}
+			if reported == 0 {
+				close(quit)
+			}
+			reported = n
+		})
+		if ok {
+			t.Errorf("%s: cancelled pow should not succeed", name)
+		}
+		if reported < 100 || next < reported {
+			t.Errorf("%s: reported %d, stopped at %d", name, reported, next)
+		}
+		resumed, ok := f(target, hash[:], next, make(chan struct{}), nil)
+		if !ok || resumed < next {
+			t.Errorf("%s: resumed pow returned %d, %v", name, resumed, ok)
+		}
+	}
+}
+
+func TestCheckObject(t *testing.T) {
+	now := time.Now()
+	obj := make([]byte, 56)
+	binary.BigEndian.PutUint64(obj[8:16], uint64(now.Add(time.Hour).Unix()))
+	copy(obj[16:], []byte("some object with a small payload"))
+	hash := sha512.Sum512(obj[8:])
+
+	// Find a nonce which satisfies a low difficulty but not a high one.
+	easy := ^uint64(0) / 64
+	hard := ^uint64(0) / (1 << 40)
+	var start uint64
+	for {
+		nonce, ok := powmgr.Sequential(easy, hash[:], start, make(chan struct{}), nil)
+		if !ok {
+			t.Fatal("pow was not found")
+		}
+		if !powmgr.CheckNonce(hard, hash[:], nonce) {
+			binary.BigEndian.PutUint64(obj[:8], nonce)
+			break
+		}
+		start = nonce + 1
+	}
+
+	if !powmgr.CheckObject(obj, 1, 1, now) {
+		t.Error("Object should satisfy a low difficulty.")
+	}
+	if powmgr.CheckObject(obj, 1<<40, 1000, now) {
+		t.Error("Object should not satisfy a high difficulty.")
+	}
+	if powmgr.CheckObject(obj[:10], 1, 1, now) {
+		t.Error("Object which is too short should not be accepted.")
+	}
+}
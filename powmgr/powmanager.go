@@ -6,6 +6,9 @@ package powmgr
 
 import (
 	"encoding/binary"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/DanielKrawisz/runner"
 	"github.com/DanielKrawisz/bmagent/store"
@@ -15,6 +18,11 @@ import (
 // While it is running, when it receives a message that a new item has been
 // added to the pow queue, it goes down the queue and runs the pow for every
 // item in the queue, and then sends the completed item to the server.
+// Up to a given number of items are processed at once, each by its own
+// worker. When every worker is busy, an item of a higher priority class
+// interrupts the item of lowest priority, whose calculation is resumed
+// afterwards. The progress of every calculation is saved in the queue
+// from time to time, so that it can also be resumed after a restart.
 type PowManager struct {
 	run      *runner.Runner
 	powQueue *store.PowQueue
@@ -25,18 +33,91 @@ type PowManager struct {
 	donePowFunc func(index uint64, user uint32, obj []byte)
 
 	// powFunc is the function that calculates the pow.
-	powFunc func(target uint64, hash []byte) uint64
+	powFunc PowFunc
+
+	// workers is the number of items whose pow is calculated at once.
+	workers int
+
+	mtx sync.Mutex // Protects the following fields.
+	// working contains the items whose pow is being calculated. 
+	working     map[uint64]*job
+	// hashRate is the number of nonces per second which were being tried
+	// the last time it was measured. 
+	hashRate    float64
+	// finish gives the expected number of nonces that a worker tries before
+	// each item in the queue is done. It is nil if the queue has changed
+	// since it was last worked out.
+	finish      map[uint64]float64
+}
+
+const (
+	// checkpointInterval is how often the progress of the pow calculations
+	// is saved.
+	checkpointInterval = time.Minute
+
+	// rateInterval is the minimum time over which the hash rate of a
+	// calculation is measured.
+	rateInterval = time.Second
+)
+
+// job is an item in the pow queue whose pow is being calculated.
+type job struct {
+	priority  uint8
+	// cancel is closed to interrupt the calculation. 
+	cancel    chan struct{}
+	stopped   bool // Whether cancel has been closed.
+	cancelled bool // Whether the item has been removed from the queue.
+	// The latest progress reported by the calculation and the latest
+	// progress saved in the queue. 
+	next      uint64
+	saved     uint64
+	// The hash rate of the calculation and the progress and time at
+	// which it was last measured.
+	rate      float64
+	rateNext  uint64
+	rateTime  time.Time
+}
+
+// report records the progress of the calculation and updates its hash rate.
+// It returns whether the hash rate has changed.
+func (j *job) report(next uint64, now time.Time) bool {
+	j.next = next
+
+	elapsed := now.Sub(j.rateTime)
+	if elapsed < rateInterval || next < j.rateNext {
+		return false
+	}
+
+	j.rate = float64(next-j.rateNext) / elapsed.Seconds()
+	j.rateNext = next
+	j.rateTime = now
+	return true
+}
+
+// stop interrupts the calculation.
+func (j *job) stop() {
+	if !j.stopped {
+		close(j.cancel)
+		j.stopped = true
+	}
 }
 
-// New creates a new PowManager.
+// New creates a new PowManager which calculates the pow of up to workers
+// items at once.
 func New(pq *store.PowQueue,
 	donePowFunc func(index uint64, user uint32, obj []byte),
-	powFunc func(target uint64, hash []byte) uint64) *PowManager {
+	powFunc PowFunc, workers int) *PowManager {
+
+	if workers < 1 {
+		workers = 1
+	}
 
 	pm := &PowManager{
 		powQueue:    pq,
 		donePowFunc: donePowFunc,
 		powFunc:     powFunc,
+		workers:     workers,
+		working:     make(map[uint64]*job),
 	}
 
 	pm.run = runner.New([]runner.Runnable{pm.powHandler},
@@ -66,12 +147,29 @@ func (pm *PowManager) Stop() {
 // RunPow adds an object message with a target value for PoW to the end of the
 // pow queue. It returns the index value of the stored element. If the
 // PowManager is running, then a signal is sent to start running hashes immediately.
+// If every worker is busy and the object has a higher priority than one of
+// the items being processed, the one of lowest priority is interrupted.
 func (pm *PowManager) RunPow(target uint64, user uint32, obj []byte) (uint64, error) {
 	index, err := pm.powQueue.Enqueue(target, user, obj)
 	if err != nil {
 		return 0, err
 	}
 
+	pm.mtx.Lock()
+	pm.finish = nil
+	if len(pm.working) >= pm.workers {
+		var lowest *job
+		for _, j := range pm.working {
+			if !j.stopped && (lowest == nil || j.priority < lowest.priority) {
+				lowest = j
+			}
+		}
+		if lowest != nil && store.PowPriority(obj) > lowest.priority {
+			lowest.stop()
+		}
+	}
+	pm.mtx.Unlock()
+
 	// Signal to start processing the pow if the queue is running.
 	if pm.newPowChan != nil {
 		pm.newPowChan <- struct{}{}
@@ -80,72 +178,329 @@ func (pm *PowManager) RunPow(target uint64, user uint32, obj []byte) (uint64, er
 	return index, nil
 }
 
-// powHandler manages the proof-of-work queue. It makes sure that only one
-// object is processed at a time. After doing POW, it returns the object
-// to the server.
+// Cancel removes the item with the given index from the pow queue. If its
+// pow is being calculated, the calculation is abandoned. store.ErrNotFound
+// is returned if there is no such item in the queue.
+func (pm *PowManager) Cancel(index uint64) error {
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+
+	_, _, err := pm.powQueue.Remove(index)
+	if err != nil {
+		return err
+	}
+	pm.finish = nil
+
+	if j, ok := pm.working[index]; ok {
+		j.cancelled = true
+		j.stop()
+	}
+
+	return nil
+}
+
+// HashRate returns the number of nonces per second that were being tried the
+// last time it was measured, or zero if it has not been measured yet.
+func (pm *PowManager) HashRate() float64 {
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+
+	return pm.hashRate
+}
+
+// expectedTrials returns the number of nonces which are expected to be tried
+// to find one which satisfies the target.
+func expectedTrials(target uint64) float64 {
+	return math.Pow(2, 64) / (float64(target) + 1)
+}
+
+// ItemStatus describes an item in the pow queue.
+type ItemStatus struct {
+	Index    uint64  `json:"index"`
+	User     uint32  `json:"user"`
+	Priority uint8   `json:"priority"`
+	Target   uint64  `json:"target"`
+	Progress uint64  `json:"progress"`
+	Working  bool    `json:"working"`
+	// ETA is the expected number of seconds until the pow of the item is
+	// done, or zero if the hash rate is not known.
+	ETA      float64 `json:"eta,omitempty"`
+}
+
+// Status describes the state of the PowManager.
+type Status struct {
+	// HashRate is in nonces per second.
+	HashRate float64       `json:"hashRate"`
+	Queue    []*ItemStatus `json:"queue"`
+}
+
+// schedule returns the expected number of nonces that a worker tries before
+// the pow of each of the given entries is done. Each entry is assumed to be
+// taken up in order by the first worker to be free.
+func (pm *PowManager) schedule(entries []*store.PowEntry) []float64 {
+	free := make([]float64, pm.workers)
+	finish := make([]float64, len(entries))
+	for i, entry := range entries {
+		next := 0
+		for w := range free {
+			if free[w] < free[next] {
+				next = w
+			}
+		}
+
+		free[next] += expectedTrials(entry.Target)
+		finish[i] = free[next]
+	}
+
+	return finish
+}
+
+// Status returns the hash rate and the items in the pow queue, in the order
+// in which they are expected to be done, with the expected time until each
+// of them is done. The work of the items is assumed to be shared among the
+// workers, each of which tries nonces at an equal part of the measured hash
+// rate.
+func (pm *PowManager) Status() (*Status, error) {
+	entries, err := pm.powQueue.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+
+	status := &Status{
+		HashRate: pm.hashRate,
+		Queue:    make([]*ItemStatus, len(entries)),
+	}
+
+	rate := pm.hashRate / float64(pm.workers)
+	finish := pm.schedule(entries)
+	for i, entry := range entries {
+		_, working := pm.working[entry.Index]
+		status.Queue[i] = &ItemStatus{
+			Index:    entry.Index,
+			User:     entry.User,
+			Priority: entry.Priority,
+			Target:   entry.Target,
+			Progress: entry.Progress,
+			Working:  working,
+		}
+
+		if rate > 0 {
+			status.Queue[i].ETA = finish[i] / rate
+		}
+	}
+
+	return status, nil
+}
+
+// Estimate returns the expected time until the pow of the item with the given
+// index is done. It returns false if the item is not in the queue or if the
+// hash rate has not yet been measured. The queue is only read again if it
+// has changed since the last estimate.
+func (pm *PowManager) Estimate(index uint64) (time.Duration, bool) {
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+
+	if pm.hashRate == 0 {
+		return 0, false
+	}
+
+	if pm.finish == nil {
+		entries, err := pm.powQueue.Entries()
+		if err != nil {
+			log.Errorf("Unable to read pow queue: %v", err)
+			return 0, false
+		}
+
+		pm.finish = make(map[uint64]float64)
+		for i, trials := range pm.schedule(entries) {
+			pm.finish[entries[i].Index] = trials
+		}
+	}
+
+	trials, ok := pm.finish[index]
+	if !ok {
+		return 0, false
+	}
+	rate := pm.hashRate / float64(pm.workers)
+	return time.Duration(trials / rate * float64(time.Second)), true
+}
+
+// saveProgress saves the progress of the calculation of the item with the
+// given index in the queue.
+func (pm *PowManager) saveProgress(index, next uint64) {
+	err := pm.powQueue.SetProgress(index, next)
+	if err != nil && err != store.ErrNotFound {
+		log.Errorf("Unable to save progress of pow #%d: %v", index, err)
+	}
+}
+
+// powHandler manages the proof-of-work queue. It makes sure that no more
+// than the allowed number of objects are processed at a time. After doing
+// POW, it returns the object to the server.
 func (pm *PowManager) powHandler(quit <-chan struct{}) error {
-	// If the PowHandler is awake, then it does not respond to signals
-	// from newPowChan and just keeps processing down the queue until the
-	// queue is empty. Then it goes to sleep.
-	awake := true
+	type result struct {
+		index uint64
+		nonce uint64
+		ok    bool
+	}
+
+	// Buffered so that calculations cancelled on quit can finish.
+	donePowChan := make(chan result, pm.workers)
 
-	donePowChan := make(chan uint64)
+	// calculatePow handles the pow calculation for a single object. It can
+	// be interrupted by Cancel or by an object of higher priority.
+	calculatePow := func(index, target uint64, hash []byte, start uint64, j *job) {
+		nonce, ok := pm.powFunc(target, hash, start, j.cancel, func(next uint64) {
+			pm.mtx.Lock()
+			defer pm.mtx.Unlock()
 
-	// calculatePow handles the pow calculation for a single object.
-	// Eventually, this might be upgraded so that it could be interrupted
-	// in the middle of a calculation.
-	calculatePow := func(target uint64, hash []byte) {
-		donePowChan <- pm.powFunc(target, hash)
+			if !j.report(next, time.Now()) {
+				return
+			}
+
+			// The total hash rate is the sum of that of every calculation.
+			pm.hashRate = 0
+			for _, w := range pm.working {
+				pm.hashRate += w.rate
+			}
+		})
+		donePowChan <- result{index, nonce, ok}
+	}
+
+	// finish removes an item from the set being worked on and saves its
+	// progress if its calculation was interrupted. It returns whether the
+	// item is still in the queue.
+	finish := func(r result) bool {
+		pm.mtx.Lock()
+		j := pm.working[r.index]
+		delete(pm.working, r.index)
+		pm.mtx.Unlock()
+
+		if j == nil || j.cancelled {
+			return false
+		}
+		if !r.ok {
+			pm.saveProgress(r.index, r.nonce)
+		}
+		return true
 	}
 
-	// startNewPow peeks for the latest information from the queue and begins
-	// processing it. It sets the queue asleep if none is found.
+	// startNewPow peeks for the next items in the queue which are not
+	// already being processed and begins processing them until every
+	// worker is busy or there is nothing left to do.
 	startNewPow := func() {
-		target, hash, err := pm.powQueue.PeekForPow()
-		if err != nil {
-			// The only allowed error is store.ErrNotFound, which means that
-			// there is nothing to process.
+		pm.mtx.Lock()
+		defer pm.mtx.Unlock()
+
+		for len(pm.working) < pm.workers {
+			index, priority, target, hash, err := pm.powQueue.PeekForPow(
+				func(index uint64) bool {
+					_, ok := pm.working[index]
+					return ok
+				})
+			if err == nil {
+				var start uint64
+				start, err = pm.powQueue.Progress(index)
+
+				// run POW for the object, continuing from where we left
+				// off if it was interrupted.
+				if err == nil {
+					j := &job{
+						priority: priority,
+						cancel:   make(chan struct{}),
+						next:     start,
+						saved:    start,
+						rateNext: start,
+						rateTime: time.Now(),
+					}
+					pm.working[index] = j
+					go calculatePow(index, target, hash, start, j)
+					continue
+				}
+			}
+
+			// The only allowed error is store.ErrNotFound, which means
+			// that there is nothing to process.
 			if err != store.ErrNotFound {
 				log.Criticalf("Peek on PowQueue failed: %v", err)
 			}
-
-			awake = false
 			return
 		}
+	}
+
+	// checkpoint saves the progress of the calculations in the queue.
+	checkpoint := func() {
+		pm.mtx.Lock()
+		defer pm.mtx.Unlock()
 
-		// run POW for the next object in the queue.
-		go calculatePow(target, hash)
+		for index, j := range pm.working {
+			if !j.cancelled && j.next > j.saved {
+				pm.saveProgress(index, j.next)
+				j.saved = j.next
+			}
+		}
 	}
 
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
 	startNewPow()
 
 out:
 	for {
 		select {
 		case <-quit:
+			// Stop the calculations and save how far they got.
+			pm.mtx.Lock()
+			running := len(pm.working)
+			for _, j := range pm.working {
+				j.stop()
+			}
+			pm.mtx.Unlock()
+
+			for ; running > 0; running-- {
+				// If the pow was found anyway, resume from the nonce
+				// that was found.
+				if r := <-donePowChan; finish(r) && r.ok {
+					pm.saveProgress(r.index, r.nonce)
+				}
+			}
 			break out
 		case <-pm.newPowChan:
-			// ignore if the pow handler is awake because it's already working.
-			if !awake {
-				awake = true
+			startNewPow()
+		case <-ticker.C:
+			checkpoint()
+		case r := <-donePowChan:
+			if !finish(r) || !r.ok {
 				startNewPow()
+				continue
 			}
-		case nonce := <-donePowChan:
+
 			// Since we have the required nonce value and have processed
-			// the pending message, remove it from the queue.
-			index, user, obj, err := pm.powQueue.Dequeue()
+			// the pending message, remove it from the queue. If it is not
+			// there, it was cancelled after the pow was found.
+			user, obj, err := pm.powQueue.Dequeue(r.index)
 			if err != nil {
-				log.Critical("Dequeue on PowQueue failed: ", err)
+				if err != store.ErrNotFound {
+					log.Critical("Dequeue on PowQueue failed: ", err)
+				}
+				startNewPow()
 				continue
 			}
+			pm.mtx.Lock()
+			pm.finish = nil
+			pm.mtx.Unlock()
 
 			// Re-assemble message as bytes.
 			nonceBytes := make([]byte, 8)
-			binary.BigEndian.PutUint64(nonceBytes, nonce)
+			binary.BigEndian.PutUint64(nonceBytes, r.nonce)
 			obj = append(nonceBytes, obj...)
 
 			// Send the data to the server.
-			pm.donePowFunc(index, user, obj)
+			pm.donePowFunc(r.index, user, obj)
 
 			startNewPow()
 		}
@@ -5,12 +5,17 @@
 package powmgr_test
 
 import (
+	"encoding/binary"
 	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/DanielKrawisz/bmagent/powmgr"
 	"github.com/DanielKrawisz/bmagent/store"
+	"github.com/DanielKrawisz/bmutil"
+	"github.com/DanielKrawisz/bmutil/wire"
 )
 
 // Test the pow handler that runs the pow calculations.
@@ -20,18 +25,28 @@ func TestPowHandler(t *testing.T) {
 	var powWait bool
 	var mutex sync.RWMutex
 	powChan := make(chan struct{})
+	powStarted := make(chan struct{})
 	donePowChan := make(chan struct{index uint64; user uint32})
 
+	var starts []uint64
+
 	// A function that does not actually calculate the pow.
-	mockPowFunc := func(target uint64, hash []byte) uint64 {
-		mutex.RLock()
+	mockPowFunc := func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		mutex.Lock()
 		pw := powWait
-		mutex.RUnlock()
+		starts = append(starts, start)
+		mutex.Unlock()
 		if pw {
-			<-powChan
-			return 1
+			powStarted <- struct{}{}
+			select {
+			case <-powChan:
+			case <-quit:
+				return start + 42, false
+			}
+			return 1, true
 		}
-		return 1
+		return 1, true
 	}
 
 	//A function that handles the completed pow.
@@ -48,7 +63,7 @@ func TestPowHandler(t *testing.T) {
 	f.Close()
 
 	l, err := store.Open(fName)
-	_, q, _, err := l.Construct("daniel", []byte("password"))
+	_, q, _, err := l.Construct([]byte("password"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,7 +76,7 @@ func TestPowHandler(t *testing.T) {
 	}
 
 	target := uint64(1152921504606846975)
-	pm := powmgr.New(q, mockPowDone, mockPowFunc)
+	pm := powmgr.New(q, mockPowDone, mockPowFunc, 1)
 
 	// Test that an item can be added to the queue and will be run
 	// once the queue handler is started.
@@ -100,6 +115,7 @@ func TestPowHandler(t *testing.T) {
 
 	pm.RunPow(target,  78, testObj[2])
 	pm.RunPow(target, 999, testObj[3])
+	<-powStarted
 
 	mutex.Lock()
 	powWait = false
@@ -115,5 +131,322 @@ func TestPowHandler(t *testing.T) {
 		t.Error("Incorrect test index returned.")
 	}
 
+	// Test that an item can be cancelled while it is running.
+	mutex.Lock()
+	powWait = true
+	mutex.Unlock()
+
+	index, _ := pm.RunPow(target, 12, testObj[0])
+	<-powStarted
+	if err = pm.Cancel(index); err != nil {
+		t.Error("Unable to cancel pow: ", err)
+	}
+	if err = pm.Cancel(index); err != store.ErrNotFound {
+		t.Errorf("Expected %v got %v", store.ErrNotFound, err)
+	}
+
+	mutex.Lock()
+	powWait = false
+	mutex.Unlock()
+
+	pm.RunPow(target, 13, testObj[1])
+	test5 := <-donePowChan
+	if test5.index != index+1 || test5.user != 13 {
+		t.Errorf("Expected index %d from user %d, got %d from %d",
+			index+1, 13, test5.index, test5.user)
+	}
+
+	// Test that an item of higher priority interrupts the item being
+	// calculated, which is resumed afterwards.
+	mutex.Lock()
+	powWait = true
+	mutex.Unlock()
+
+	low, _ := pm.RunPow(target, 14, testObj[2])
+	<-powStarted
+
+	mutex.Lock()
+	powWait = false
+	starts = nil
+	mutex.Unlock()
+
+	getpubkey := make([]byte, 13)
+	binary.BigEndian.PutUint32(getpubkey[8:12], uint32(wire.ObjectTypeGetPubKey))
+	high, _ := pm.RunPow(target, 15, getpubkey)
+	test6 := <-donePowChan
+	test7 := <-donePowChan
+	if test6.index != high || test7.index != low {
+		t.Errorf("Expected indices %d, %d got %d, %d", high, low, test6.index, test7.index)
+	}
+
+	mutex.Lock()
+	if len(starts) != 2 || starts[0] != 0 || starts[1] != 42 {
+		t.Errorf("Expected calculations to start from 0 and 42, got %v", starts)
+	}
+	mutex.Unlock()
+
 	pm.Stop()
 }
+
+// Test that several objects are processed at once by a pool of workers.
+func TestPowPool(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	s, q, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Each calculation waits to be released and returns the first byte
+	// of the hash as its nonce.
+	started := make(chan struct{})
+	release := make(map[byte]chan struct{})
+	var mutex sync.Mutex
+	mockPowFunc := func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		mutex.Lock()
+		r, ok := release[hash[0]]
+		if !ok {
+			r = make(chan struct{})
+			release[hash[0]] = r
+		}
+		mutex.Unlock()
+
+		started <- struct{}{}
+		select {
+		case <-r:
+			return uint64(hash[0]), true
+		case <-quit:
+			return start, false
+		}
+	}
+
+	type done struct {
+		index uint64
+		user  uint32
+		nonce byte
+	}
+	doneChan := make(chan done)
+	mockPowDone := func(index uint64, user uint32, obj []byte) {
+		doneChan <- done{index, user, obj[7]}
+	}
+
+	pm := powmgr.New(q, mockPowDone, mockPowFunc, 3)
+	pm.Start()
+	defer pm.Stop()
+
+	users := make(map[uint64]uint32)
+	hashes := make(map[uint64]byte)
+	for i := uint32(0); i < 3; i++ {
+		obj := []byte{byte(i)}
+		index, err := pm.RunPow(1, 20+i, obj)
+		if err != nil {
+			t.Fatal("Unable to submit to pow queue: ", err)
+		}
+		users[index] = 20 + i
+		hashes[index] = bmutil.Sha512(obj)[0]
+	}
+
+	// All three calculations should be running at once.
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+
+	// Finish them in the reverse order.
+	for index := uint64(3); index > 0; index-- {
+		mutex.Lock()
+		close(release[hashes[index]])
+		mutex.Unlock()
+
+		d := <-doneChan
+		if d.index != index || d.user != users[index] || d.nonce != hashes[index] {
+			t.Errorf("Expected index %d from user %d with nonce %d, got %d from %d with %d",
+				index, users[index], hashes[index], d.index, d.user, d.nonce)
+		}
+	}
+}
+
+// Test that the progress of a calculation is kept when the PowManager is
+// stopped and resumed when it is started again.
+func TestPowCheckpoint(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	s, q, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The calculation reports some progress and then waits to be stopped.
+	starts := make(chan uint64)
+	mockPowFunc := func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		starts <- start
+		progress(start + 10)
+		<-quit
+		return start + 20, false
+	}
+
+	pm := powmgr.New(q, func(uint64, uint32, []byte) {}, mockPowFunc, 1)
+	index, err := pm.RunPow(1, 1, []byte("test"))
+	if err != nil {
+		t.Fatal("Unable to submit to pow queue: ", err)
+	}
+
+	for _, expected := range []uint64{0, 20, 40} {
+		pm.Start()
+		if start := <-starts; start != expected {
+			t.Errorf("Expected calculation to start from %d, got %d", expected, start)
+		}
+		pm.Stop()
+
+		if next, err := q.Progress(index); err != nil || next != expected+20 {
+			t.Errorf("Expected progress %d, got %d, %v", expected+20, next, err)
+		}
+	}
+}
+
+// Test that the hash rate is measured and used to estimate when the items
+// in the queue will be done.
+func TestPowStatus(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	s, q, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The calculation tries a million nonces a second until it is stopped.
+	reported := make(chan struct{})
+	mockPowFunc := func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		time.Sleep(1100 * time.Millisecond)
+		progress(start + 1100000)
+		reported <- struct{}{}
+		<-quit
+		return start, false
+	}
+
+	pm := powmgr.New(q, func(uint64, uint32, []byte) {}, mockPowFunc, 1)
+	if pm.HashRate() != 0 {
+		t.Errorf("Expected no hash rate, got %f", pm.HashRate())
+	}
+
+	// Two items which are expected to take 2^64 / 2^44 = 2^20 nonces each.
+	first, _ := pm.RunPow(1<<44-1, 1, []byte("first"))
+	second, _ := pm.RunPow(1<<44-1, 1, []byte("second"))
+	if _, ok := pm.Estimate(first); ok {
+		t.Error("Estimate returned without a hash rate.")
+	}
+
+	pm.Start()
+	defer pm.Stop()
+	<-reported
+
+	rate := pm.HashRate()
+	if rate < 900000 || rate > 1100000 {
+		t.Errorf("Expected a hash rate of about 1000000, got %f", rate)
+	}
+
+	status, err := pm.Status()
+	if err != nil {
+		t.Fatal("Status failed: ", err)
+	}
+	if len(status.Queue) != 2 || status.Queue[0].Index != first ||
+		!status.Queue[0].Working || status.Queue[1].Working {
+		t.Fatalf("Wrong queue: %v", status.Queue)
+	}
+	if status.Queue[1].ETA <= status.Queue[0].ETA {
+		t.Errorf("Second item expected before the first: %f, %f",
+			status.Queue[1].ETA, status.Queue[0].ETA)
+	}
+
+	eta, ok := pm.Estimate(second)
+	expected := time.Duration(float64(2<<20) / rate * float64(time.Second))
+	if !ok || eta != expected {
+		t.Errorf("Expected estimate %s, got %s, %v", expected, eta, ok)
+	}
+}
+
+// Test that the work of the items in the queue is expected to be shared
+// among the workers.
+func TestPowEstimateWorkers(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	s, q, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Each calculation tries a million nonces a second until it is stopped.
+	reported := make(chan struct{})
+	mockPowFunc := func(target uint64, hash []byte, start uint64, quit <-chan struct{},
+		progress func(uint64)) (uint64, bool) {
+		time.Sleep(1100 * time.Millisecond)
+		progress(start + 1100000)
+		reported <- struct{}{}
+		<-quit
+		return start, false
+	}
+
+	pm := powmgr.New(q, func(uint64, uint32, []byte) {}, mockPowFunc, 2)
+
+	// Three items which are expected to take 2^20 nonces each.
+	first, _ := pm.RunPow(1<<44-1, 1, []byte("first"))
+	second, _ := pm.RunPow(1<<44-1, 1, []byte("second"))
+	third, _ := pm.RunPow(1<<44-1, 1, []byte("third"))
+
+	pm.Start()
+	defer pm.Stop()
+	<-reported
+	<-reported
+
+	// The first two items are done at once and the third after them.
+	rate := pm.HashRate() / 2
+	tests := []struct {
+		index  uint64
+		trials float64
+	}{
+		{first, 1 << 20},
+		{second, 1 << 20},
+		{third, 2 << 20},
+	}
+	for i, test := range tests {
+		eta, ok := pm.Estimate(test.index)
+		expected := time.Duration(test.trials / rate * float64(time.Second))
+		if !ok || eta != expected {
+			t.Errorf("%d: expected estimate %s, got %s, %v", i, expected, eta, ok)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/DanielKrawisz/bmagent/keymgr"
+)
+
+// rpcServer provides a JSON API over HTTP for managing bmagent.
+type rpcServer struct {
+	server    *server
+	listeners []net.Listener
+	mux       *http.ServeMux
+}
+
+// newRPCServer creates an rpcServer listening on the addresses given in
+// the config.
+func newRPCServer(s *server) (*rpcServer, error) {
+	r := &rpcServer{
+		server:    s,
+		listeners: make([]net.Listener, 0, len(cfg.RPCListeners)),
+		mux:       http.NewServeMux(),
+	}
+
+	r.mux.HandleFunc("/pow", r.handlePow)
+	r.mux.HandleFunc("/identities", r.handleIdentities)
+
+	var tlsConfig *tls.Config
+	if !cfg.DisableServerTLS {
+		var err error
+		tlsConfig, err = serverTLSConfig()
+		if err != nil {
+			return nil, rpcsLog.Criticalf("Failed to load TLS certificate: %v", err)
+		}
+	}
+
+	for _, laddr := range cfg.RPCListeners {
+		l, err := net.Listen("tcp", laddr)
+		if err != nil {
+			r.Stop()
+			return nil, rpcsLog.Criticalf("Failed to listen on %s: %v", laddr, err)
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		r.listeners = append(r.listeners, l)
+	}
+
+	return r, nil
+}
+
+// serverTLSConfig returns the TLS configuration for the servers, using the
+// certificate and key given in the config. They are generated if neither
+// exists.
+func serverTLSConfig() (*tls.Config, error) {
+	if !fileExists(cfg.TLSCert) && !fileExists(cfg.TLSKey) {
+		if err := genCertPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+			return nil, err
+		}
+	}
+
+	keypair, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{keypair},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// genCertPair generates a key/cert pair to the paths provided.
+func genCertPair(certFile, keyFile string) error {
+	rpcsLog.Infof("Generating TLS certificates...")
+
+	org := "bmagent autogenerated cert"
+	validUntil := time.Now().Add(10 * 365 * 24 * time.Hour)
+	cert, key, err := btcutil.NewTLSCertPair(org, validUntil, nil)
+	if err != nil {
+		return err
+	}
+
+	// Write cert and key files.
+	if err = ioutil.WriteFile(certFile, cert, 0666); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		os.Remove(certFile)
+		return err
+	}
+
+	rpcsLog.Infof("Done generating TLS certificates")
+	return nil
+}
+
+// Start begins serving requests.
+func (r *rpcServer) Start() {
+	for _, l := range r.listeners {
+		rpcsLog.Infof("Listening on %s", l.Addr())
+		go func(l net.Listener) {
+			err := http.Serve(l, r)
+			rpcsLog.Debugf("Stopped listening on %s: %v", l.Addr(), err)
+		}(l)
+	}
+}
+
+// Stop closes all the listeners.
+func (r *rpcServer) Stop() {
+	for _, l := range r.listeners {
+		l.Close()
+	}
+}
+
+// ServeHTTP checks that requests are authorized before handling them.
+func (r *rpcServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if cfg.Username != "" {
+		username, password, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(cfg.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bmagent"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	r.mux.ServeHTTP(w, req)
+}
+
+// writeJSON writes a response encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		rpcsLog.Errorf("Unable to write response: %v", err)
+	}
+}
+
+// handlePow returns the hash rate and the items in the pow queue with the
+// expected time until each is done.
+func (r *rpcServer) handlePow(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := r.server.powManager.Status()
+	if err != nil {
+		rpcsLog.Errorf("Unable to read pow queue: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, status)
+}
+
+// identityStatus describes one of the user's identities.
+type identityStatus struct {
+	Address  string `json:"address"`
+	Name     string `json:"name"`
+	Chan     bool   `json:"chan"`
+	Imported bool   `json:"imported"`
+	Disabled bool   `json:"disabled"`
+	Retired  bool   `json:"retired"`
+}
+
+// handleIdentities returns the user's identities on GET. On POST, it
+// disables, enables, removes or retires the identity given by the address
+// form value, according to the action form value. The change takes effect
+// immediately.
+func (r *rpcServer) handleIdentities(w http.ResponseWriter, req *http.Request) {
+	// TODO allow for more than one user. Right now there is just 1 user.
+	keys := r.server.users[1].Keys
+
+	switch req.Method {
+	case "GET":
+		ids := make([]identityStatus, 0, keys.Size())
+		keys.ForEach(func(id *keymgr.PrivateID) error {
+			ids = append(ids, identityStatus{
+				Address:  id.Address(),
+				Name:     id.Name,
+				Chan:     id.IsChan,
+				Imported: id.Imported,
+				Disabled: id.Disabled,
+				Retired:  id.Retired,
+			})
+			return nil
+		})
+		writeJSON(w, ids)
+
+	case "POST":
+		var f func(string) error
+		switch req.FormValue("action") {
+		case "disable":
+			f = keys.DisableIdentity
+		case "enable":
+			f = keys.EnableIdentity
+		case "remove":
+			f = keys.RemoveImported
+		case "retire":
+			f = keys.RetireIdentity
+		default:
+			http.Error(w, "Action must be disable, enable, remove or retire",
+				http.StatusBadRequest)
+			return
+		}
+
+		address := req.FormValue("address")
+		switch err := f(address); err {
+		case nil:
+			rpcsLog.Infof("Identity %s: %s", address, req.FormValue("action"))
+			w.WriteHeader(http.StatusNoContent)
+		case keymgr.ErrNonexistentIdentity:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusConflict)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
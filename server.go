@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"github.com/jordwest/imap-server"
+	"github.com/DanielKrawisz/bmagent/carddav"
 	"github.com/DanielKrawisz/bmagent/email"
 	"github.com/DanielKrawisz/bmagent/keymgr"
 	"github.com/DanielKrawisz/bmagent/powmgr"
@@ -41,6 +43,14 @@ const (
 	// saveInterval is the interval after which data in memory should be saved
 	// to disk.
 	saveInterval = time.Minute * 5
+
+	// pubkeyCheckInterval is the interval after which bmclient should check
+	// whether the public keys of any of our identities need to be published.
+	pubkeyCheckInterval = time.Hour
+
+	// pubkeyRepublishMargin is how long before our public keys expire that
+	// they are published again.
+	pubkeyRepublishMargin = time.Hour * 24
 )
 
 // server struct manages everything that a running instance of bmclient
@@ -61,6 +71,9 @@ type server struct {
 	imap             *imap.Server
 	imapUser         map[uint32]*email.User
 	imapListeners    []net.Listener
+	carddav          *carddav.Server
+	carddavListeners []net.Listener
+	rpcServer        *rpcServer
 	quit             chan struct{}
 	wg               sync.WaitGroup
 }
@@ -111,6 +124,11 @@ func newServer(rpcc *rpc.ClientConfig, user *User, s *store.Store,
 	}
 	srvr.imapUser[1] = imapUser
 
+	// Publish the public keys of new and re-enabled identities.
+	user.Keys.AddListener(func(address string) {
+		srvr.publishIfNeeded(1, address)
+	})
+
 	// Setup SMTP and IMAP servers.
 	srvr.smtp = email.NewSMTPServer(&email.SMTPConfig{
 		RequireTLS: !cfg.DisableServerTLS,
@@ -144,6 +162,29 @@ func newServer(rpcc *rpc.ClientConfig, user *User, s *store.Store,
 		srvr.smtpListeners = append(srvr.smtpListeners, l)
 	}
 
+	// Setup CardDAV server for the address book.
+	srvr.carddav = carddav.NewServer(&carddav.Config{
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}, userData.Contacts)
+	var davTLS *tls.Config
+	if len(cfg.CardDAVListeners) > 0 && !cfg.DisableServerTLS {
+		davTLS, err = serverTLSConfig()
+		if err != nil {
+			return nil, davLog.Criticalf("Failed to load TLS certificate: %v", err)
+		}
+	}
+	for _, laddr := range cfg.CardDAVListeners {
+		l, err := net.Listen("tcp", laddr)
+		if err != nil {
+			return nil, davLog.Criticalf("Failed to listen on %s: %v", laddr, err)
+		}
+		if davTLS != nil {
+			l = tls.NewListener(l, davTLS)
+		}
+		srvr.carddavListeners = append(srvr.carddavListeners, l)
+	}
+
 	// Load counter values from store.
 	srvr.msgCounter, err = s.GetCounter(wire.ObjectTypeMsg)
 	if err != nil {
@@ -161,7 +202,15 @@ func newServer(rpcc *rpc.ClientConfig, user *User, s *store.Store,
 	}
 
 	// Setup pow manager.
-	srvr.powManager = powmgr.New(q, srvr.receiveDonePow, cfg.powHandler)
+	srvr.powManager = powmgr.New(q, srvr.receiveDonePow, cfg.powHandler, cfg.powWorkers)
+
+	// Setup RPC server.
+	if cfg.EnableRPC {
+		srvr.rpcServer, err = newRPCServer(srvr)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return srvr, nil
 }
@@ -189,7 +238,16 @@ func (s *server) Start() {
 		go s.smtp.Serve(l)
 	}
 
-	// TODO Start RPC server.
+	// Start CardDAV server.
+	for _, l := range s.carddavListeners {
+		davLog.Infof("Listening on %s", l.Addr())
+		go s.carddav.Serve(l)
+	}
+
+	// Start RPC server.
+	if s.rpcServer != nil {
+		s.rpcServer.Start()
+	}
 
 	// Start public key request handler.
 	serverLog.Info("Starting public key request handler.")
@@ -200,6 +258,11 @@ func (s *server) Start() {
 	serverLog.Info("Starting proof-of-work manager.")
 	s.powManager.Start()
 
+	// Start public key publisher.
+	serverLog.Info("Starting public key publisher.")
+	s.wg.Add(1)
+	go s.pubkeyPublisher()
+
 	// Start saving data periodically.
 	s.wg.Add(1)
 	go s.savePeriodically()
@@ -229,15 +292,23 @@ func (s *server) newMessage(counter uint64, obj []byte) {
 	var address string
 	// Whether the message was received from a channel.
 	var ofChan bool
+	// The proof-of-work demanded by the identity.
+	var nonceTrials, extraBytes uint64
 	
 	var id uint32
 
-	// Try decrypting with all available identities.
+	// Try decrypting with all available identities. Disabled identities
+	// no longer receive messages.
 	for uid, user := range s.users {
 		err = user.Keys.ForEach(func(id *keymgr.PrivateID) error {
+			if id.Disabled {
+				return nil
+			}
 			if cipher.TryDecryptAndVerifyMsg(msg, &id.Private) == nil {
 				address = id.Address()
 				ofChan = id.IsChan
+				nonceTrials = id.NonceTrialsPerByte
+				extraBytes = id.ExtraBytes
 				return errors.New("decryption successful")
 			}
 			return nil
@@ -257,14 +328,42 @@ func (s *server) newMessage(counter uint64, obj []byte) {
 
 	// Decryption was successful. Add message to store.
 
-	// TODO Store public key of the sender in bmagent
-
 	// Read message.
 	bmsg, err := email.MsgRead(msg, address, ofChan)
 	if err != nil {
 		log.Errorf("Failed to decode message #%d: %v", counter, err)
 		return
 	}
+
+	// Check that the message has the proof-of-work that our identity
+	// demands, unless the sender is in the address book. bmd has already
+	// checked it against the network minimum.
+	if !s.sufficientPow(id, obj, msg, nonceTrials, extraBytes) {
+		serverLog.Infof("Ignoring message #%d to %s, which has insufficient proof-of-work.",
+			counter, address)
+		return
+	}
+
+	// Messages from blocked senders are dropped or put in the Junk folder,
+	// and are not acknowledged either way.
+	if blocked, action := s.senderBlocked(id, msg); blocked {
+		if action == store.DropBlocked {
+			serverLog.Infof("Dropping message #%d to %s from blocked sender %s.",
+				counter, address, bmsg.From)
+			return
+		}
+		
+		serverLog.Infof("Filing message #%d to %s from blocked sender %s as junk.",
+			counter, address, bmsg.From)
+		err = s.imapUser[id].DeliverJunk(bmsg)
+		if err != nil {
+			log.Errorf("Failed to save message #%d: %v", counter, err)
+		}
+		return
+	}
+
+	// Save the public key of the sender.
+	s.saveSender(id, senderIdentity(msg))
 	
 	rpccLog.Trace("Bitmessage received from " + bmsg.From + " to " + bmsg.To)
 
@@ -274,6 +373,12 @@ func (s *server) newMessage(counter uint64, obj []byte) {
 		return
 	}
 
+	// Answer the message if our identity has an automatic reply. Chans
+	// never answer automatically.
+	if !ofChan {
+		s.autoReply(id, address, msg, bmsg)
+	}
+
 	// Check if length of Ack is correct and message isn't from a channel.
 	if len(msg.Ack) < wire.MessageHeaderSize || ofChan {
 		return
@@ -293,6 +398,132 @@ func (s *server) newMessage(counter uint64, obj []byte) {
 
 }
 
+// sufficientPow returns whether a message which was decrypted by one of our
+// identities has the proof-of-work that the identity demands. Messages from
+// senders in the user's address book are always accepted.
+func (s *server) sufficientPow(uid uint32, obj []byte, msg *wire.MsgMsg,
+	nonceTrials, extraBytes uint64) bool {
+
+	if nonceTrials <= pow.DefaultNonceTrialsPerByte &&
+		extraBytes <= pow.DefaultExtraBytes {
+		return true
+	}
+
+	from, err := senderIdentity(msg).Address.Encode()
+	if err != nil {
+		return false
+	}
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return false
+	}
+	if _, err := userData.Contacts.Label(from); err == nil {
+		return true
+	}
+
+	if nonceTrials < pow.DefaultNonceTrialsPerByte {
+		nonceTrials = pow.DefaultNonceTrialsPerByte
+	}
+	if extraBytes < pow.DefaultExtraBytes {
+		extraBytes = pow.DefaultExtraBytes
+	}
+	return powmgr.CheckObject(obj, nonceTrials, extraBytes, time.Now())
+}
+
+// autoReply sends the automatic reply of the identity which received a
+// message, if it has one which is active and the sender has not already been
+// answered within its window. Messages which are automatic replies
+// themselves are not answered, so that auto-responders do not answer each
+// other forever.
+func (s *server) autoReply(uid uint32, address string, msg *wire.MsgMsg,
+	bmsg *email.Bitmessage) {
+
+	if email.IsAutoReply(bmsg) {
+		return
+	}
+
+	from, err := senderIdentity(msg).Address.Encode()
+	if err != nil {
+		return
+	}
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return
+	}
+
+	reply, err := userData.AutoReplies.Reply(address, from, time.Now())
+	if err != nil {
+		serverLog.Errorf("Failed to read automatic reply of %s: %v", address, err)
+		return
+	}
+	if reply == nil {
+		return
+	}
+
+	serverLog.Infof("Sending automatic reply from %s to %s.", address, from)
+	err = s.imapUser[uid].SendAutoReply(bmsg, reply.Subject, reply.Body)
+	if err != nil {
+		serverLog.Errorf("Failed to send automatic reply from %s: %v", address, err)
+	}
+}
+
+// senderBlocked returns whether the sender of a message which was decrypted
+// by one of the user's identities is blocked by the user's blacklist or
+// whitelist, and what should be done with the message if so.
+func (s *server) senderBlocked(uid uint32, msg *wire.MsgMsg) (bool, store.FilterAction) {
+	from, err := senderIdentity(msg).Address.Encode()
+	if err != nil {
+		return false, store.DropBlocked
+	}
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return false, store.DropBlocked
+	}
+
+	filter := userData.SenderFilter
+	blocked, err := filter.Blocked(from)
+	if err != nil {
+		serverLog.Errorf("Failed to read sender filter: %v", err)
+		return false, store.DropBlocked
+	}
+	if !blocked {
+		return false, store.DropBlocked
+	}
+
+	action, err := filter.Action()
+	if err != nil {
+		serverLog.Errorf("Failed to read sender filter: %v", err)
+	}
+	return true, action
+}
+
+// senderIdentity returns the public identity of the sender of a decrypted
+// message.
+func senderIdentity(msg *wire.MsgMsg) *identity.Public {
+	sign, _ := msg.SigningKey.ToBtcec()
+	encr, _ := msg.EncryptionKey.ToBtcec()
+	return identity.NewPublic(sign, encr, msg.NonceTrials,
+		msg.ExtraBytes, msg.FromAddressVersion, msg.FromStreamNumber)
+}
+
+// saveSender saves the public key of the sender of a message in the user's
+// contacts, so that it need not be requested if the user replies.
+func (s *server) saveSender(uid uint32, from *identity.Public) {
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return
+	}
+
+	err = savePublicID(userData.Contacts, from, time.Now())
+	if err != nil {
+		serverLog.Errorf("Failed to save public key of sender: %v", err)
+	}
+}
+
 // newBroadcast is called when a new broadcast is received by the RPC client.
 // Broadcasts are guaranteed to be received in ascending order of counter value.
 func (s *server) newBroadcast(counter uint64, obj []byte) {
@@ -314,8 +545,10 @@ func (s *server) newBroadcast(counter uint64, obj []byte) {
 	}
 
 	var fromAddress string
+	var userData *store.UserData
 
 	for _, user := range s.store.Users {
+		userData = user
 
 		err = user.BroadcastAddresses.ForEach(func(addr *bmutil.Address) error {
 			if cipher.TryDecryptAndVerifyBroadcast(msg, addr) == nil {
@@ -324,11 +557,14 @@ func (s *server) newBroadcast(counter uint64, obj []byte) {
 			}
 			return nil
 		})
-		if err == nil { // Broadcast decryption failed.
-			return
+		if err != nil { // Broadcast decryption succeeded.
+			break
 		}
 		
 	} 
+	if fromAddress == "" { // Broadcast decryption failed.
+		return
+	}
 	
 	// Read message.
 	bmsg, err := email.BroadcastRead(msg)
@@ -339,7 +575,17 @@ func (s *server) newBroadcast(counter uint64, obj []byte) {
 	
 	rpccLog.Trace("Bitmessage broadcast received from " + bmsg.From + " to " + bmsg.To)
 
-	err = s.imapUser[1].DeliverFromBMNet(bmsg)
+	// Save the public key of the sender.
+	sign, _ := msg.SigningKey.ToBtcec()
+	encr, _ := msg.EncryptionKey.ToBtcec()
+	err = savePublicID(userData.Contacts, identity.NewPublic(sign, encr,
+		msg.NonceTrials, msg.ExtraBytes, msg.FromAddressVersion,
+		msg.FromStreamNumber), time.Now())
+	if err != nil {
+		serverLog.Errorf("Failed to save public key of %s: %v", fromAddress, err)
+	}
+
+	err = s.imapUser[1].DeliverBroadcast(fromAddress, bmsg)
 	if err != nil {
 		log.Errorf("Failed to save message #%d: %v", counter, err)
 		return
@@ -394,8 +640,39 @@ func (s *server) newGetpubkey(counter uint64, obj []byte) {
 		return
 	}
 
+	// Ignore the request if a pubkey is already waiting for its pow.
+	if s.pubkeyQueued(id, privID) {
+		serverLog.Debugf("Ignoring getpubkey request for %s, which is queued for publication.",
+			privID.Address())
+		return
+	}
+
+	// Ignore the request if we sent the pubkey recently and it is still
+	// valid.
+	published, expires, ok := s.lastPublication(id, privID)
+	if ok && time.Now().Before(expires) &&
+		time.Now().Before(published.Add(cfg.GetpubkeyInterval)) {
+		serverLog.Debugf("Ignoring getpubkey request for %s, which was published at %s.",
+			privID.Address(), published)
+		return
+	}
+
+	serverLog.Infof("Received a getpubkey request for %s, sending out the pubkey.",
+		privID.Address())
+	s.publishPubkey(id, privID)
+}
+
+// publishPubkey generates a pubkey message for one of our identities and adds
+// it to the proof-of-work queue. The publication is recorded once the pubkey
+// has been sent.
+func (s *server) publishPubkey(uid uint32, privID *keymgr.PrivateID) {
 	addr := privID.Address()
-	serverLog.Infof("Received a getpubkey request for %s, sending out the pubkey.", addr)
+
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data for %s: %v", addr, err)
+		return
+	}
 
 	// Generate a pubkey message.
 	pkMsg, err := cipher.GeneratePubKey(&privID.Private, defaultPubkeyExpiry)
@@ -410,11 +687,115 @@ func (s *server) newGetpubkey(counter uint64, obj []byte) {
 		uint64(pkMsg.ExpiresTime.Sub(time.Now()).Seconds()),
 		pow.DefaultNonceTrialsPerByte, pow.DefaultExtraBytes)
 
-	_, err = s.powManager.RunPow(target, id, b)
+	// The pubkey is queued before the pow is requested because the pow 
+	// may be done before RunPow returns.
+	userData.Publications.Queue(addr, b, pkMsg.ExpiresTime)
+	_, err = s.powManager.RunPow(target, uid, b)
 	if err != nil {
+		userData.Publications.Unqueue(b)
 		serverLog.Critical("Failed to enqueue pow request:", err)
+	}
+}
+
+// lastPublication returns the time that the public key of the given identity
+// was last published and the time that it expires. ok is false if it has
+// never been published.
+func (s *server) lastPublication(uid uint32, privID *keymgr.PrivateID) (
+	published, expires time.Time, ok bool) {
+
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return time.Time{}, time.Time{}, false
+	}
+
+	published, expires, err = userData.Publications.LastPublished(privID.Address())
+	if err != nil {
+		if err != store.ErrNotFound {
+			serverLog.Errorf("Failed to get publication time of pubkey for %s: %v",
+				privID.Address(), err)
+		}
+		return time.Time{}, time.Time{}, false
+	}
+
+	return published, expires, true
+}
+
+// needsPublication returns whether the public key of the given identity has
+// never been published or is about to expire.
+func (s *server) needsPublication(uid uint32, privID *keymgr.PrivateID) bool {
+	if privID.Disabled || privID.IsChan { // We don't publish these.
+		return false
+	}
+
+	if s.pubkeyQueued(uid, privID) {
+		return false
+	}
+
+	_, expires, ok := s.lastPublication(uid, privID)
+	return !ok || time.Now().After(expires.Add(-pubkeyRepublishMargin))
+}
+
+// pubkeyQueued returns whether a pubkey for the given identity is waiting
+// for its proof-of-work to be done.
+func (s *server) pubkeyQueued(uid uint32, privID *keymgr.PrivateID) bool {
+	userData, err := s.store.GetUser(s.users[uid].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return false
+	}
+
+	return userData.Publications.IsQueued(privID.Address())
+}
+
+// publishIfNeeded publishes the public key of an identity if it has never
+// been published or is about to expire. It is called whenever an identity is
+// added to a user's key manager.
+func (s *server) publishIfNeeded(uid uint32, address string) {
+	privID := s.users[uid].Keys.LookupByAddress(address)
+	if privID == nil || !s.needsPublication(uid, privID) {
 		return
 	}
+
+	serverLog.Infof("Publishing the pubkey for %s.", address)
+	s.publishPubkey(uid, privID)
+}
+
+// pubkeyPublisher periodically publishes the public keys of our identities
+// that have never been published or that are about to expire.
+func (s *server) pubkeyPublisher() {
+	defer s.wg.Done()
+
+	s.publishPubkeys()
+
+	t := time.NewTicker(pubkeyCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+			s.publishPubkeys()
+		}
+	}
+}
+
+// publishPubkeys publishes the public keys of all identities which need it.
+func (s *server) publishPubkeys() {
+	for uid, user := range s.users {
+		var ids []*keymgr.PrivateID
+		user.Keys.ForEach(func(privID *keymgr.PrivateID) error {
+			if s.needsPublication(uid, privID) {
+				ids = append(ids, privID)
+			}
+			return nil
+		})
+
+		for _, privID := range ids {
+			serverLog.Infof("Publishing the pubkey for %s.", privID.Address())
+			s.publishPubkey(uid, privID)
+		}
+	}
 }
 
 // pkRequestHandler manages the pubkey request store. It periodically checks
@@ -508,6 +889,9 @@ func (s *server) receiveDonePow(index uint64, user uint32, obj []byte) {
 
 	// Send the object out on the network.
 	_, err = s.bmd.SendObject(obj)
+	if msg.ObjectType == wire.ObjectTypePubKey {
+		s.pubkeySent(user, obj[8:], err == nil)
+	}
 	if err != nil {
 		serverLog.Error("Failed to send object:", err)
 		return
@@ -524,6 +908,33 @@ func (s *server) receiveDonePow(index uint64, user uint32, obj []byte) {
 	}
 }
 
+// pubkeySent records the publication of a pubkey object, without its nonce,
+// once it has been sent. If it could not be sent, it is no longer considered
+// queued so that it is published again.
+func (s *server) pubkeySent(user uint32, obj []byte, sent bool) {
+	userData, err := s.store.GetUser(s.users[user].Username)
+	if err != nil {
+		serverLog.Errorf("Failed to get user data: %v", err)
+		return
+	}
+
+	if !sent {
+		userData.Publications.Unqueue(obj)
+		return
+	}
+
+	addr, err := userData.Publications.Sent(obj, time.Now())
+	if err == store.ErrNotFound {
+		// The pubkey was queued before bmclient was restarted. 
+		serverLog.Debug("Sent a pubkey which was not queued for publication.")
+		return
+	}
+	if err != nil {
+		serverLog.Errorf("Failed to record publication of pubkey for %s: %v",
+			addr, err)
+	}
+}
+
 // savePeriodically periodically saves data in memory to the disk. This is to
 // ensure that everything isn't lost in case of power failure/sudden shutdown.
 func (s *server) savePeriodically() {
@@ -635,6 +1046,16 @@ func (s *server) Stop() {
 	}
 	s.imapUser = nil // Prevent pointer cycle.
 
+	// Close all CardDAV listeners.
+	for _, l := range s.carddavListeners {
+		l.Close()
+	}
+
+	// Close all RPC listeners.
+	if s.rpcServer != nil {
+		s.rpcServer.Stop()
+	}
+
 	s.bmd.Stop()
 	s.powManager.Stop()
 	close(s.quit)
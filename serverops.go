@@ -8,8 +8,10 @@ package main
 import (
 	"time"
 
+	"github.com/btcsuite/btcd/btcec"
 	"github.com/DanielKrawisz/bmagent/keymgr"
 	"github.com/DanielKrawisz/bmagent/store"
+	"github.com/DanielKrawisz/bmutil"
 	"github.com/DanielKrawisz/bmutil/identity"
 	"github.com/DanielKrawisz/bmutil/wire"
 )
@@ -42,6 +44,20 @@ func (s *serverOps) GetOrRequestPublicID(addr string) (*identity.Public, error)
 		return private.ToPublic(), nil
 	}
 
+	// Check the public keys saved in the user's contacts.
+	contact, err := s.data.Contacts.Get(addr)
+	if err == nil {
+		pubID, err := contactPublicID(addr, contact)
+		if err != nil {
+			serverLog.Errorf("Invalid public key saved for %s: %v", addr, err)
+		} else if pubID != nil {
+			s.pubIDs[addr] = pubID
+			return pubID, nil
+		}
+	} else if err != store.ErrNotFound {
+		return nil, err
+	}
+
 	pubID, err := s.server.getOrRequestPublicIdentity(s.id, addr)
 	if err != nil { // Some error occured.
 		return nil, err
@@ -50,16 +66,63 @@ func (s *serverOps) GetOrRequestPublicID(addr string) (*identity.Public, error)
 		return nil, nil
 	}
 
+	err = savePublicID(s.data.Contacts, pubID, time.Now())
+	if err != nil {
+		serverLog.Errorf("Failed to save public key for %s: %v", addr, err)
+	}
+
 	s.pubIDs[addr] = pubID
 	return pubID, nil
 }
 
+// contactPublicID returns the public identity of a contact, or nil if its
+// public key is not known.
+func contactPublicID(addr string, contact *store.Contact) (*identity.Public, error) {
+	if contact.SigningKey == nil || contact.EncryptionKey == nil {
+		return nil, nil
+	}
+
+	address, err := bmutil.DecodeAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := btcec.ParsePubKey(contact.SigningKey, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := btcec.ParsePubKey(contact.EncryptionKey, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+
+	return identity.NewPublic(signKey, encKey, contact.NonceTrialsPerByte,
+		contact.ExtraBytes, address.Version, address.Stream), nil
+}
+
+// savePublicID saves the public key of an identity, which was seen at the
+// given time, in the user's contacts.
+func savePublicID(contacts *store.Contacts, pubID *identity.Public, seen time.Time) error {
+	addr, err := pubID.Address.Encode()
+	if err != nil {
+		return err
+	}
+
+	return contacts.SetPublicKey(addr, pubID.SigningKey.SerializeUncompressed(),
+		pubID.EncryptionKey.SerializeUncompressed(), pubID.NonceTrialsPerByte,
+		pubID.ExtraBytes, seen)
+}
+
 // GetPrivateID queries the key manager for the right private key for the given
 // address.
 func (s *serverOps) GetPrivateID(addr string) *keymgr.PrivateID {
 	return s.user.Keys.LookupByAddress(addr)
 }
 
+// Names returns the names of the user's identities indexed by address.
+func (s *serverOps) Names() map[string]string {
+	return s.user.Keys.Names()
+}
+
 // GetObjectExpiry returns the time duration after which an object of the
 // given type will expire on the network. It's used for POW calculations.
 func (s *serverOps) GetObjectExpiry(objType wire.ObjectType) time.Duration {
@@ -82,7 +145,71 @@ func (s *serverOps) RunPow(target uint64, obj []byte) (uint64, error) {
 	return s.server.powManager.RunPow(target, s.id, obj)
 }
 
+// CancelPow removes an object from the pow queue.
+func (s *serverOps) CancelPow(index uint64) error {
+	return s.server.powManager.Cancel(index)
+}
+
+// PowEstimate returns the expected time until an object in the pow queue
+// is done.
+func (s *serverOps) PowEstimate(index uint64) (time.Duration, bool) {
+	return s.server.powManager.Estimate(index)
+}
+
 // Folders returns the set of folders for a given user.
 func (s *serverOps) Folders() []store.Folder {
 	return s.data.Folders()
 }
+
+// NewFolder creates a new folder for the user, or returns the existing
+// folder with the given name.
+func (s *serverOps) NewFolder(name string) (store.Folder, error) {
+	folder, err := s.data.FolderByName(name)
+	if err == nil {
+		return folder, nil
+	}
+	return s.data.NewFolder(name)
+}
+
+// RenameFolder changes the name of one of the user's folders.
+func (s *serverOps) RenameFolder(oldName, newName string) error {
+	return s.data.RenameFolder(oldName, newName)
+}
+
+// BroadcastAddresses returns the broadcast addresses that the user is
+// subscribed to.
+func (s *serverOps) BroadcastAddresses() *store.BroadcastAddresses {
+	return s.data.BroadcastAddresses
+}
+
+// Contacts returns the user's address book.
+func (s *serverOps) Contacts() *store.Contacts {
+	return s.data.Contacts
+}
+
+// SenderFilter returns the user's blacklist and whitelist.
+func (s *serverOps) SenderFilter() *store.SenderFilter {
+	return s.data.SenderFilter
+}
+
+// SieveScript returns the script which files the user's incoming messages.
+func (s *serverOps) SieveScript() *store.SieveScript {
+	return s.data.SieveScript
+}
+
+// AutoReplies returns the automatic replies of the user's identities.
+func (s *serverOps) AutoReplies() *store.AutoReplies {
+	return s.data.AutoReplies
+}
+
+// PublishPubkey queues the pubkey of one of the user's identities to be
+// published.
+func (s *serverOps) PublishPubkey(addr string) error {
+	private := s.GetPrivateID(addr)
+	if private == nil {
+		return keymgr.ErrNonexistentIdentity
+	}
+
+	s.server.publishPubkey(s.id, private)
+	return nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+/*
+Package sieve implements the subset of the Sieve mail filtering language
+(RFC 5228) which bmagent uses to file incoming messages.
+
+The supported control commands are require, if, elsif, else and stop. The
+supported actions are keep, discard, fileinto and addflag (RFC 5232). The
+supported tests are header, address, envelope, exists, allof, anyof, not,
+true and false, with the :is, :contains and :matches match types and the
+i;ascii-casemap and i;octet comparators.
+
+The envelope of a message is made of the Bitmessage addresses that it was
+sent from and to. For a message received by a chan, the envelope "to" address
+is the address of the chan.
+
+A script is parsed once with Parse and can then be run against any number of
+messages:
+
+	script, err := sieve.Parse(`require ["fileinto", "imap4flags"];
+	if address :is "from" "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq@bm.addr" {
+		addflag "\\Flagged";
+		fileinto "Friends";
+	}`)
+	result := script.Run(&sieve.Message{Header: header, From: from, To: to})
+*/
+package sieve
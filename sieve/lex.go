@@ -0,0 +1,258 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tokenType is the type of a lexical token.
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenTag
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+// token is a lexical token of a script.
+type token struct {
+	typ   tokenType
+	value string // The identifier, tag name, unescaped string or punctuation.
+	num   uint64
+	line  int
+}
+
+// String returns a description of the token for error messages.
+func (t token) String() string {
+	switch t.typ {
+	case tokenEOF:
+		return "end of script"
+	case tokenTag:
+		return ":" + t.value
+	case tokenString:
+		return strconv.Quote(t.value)
+	case tokenNumber:
+		return strconv.FormatUint(t.num, 10)
+	}
+	return t.value
+}
+
+// Error is returned when a script cannot be parsed.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+// Error returns the message of the error with its line number.
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// errorf creates an Error at the given line.
+func errorf(line int, format string, args ...interface{}) *Error {
+	return &Error{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// lexer splits a script into tokens.
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// skipSpace skips white space and comments.
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return errorf(l.line, "unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// next returns the next token.
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{typ: tokenEOF, line: l.line}, nil
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+	switch {
+	case isAlpha(c):
+		start := l.pos
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+
+		// A multi-line string begins with text:
+		if strings.ToLower(word) == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiline()
+			return token{typ: tokenString, value: s, line: line}, err
+		}
+		return token{typ: tokenIdentifier, value: strings.ToLower(word), line: line}, nil
+
+	case c == ':':
+		l.pos++
+		start := l.pos
+		for l.pos < len(l.src) && (isAlpha(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		if start == l.pos {
+			return token{}, errorf(line, "expected a tag after ':'")
+		}
+		return token{typ: tokenTag, value: strings.ToLower(l.src[start:l.pos]), line: line}, nil
+
+	case c == '"':
+		s, err := l.quoted()
+		return token{typ: tokenString, value: s, line: line}, err
+
+	case isDigit(c):
+		start := l.pos
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		n, err := strconv.ParseUint(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, errorf(line, "invalid number %s", l.src[start:l.pos])
+		}
+		if l.pos < len(l.src) {
+			switch l.src[l.pos] {
+			case 'K', 'k':
+				n <<= 10
+				l.pos++
+			case 'M', 'm':
+				n <<= 20
+				l.pos++
+			case 'G', 'g':
+				n <<= 30
+				l.pos++
+			}
+		}
+		return token{typ: tokenNumber, num: n, line: line}, nil
+
+	case strings.IndexByte(";,()[]{}", c) >= 0:
+		l.pos++
+		return token{typ: tokenPunct, value: string(c), line: line}, nil
+	}
+
+	return token{}, errorf(line, "unexpected character %q", c)
+}
+
+// quoted reads a quoted string. Only \" and \\ are escape sequences; a
+// backslash before any other character is dropped.
+func (l *lexer) quoted() (string, error) {
+	line := l.line
+	l.pos++ // Opening quote.
+
+	var b []byte
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		l.pos++
+		switch c {
+		case '"':
+			return string(b), nil
+		case '\\':
+			if l.pos < len(l.src) {
+				c = l.src[l.pos]
+				l.pos++
+			}
+		}
+		if c == '\n' {
+			l.line++
+		}
+		b = append(b, c)
+	}
+	return "", errorf(line, "unterminated string")
+}
+
+// multiline reads the rest of a multi-line string after text:, which ends
+// with a line containing a single dot. Lines beginning with two dots have
+// one of them removed.
+func (l *lexer) multiline() (string, error) {
+	line := l.line
+
+	// The rest of the line after text: may only hold white space or a
+	// comment.
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return "", errorf(line, "expected a new line after text:")
+	}
+	l.pos++
+	l.line++
+
+	var lines []string
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var text string
+		if end < 0 {
+			text = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			text = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+			l.line++
+		}
+		text = strings.TrimSuffix(text, "\r")
+
+		if text == "." {
+			if len(lines) == 0 {
+				return "", nil
+			}
+			return strings.Join(lines, "\r\n") + "\r\n", nil
+		}
+		if strings.HasPrefix(text, "..") {
+			text = text[1:]
+		}
+		lines = append(lines, text)
+	}
+	return "", errorf(line, "unterminated multi-line string")
+}
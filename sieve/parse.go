@@ -0,0 +1,263 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sieve
+
+// argument is an argument of a command or a test, which is either a tag,
+// a number, a string or a string list.
+type argument struct {
+	tag  string
+	num  *uint64
+	strs []string
+	line int
+}
+
+// String returns a description of the argument for error messages.
+func (a *argument) String() string {
+	switch {
+	case a.tag != "":
+		return ":" + a.tag
+	case a.num != nil:
+		return "number"
+	}
+	return "string"
+}
+
+// test is a test as it is written in a script.
+type test struct {
+	name  string
+	args  []*argument
+	tests []*test
+	line  int
+}
+
+// command is a command as it is written in a script.
+type command struct {
+	name     string
+	args     []*argument
+	tests    []*test
+	block    []*command
+	hasBlock bool
+	line     int
+}
+
+// parser builds the syntax tree of a script.
+type parser struct {
+	lex    *lexer
+	peeked *token
+}
+
+// peek returns the next token without consuming it.
+func (p *parser) peek() (token, error) {
+	if p.peeked == nil {
+		t, err := p.lex.next()
+		if err != nil {
+			return token{}, err
+		}
+		p.peeked = &t
+	}
+	return *p.peeked, nil
+}
+
+// next consumes the next token.
+func (p *parser) next() (token, error) {
+	t, err := p.peek()
+	p.peeked = nil
+	return t, err
+}
+
+// isPunct returns whether a token is the given punctuation.
+func isPunct(t token, c string) bool {
+	return t.typ == tokenPunct && t.value == c
+}
+
+// expect consumes the next token, which must be the given punctuation.
+func (p *parser) expect(c string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if !isPunct(t, c) {
+		return errorf(t.line, "expected '%s' but found %s", c, t)
+	}
+	return nil
+}
+
+// commands parses commands until the end of a block or of the script.
+func (p *parser) commands(inBlock bool) ([]*command, error) {
+	var cmds []*command
+	for {
+		t, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if t.typ == tokenEOF {
+			if inBlock {
+				return nil, errorf(t.line, "missing '}'")
+			}
+			return cmds, nil
+		}
+		if inBlock && isPunct(t, "}") {
+			p.next()
+			return cmds, nil
+		}
+
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// command parses a command, which ends either with a semicolon or a block.
+func (p *parser) command() (*command, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != tokenIdentifier {
+		return nil, errorf(t.line, "expected a command but found %s", t)
+	}
+
+	cmd := &command{name: t.value, line: t.line}
+	cmd.args, cmd.tests, err = p.arguments()
+	if err != nil {
+		return nil, err
+	}
+
+	t, err = p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case isPunct(t, ";"):
+	case isPunct(t, "{"):
+		cmd.hasBlock = true
+		cmd.block, err = p.commands(true)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errorf(t.line, "expected ';' or '{' after %s but found %s", cmd.name, t)
+	}
+	return cmd, nil
+}
+
+// arguments parses the arguments of a command or a test, which may be
+// followed by a test or a list of tests.
+func (p *parser) arguments() ([]*argument, []*test, error) {
+	var args []*argument
+	for {
+		t, err := p.peek()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case t.typ == tokenTag:
+			p.next()
+			args = append(args, &argument{tag: t.value, line: t.line})
+		case t.typ == tokenNumber:
+			p.next()
+			n := t.num
+			args = append(args, &argument{num: &n, line: t.line})
+		case t.typ == tokenString:
+			p.next()
+			args = append(args, &argument{strs: []string{t.value}, line: t.line})
+		case isPunct(t, "["):
+			p.next()
+			strs, err := p.stringList()
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, &argument{strs: strs, line: t.line})
+		case isPunct(t, "("):
+			p.next()
+			tests, err := p.testList()
+			return args, tests, err
+		case t.typ == tokenIdentifier:
+			tst, err := p.test()
+			if err != nil {
+				return nil, nil, err
+			}
+			return args, []*test{tst}, nil
+		default:
+			return args, nil, nil
+		}
+	}
+}
+
+// stringList parses the rest of a string list after its opening bracket.
+func (p *parser) stringList() ([]string, error) {
+	var strs []string
+	for {
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.typ != tokenString {
+			return nil, errorf(t.line, "expected a string but found %s", t)
+		}
+		strs = append(strs, t.value)
+
+		t, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		if isPunct(t, "]") {
+			return strs, nil
+		}
+		if !isPunct(t, ",") {
+			return nil, errorf(t.line, "expected ',' or ']' but found %s", t)
+		}
+	}
+}
+
+// testList parses the rest of a list of tests after its opening parenthesis.
+func (p *parser) testList() ([]*test, error) {
+	var tests []*test
+	for {
+		tst, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, tst)
+
+		t, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if isPunct(t, ")") {
+			return tests, nil
+		}
+		if !isPunct(t, ",") {
+			return nil, errorf(t.line, "expected ',' or ')' but found %s", t)
+		}
+	}
+}
+
+// test parses a test.
+func (p *parser) test() (*test, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.typ != tokenIdentifier {
+		return nil, errorf(t.line, "expected a test but found %s", t)
+	}
+
+	tst := &test{name: t.value, line: t.line}
+	tst.args, tst.tests, err = p.arguments()
+	if err != nil {
+		return nil, err
+	}
+	return tst, nil
+}
+
+// parse returns the syntax tree of a script.
+func parse(src string) ([]*command, error) {
+	p := &parser{lex: &lexer{src: src, line: 1}}
+	return p.commands(false)
+}
@@ -0,0 +1,672 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sieve
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Inbox is the folder in which keep files messages.
+const Inbox = "INBOX"
+
+// extensions are the extensions that may be given to require.
+var extensions = map[string]bool{
+	"fileinto":                   true,
+	"imap4flags":                 true,
+	"envelope":                   true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Message is a message that a script is run against.
+type Message struct {
+	// Header holds the header fields of the message as they are shown to
+	// the user.
+	Header map[string][]string
+
+	// From and To are the envelope addresses of the message.
+	From string
+	To   string
+}
+
+// Delivery is a folder that a message is filed in with the flags that it
+// is given there.
+type Delivery struct {
+	Folder string
+	Flags  []string
+}
+
+// Result is the outcome of running a script. A message with no deliveries is
+// discarded.
+type Result struct {
+	Deliveries []Delivery
+}
+
+// Script is a parsed Sieve script.
+type Script struct {
+	commands []*action
+}
+
+// condition is a compiled test.
+type condition interface {
+	eval(m *Message) bool
+}
+
+// branch is one branch of an if command. Its condition is nil for else.
+type branch struct {
+	cond condition
+	body []*action
+}
+
+// action is a compiled command.
+type action struct {
+	name     string
+	branches []*branch // For if.
+	folder   string    // For fileinto.
+	flags    []string  // For addflag.
+}
+
+// matcher compares header values against keys.
+type matcher struct {
+	typ        string // is, contains or matches.
+	comparator string
+}
+
+// match returns whether a value matches a key.
+func (m *matcher) match(value, key string) bool {
+	if m.comparator == "i;ascii-casemap" {
+		value, key = asciiLower(value), asciiLower(key)
+	}
+
+	switch m.typ {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return glob(value, key)
+	}
+	return value == key
+}
+
+// matchAny returns whether any value matches any key.
+func (m *matcher) matchAny(values, keys []string) bool {
+	for _, value := range values {
+		for _, key := range keys {
+			if m.match(value, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// asciiLower converts the ASCII letters of a string to lower case.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// glob matches a string against a pattern in which * matches any sequence
+// of characters, ? matches a single character and \ escapes the next
+// character.
+func glob(s, pattern string) bool {
+	type element struct {
+		r        rune
+		wildcard rune // '*', '?' or 0 for a literal.
+	}
+
+	var pat []element
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			pat = append(pat, element{r: r})
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*' || r == '?':
+			pat = append(pat, element{wildcard: r})
+		default:
+			pat = append(pat, element{r: r})
+		}
+	}
+
+	str := []rune(s)
+	si, pi, star, mark := 0, 0, -1, 0
+	for si < len(str) {
+		switch {
+		case pi < len(pat) && (pat[pi].wildcard == '?' ||
+			(pat[pi].wildcard == 0 && pat[pi].r == str[si])):
+			si++
+			pi++
+		case pi < len(pat) && pat[pi].wildcard == '*':
+			star, mark = pi, si
+			pi++
+		case star >= 0:
+			mark++
+			pi, si = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(pat) && pat[pi].wildcard == '*' {
+		pi++
+	}
+	return pi == len(pat)
+}
+
+// headerValues returns the values of the named header fields, whose names
+// are case-insensitive.
+func headerValues(header map[string][]string, name string) []string {
+	var values []string
+	for key, v := range header {
+		if strings.EqualFold(key, name) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// addressPart returns part of an address, which is all, localpart or domain.
+func addressPart(address, part string) string {
+	i := strings.LastIndex(address, "@")
+	switch part {
+	case "localpart":
+		if i < 0 {
+			return address
+		}
+		return address[:i]
+	case "domain":
+		if i < 0 {
+			return ""
+		}
+		return address[i+1:]
+	}
+	return address
+}
+
+// addresses returns the addresses in a header value. A value which cannot
+// be parsed as an address list is taken as a single address.
+func addresses(value string) []string {
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return []string{strings.TrimSpace(value)}
+	}
+
+	addrs := make([]string, len(list))
+	for i, addr := range list {
+		addrs[i] = addr.Address
+	}
+	return addrs
+}
+
+type headerTest struct {
+	names, keys []string
+	matcher
+}
+
+func (t *headerTest) eval(m *Message) bool {
+	for _, name := range t.names {
+		if t.matchAny(headerValues(m.Header, name), t.keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressTest is the address test, or the envelope test if envelope is true.
+type addressTest struct {
+	names, keys []string
+	part        string
+	envelope    bool
+	matcher
+}
+
+func (t *addressTest) eval(m *Message) bool {
+	for _, name := range t.names {
+		var addrs []string
+		if t.envelope {
+			switch asciiLower(name) {
+			case "from":
+				addrs = []string{m.From}
+			case "to":
+				addrs = []string{m.To}
+			}
+		} else {
+			for _, value := range headerValues(m.Header, name) {
+				addrs = append(addrs, addresses(value)...)
+			}
+		}
+
+		for i, addr := range addrs {
+			addrs[i] = addressPart(addr, t.part)
+		}
+		if t.matchAny(addrs, t.keys) {
+			return true
+		}
+	}
+	return false
+}
+
+type existsTest []string
+
+func (t existsTest) eval(m *Message) bool {
+	for _, name := range t {
+		if len(headerValues(m.Header, name)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+type allofTest []condition
+
+func (t allofTest) eval(m *Message) bool {
+	for _, c := range t {
+		if !c.eval(m) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyofTest []condition
+
+func (t anyofTest) eval(m *Message) bool {
+	for _, c := range t {
+		if c.eval(m) {
+			return true
+		}
+	}
+	return false
+}
+
+type notTest struct {
+	condition
+}
+
+func (t notTest) eval(m *Message) bool {
+	return !t.condition.eval(m)
+}
+
+type constTest bool
+
+func (t constTest) eval(m *Message) bool {
+	return bool(t)
+}
+
+// compiler checks the syntax tree of a script and turns it into actions.
+type compiler struct {
+	required map[string]bool
+}
+
+// require checks that an extension has been required.
+func (c *compiler) require(ext string, line int) error {
+	if !c.required[ext] {
+		return errorf(line, `missing require "%s"`, ext)
+	}
+	return nil
+}
+
+// stringArgs returns the strings of the positional arguments of a command or a
+// test, of which there must be n.
+func stringArgs(name string, line int, args []*argument, n int) ([][]string, error) {
+	if len(args) != n {
+		return nil, errorf(line, "%s takes %d arguments but has %d", name, n, len(args))
+	}
+
+	strs := make([][]string, n)
+	for i, arg := range args {
+		if arg.strs == nil {
+			return nil, errorf(arg.line, "%s expects a string but found a %s", name, arg)
+		}
+		strs[i] = arg.strs
+	}
+	return strs, nil
+}
+
+// matchArgs reads the match type, comparator and, for address tests, the
+// address part from the tagged arguments of a test and returns its other
+// arguments.
+func (c *compiler) matchArgs(t *test, isAddress bool) (*matcher, string, []*argument, error) {
+	m := &matcher{typ: "is", comparator: "i;ascii-casemap"}
+	part := "all"
+	var typ, partSet, comparatorSet bool
+	var rest []*argument
+	for i := 0; i < len(t.args); i++ {
+		arg := t.args[i]
+		switch arg.tag {
+		case "":
+			rest = append(rest, arg)
+		case "is", "contains", "matches":
+			if typ {
+				return nil, "", nil, errorf(arg.line, "more than one match type given to %s", t.name)
+			}
+			typ = true
+			m.typ = arg.tag
+		case "comparator":
+			if comparatorSet {
+				return nil, "", nil, errorf(arg.line, "more than one comparator given to %s", t.name)
+			}
+			comparatorSet = true
+			i++
+			if i == len(t.args) || len(t.args[i].strs) != 1 {
+				return nil, "", nil, errorf(arg.line, ":comparator expects a string")
+			}
+			m.comparator = t.args[i].strs[0]
+			if m.comparator != "i;ascii-casemap" && m.comparator != "i;octet" {
+				return nil, "", nil, errorf(arg.line, "unsupported comparator %s", m.comparator)
+			}
+		case "all", "localpart", "domain":
+			if !isAddress {
+				return nil, "", nil, errorf(arg.line, "unexpected :%s given to %s", arg.tag, t.name)
+			}
+			if partSet {
+				return nil, "", nil, errorf(arg.line, "more than one address part given to %s", t.name)
+			}
+			partSet = true
+			part = arg.tag
+		default:
+			return nil, "", nil, errorf(arg.line, "unexpected :%s given to %s", arg.tag, t.name)
+		}
+	}
+	return m, part, rest, nil
+}
+
+// test compiles a test.
+func (c *compiler) test(t *test) (condition, error) {
+	switch t.name {
+	case "header", "address", "envelope":
+		if t.name == "envelope" {
+			if err := c.require("envelope", t.line); err != nil {
+				return nil, err
+			}
+		}
+		if len(t.tests) != 0 {
+			return nil, errorf(t.line, "%s does not take tests", t.name)
+		}
+
+		m, part, rest, err := c.matchArgs(t, t.name != "header")
+		if err != nil {
+			return nil, err
+		}
+		strs, err := stringArgs(t.name, t.line, rest, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.name == "header" {
+			return &headerTest{names: strs[0], keys: strs[1], matcher: *m}, nil
+		}
+		return &addressTest{
+			names:    strs[0],
+			keys:     strs[1],
+			part:     part,
+			envelope: t.name == "envelope",
+			matcher:  *m,
+		}, nil
+
+	case "exists":
+		if len(t.tests) != 0 {
+			return nil, errorf(t.line, "exists does not take tests")
+		}
+		strs, err := stringArgs(t.name, t.line, t.args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return existsTest(strs[0]), nil
+
+	case "allof", "anyof", "not":
+		if len(t.args) != 0 {
+			return nil, errorf(t.line, "%s does not take arguments", t.name)
+		}
+		if len(t.tests) == 0 || (t.name == "not" && len(t.tests) != 1) {
+			return nil, errorf(t.line, "wrong number of tests given to %s", t.name)
+		}
+
+		conds := make([]condition, len(t.tests))
+		for i, tst := range t.tests {
+			cond, err := c.test(tst)
+			if err != nil {
+				return nil, err
+			}
+			conds[i] = cond
+		}
+
+		switch t.name {
+		case "allof":
+			return allofTest(conds), nil
+		case "anyof":
+			return anyofTest(conds), nil
+		}
+		return notTest{conds[0]}, nil
+
+	case "true", "false":
+		if len(t.args) != 0 || len(t.tests) != 0 {
+			return nil, errorf(t.line, "%s does not take arguments", t.name)
+		}
+		return constTest(t.name == "true"), nil
+	}
+
+	return nil, errorf(t.line, "unknown test %s", t.name)
+}
+
+// commands compiles a list of commands. Commands which follow an if command
+// are joined to it as its branches.
+func (c *compiler) commands(cmds []*command, top bool) ([]*action, error) {
+	var actions []*action
+	var lastIf *action // The if which an elsif or else may follow.
+	for _, cmd := range cmds {
+		if cmd.name == "require" && (!top || len(actions) != 0) {
+			return nil, errorf(cmd.line, "require must come before other commands")
+		}
+		isBranch := cmd.name == "if" || cmd.name == "elsif" || cmd.name == "else"
+		if cmd.hasBlock != isBranch {
+			if isBranch {
+				return nil, errorf(cmd.line, "%s requires a block", cmd.name)
+			}
+			return nil, errorf(cmd.line, "%s does not take a block", cmd.name)
+		}
+		if !isBranch && len(cmd.tests) != 0 {
+			return nil, errorf(cmd.line, "%s does not take tests", cmd.name)
+		}
+
+		switch cmd.name {
+		case "require":
+			strs, err := stringArgs(cmd.name, cmd.line, cmd.args, 1)
+			if err != nil {
+				return nil, err
+			}
+			for _, ext := range strs[0] {
+				if !extensions[ext] {
+					return nil, errorf(cmd.line, "unsupported extension %s", ext)
+				}
+				c.required[ext] = true
+			}
+			continue
+
+		case "if", "elsif", "else":
+			if cmd.name != "if" && lastIf == nil {
+				return nil, errorf(cmd.line, "%s without if", cmd.name)
+			}
+
+			br := &branch{}
+			if cmd.name == "else" {
+				if len(cmd.args) != 0 || len(cmd.tests) != 0 {
+					return nil, errorf(cmd.line, "else does not take a test")
+				}
+			} else {
+				if len(cmd.args) != 0 || len(cmd.tests) != 1 {
+					return nil, errorf(cmd.line, "%s requires a single test", cmd.name)
+				}
+				var err error
+				br.cond, err = c.test(cmd.tests[0])
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			var err error
+			br.body, err = c.commands(cmd.block, false)
+			if err != nil {
+				return nil, err
+			}
+
+			if cmd.name == "if" {
+				lastIf = &action{name: "if"}
+				actions = append(actions, lastIf)
+			}
+			lastIf.branches = append(lastIf.branches, br)
+			if cmd.name == "else" {
+				lastIf = nil
+			}
+			continue
+
+		case "keep", "discard", "stop":
+			if len(cmd.args) != 0 {
+				return nil, errorf(cmd.line, "%s does not take arguments", cmd.name)
+			}
+			actions = append(actions, &action{name: cmd.name})
+
+		case "fileinto":
+			if err := c.require("fileinto", cmd.line); err != nil {
+				return nil, err
+			}
+			strs, err := stringArgs(cmd.name, cmd.line, cmd.args, 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(strs[0]) != 1 {
+				return nil, errorf(cmd.line, "fileinto expects a single folder")
+			}
+			actions = append(actions, &action{name: cmd.name, folder: strs[0][0]})
+
+		case "addflag":
+			if err := c.require("imap4flags", cmd.line); err != nil {
+				return nil, err
+			}
+			strs, err := stringArgs(cmd.name, cmd.line, cmd.args, 1)
+			if err != nil {
+				return nil, err
+			}
+			var flags []string
+			for _, s := range strs[0] {
+				flags = append(flags, strings.Fields(s)...)
+			}
+			actions = append(actions, &action{name: cmd.name, flags: flags})
+
+		default:
+			return nil, errorf(cmd.line, "unknown command %s", cmd.name)
+		}
+		lastIf = nil
+	}
+	return actions, nil
+}
+
+// Parse parses a script. An *Error is returned if the script is invalid.
+func Parse(src string) (*Script, error) {
+	cmds, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &compiler{required: make(map[string]bool)}
+	actions, err := c.commands(cmds, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{commands: actions}, nil
+}
+
+// state is the state of a script which is running.
+type state struct {
+	msg          *Message
+	flags        []string
+	deliveries   []Delivery
+	implicitKeep bool
+}
+
+// deliver files the message in a folder with the current flags. A message is
+// only filed once in each folder.
+func (s *state) deliver(folder string) {
+	s.implicitKeep = false
+	if strings.EqualFold(folder, Inbox) {
+		folder = Inbox
+	}
+	for _, d := range s.deliveries {
+		if d.Folder == folder {
+			return
+		}
+	}
+
+	flags := make([]string, len(s.flags))
+	copy(flags, s.flags)
+	s.deliveries = append(s.deliveries, Delivery{Folder: folder, Flags: flags})
+}
+
+// addFlags adds flags to those that the message will be filed with. Flags
+// are case-insensitive.
+func (s *state) addFlags(flags []string) {
+	for _, flag := range flags {
+		found := false
+		for _, f := range s.flags {
+			if strings.EqualFold(f, flag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.flags = append(s.flags, flag)
+		}
+	}
+}
+
+// run performs a list of actions. It returns false if the script stopped.
+func (s *state) run(actions []*action) bool {
+	for _, a := range actions {
+		switch a.name {
+		case "if":
+			for _, br := range a.branches {
+				if br.cond == nil || br.cond.eval(s.msg) {
+					if !s.run(br.body) {
+						return false
+					}
+					break
+				}
+			}
+		case "keep":
+			s.deliver(Inbox)
+		case "discard":
+			s.implicitKeep = false
+		case "stop":
+			return false
+		case "fileinto":
+			s.deliver(a.folder)
+		case "addflag":
+			s.addFlags(a.flags)
+		}
+	}
+	return true
+}
+
+// Run runs the script against a message and returns the folders that the
+// message should be filed in. Unless the script files or discards the
+// message, it is kept in the Inbox.
+func (s *Script) Run(m *Message) *Result {
+	st := &state{
+		msg:          m,
+		implicitKeep: true,
+	}
+	st.run(s.commands)
+	if st.implicitKeep {
+		st.deliver(Inbox)
+	}
+	return &Result{Deliveries: st.deliveries}
+}
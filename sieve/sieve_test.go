@@ -0,0 +1,158 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package sieve_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DanielKrawisz/bmagent/sieve"
+)
+
+const (
+	alice   = "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq@bm.addr"
+	bob     = "BM-2cUJvFYHhXpBHyd96KHfjxsgTYi44BajdE@bm.addr"
+	general = "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r@bm.addr"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		line   int
+	}{
+		{`keep`, 1},
+		{`fileinto "Friends";`, 1},
+		{"require \"fileinto\";\n\nfileinto [\"a\", \"b\"];", 3},
+		{`require "vacation";`, 1},
+		{"keep;\nrequire \"fileinto\";", 2},
+		{`if true { keep; } else { keep; } else { keep; }`, 1},
+		{`elsif true { keep; }`, 1},
+		{`if true keep;`, 1},
+		{`if header :is :contains "subject" "x" { keep; }`, 1},
+		{`if header :localpart "to" "x" { keep; }`, 1},
+		{`if header "subject" { keep; }`, 1},
+		{`if header :comparator "i;unicode-casemap" "subject" "x" { keep; }`, 1},
+		{`if envelope "to" "x" { keep; }`, 1},
+		{"if not (true, false) {\n keep;\n}", 1},
+		{`if size :over 100K { discard; }`, 1},
+		{"/* a comment\n */ addflag \"\\\\Seen\";", 2},
+		{"if true {\n  keep;\n", 3},
+		{"if header \"subject\" \"unterminated { keep; }", 1},
+		{"redirect \"someone@example.com\";", 1},
+	}
+
+	for i, test := range tests {
+		_, err := sieve.Parse(test.script)
+		if err == nil {
+			t.Errorf("case %d: expected error", i)
+			continue
+		}
+		serr, ok := err.(*sieve.Error)
+		if !ok {
+			t.Errorf("case %d: expected *sieve.Error, got %T", i, err)
+			continue
+		}
+		if serr.Line != test.line {
+			t.Errorf("case %d: expected error on line %d, got %v", i, test.line, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	msg := &sieve.Message{
+		Header: map[string][]string{
+			"From":    {"Alice <" + alice + ">"},
+			"To":      {general},
+			"Subject": {"Weekly REPORT: all good"},
+		},
+		From: alice,
+		To:   general,
+	}
+
+	tests := []struct {
+		script   string
+		expected []sieve.Delivery
+	}{
+		{``, []sieve.Delivery{{"INBOX", []string{}}}},
+		{`# Nothing but a comment.
+		  keep;`, []sieve.Delivery{{"INBOX", []string{}}}},
+		{`discard;`, nil},
+		{`require "fileinto";
+		  if header :contains "subject" "report" {
+		      fileinto "Reports";
+		  }`, []sieve.Delivery{{"Reports", []string{}}}},
+		{`require "fileinto";
+		  if header :comparator "i;octet" :contains "subject" "report" {
+		      fileinto "Reports";
+		  }`, []sieve.Delivery{{"INBOX", []string{}}}},
+		{`require "fileinto";
+		  if header :matches "Subject" "weekly * good" {
+		      fileinto "Reports";
+		  }`, []sieve.Delivery{{"Reports", []string{}}}},
+		{`require "fileinto";
+		  if header :matches "subject" "weekly ?eport" {
+		      fileinto "Reports";
+		  }`, []sieve.Delivery{{"INBOX", []string{}}}},
+		{`require ["fileinto", "imap4flags"];
+		  if address :is "from" "` + alice + `" {
+		      addflag ["\\Flagged", "$Friend \\Seen"];
+		      fileinto "Friends";
+		      stop;
+		  }
+		  fileinto "Others";`,
+			[]sieve.Delivery{{"Friends", []string{"\\Flagged", "$Friend", "\\Seen"}}}},
+		{`require "fileinto";
+		  if address :localpart "from" "` + bob[:len(bob)-8] + `" {
+		      fileinto "Bob";
+		  } elsif address :domain "from" "BM.ADDR" {
+		      fileinto "Bitmessage";
+		  } else {
+		      fileinto "Other";
+		  }`, []sieve.Delivery{{"Bitmessage", []string{}}}},
+		{`require ["envelope", "fileinto"];
+		  if envelope :is "to" "` + general + `" {
+		      fileinto "Chans/general";
+		      keep;
+		  }`, []sieve.Delivery{
+			{"Chans/general", []string{}},
+			{"INBOX", []string{}},
+		}},
+		{`require ["fileinto", "imap4flags"];
+		  fileinto "A";
+		  addflag "\\Seen";
+		  fileinto "B";
+		  fileinto "a";
+		  fileinto "A";`, []sieve.Delivery{
+			{"A", []string{}},
+			{"B", []string{"\\Seen"}},
+			{"a", []string{"\\Seen"}},
+		}},
+		{`require "imap4flags";
+		  if allof (exists ["from", "subject"], not exists "cc") {
+		      addflag "\\Flagged";
+		  }
+		  if anyof (false, header :is "x-missing" "") {
+		      discard;
+		  }`, []sieve.Delivery{{"INBOX", []string{"\\Flagged"}}}},
+		{`if true { discard; stop; } keep;`, nil},
+		{`require "fileinto";
+		  fileinto "inbox";`, []sieve.Delivery{{"INBOX", []string{}}}},
+		{"require \"fileinto\";\nfileinto text:\nMulti\n.\n;",
+			[]sieve.Delivery{{"Multi\r\n", []string{}}}},
+	}
+
+	for i, test := range tests {
+		script, err := sieve.Parse(test.script)
+		if err != nil {
+			t.Errorf("case %d: Parse returned error %v", i, err)
+			continue
+		}
+
+		result := script.Run(msg)
+		if !reflect.DeepEqual(result.Deliveries, test.expected) {
+			t.Errorf("case %d: expected %v, got %v", i, test.expected, result.Deliveries)
+		}
+	}
+}
@@ -16,6 +16,11 @@ type UserData struct {
 	bucketId           []byte				// The name of the user's bucket
 	username           string				// the username.
 	BroadcastAddresses *BroadcastAddresses
+	Publications       *Publications
+	Contacts           *Contacts
+	SenderFilter       *SenderFilter
+	SieveScript        *SieveScript
+	AutoReplies        *AutoReplies
 	mutex              sync.RWMutex        // For protecting the map.
 	folders            map[string]Folder
 }
@@ -26,6 +31,11 @@ func newUserData(
 	bucketId    []byte,
 	username    string,
 	broadcast   *BroadcastAddresses,
+	publications *Publications,
+	contacts    *Contacts,
+	filter      *SenderFilter,
+	sieve       *SieveScript,
+	autoReplies *AutoReplies,
 	folderNames map[string]struct{}) *UserData {
 		
 	folders := make(map[string]Folder)
@@ -40,6 +50,11 @@ func newUserData(
 		bucketId : bucketId, 
 		username : username, 
 		BroadcastAddresses: broadcast, 
+		Publications: publications, 
+		Contacts: contacts, 
+		SenderFilter: filter, 
+		SieveScript: sieve, 
+		AutoReplies: autoReplies, 
 		folders : folders, 
 	}
 }
@@ -122,6 +137,30 @@ func (u *UserData) Folders() []Folder {
 	return mboxes
 }
 
+// RenameFolder changes the name of a folder. 
+func (u *UserData) RenameFolder(oldName, newName string) error {
+	folder, err := u.FolderByName(oldName)
+	if err != nil {
+		return err
+	}
+	
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	
+	if _, ok := u.folders[newName]; ok {
+		return ErrDuplicateMailbox
+	}
+	
+	err = folder.SetName(newName)
+	if err != nil {
+		return err
+	}
+	
+	delete(u.folders, oldName)
+	u.folders[newName] = folder
+	return nil
+}
+
 // Delete deletes the folder. Any operations after a Delete are invalid.
 func (u *UserData) DeleteFolder(name string) error {
 	return u.db.Update(func(tx *bolt.Tx) error {
@@ -0,0 +1,225 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/DanielKrawisz/bmutil"
+)
+
+var (
+	// autoReplySettingsKey is the key of an identity's settings in its
+	// bucket.
+	autoReplySettingsKey = []byte("settings")
+
+	// autoReplySentBucket is the sub-bucket of an identity's bucket which
+	// holds the time that each sender was last replied to.
+	autoReplySentBucket = []byte("sent")
+)
+
+// AutoReply is an automatic reply which one of the user's identities sends
+// to the senders of the messages it receives.
+type AutoReply struct {
+	Subject string
+	Body    string
+
+	// The reply is only sent to messages received between Start and End.
+	// A zero time leaves that end of the range open.
+	Start time.Time
+	End   time.Time
+
+	// Window is the time during which each sender is replied to only once.
+	// If it is zero, each sender is replied to only once for as long as the
+	// reply is set.
+	Window time.Duration
+}
+
+// Active returns whether the reply is sent to messages received at the
+// given time.
+func (r *AutoReply) Active(t time.Time) bool {
+	if !r.Start.IsZero() && t.Before(r.Start) {
+		return false
+	}
+	if !r.End.IsZero() && t.After(r.End) {
+		return false
+	}
+	return true
+}
+
+// AutoReplies holds the automatic replies of the user's identities, indexed
+// by address, and remembers which senders each has replied to. The replies
+// are encrypted with the master key.
+type AutoReplies struct {
+	masterKey *[keySize]byte // can be nil.
+	db        *bolt.DB
+	bucketId  []byte // The name of the user's bucket.
+}
+
+// newAutoReplies creates a new AutoReplies object after doing the necessary
+// initialization.
+func newAutoReplies(masterKey *[keySize]byte, db *bolt.DB, bucketId []byte) (*AutoReplies, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(bucketId).CreateBucketIfNotExists(autoReplyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AutoReplies{
+		masterKey: masterKey,
+		db:        db,
+		bucketId:  bucketId,
+	}, nil
+}
+
+// identity returns the bucket of one of the user's identities, or nil if it
+// has no automatic reply.
+func (a *AutoReplies) identity(tx *bolt.Tx, address string) *bolt.Bucket {
+	return tx.Bucket(a.bucketId).Bucket(autoReplyBucket).Bucket([]byte(address))
+}
+
+// decode decrypts and decodes the settings of an automatic reply.
+func (a *AutoReplies) decode(v []byte) (*AutoReply, error) {
+	data, ok := decrypt(a.masterKey, a.db, v)
+	if !ok {
+		return nil, errors.New("Unable to decrypt automatic reply.")
+	}
+
+	reply := &AutoReply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Set sets the automatic reply of one of the user's identities. Senders who
+// were replied to before are forgotten, so that they receive the new reply.
+func (a *AutoReplies) Set(address string, reply *AutoReply) error {
+	if _, err := bmutil.DecodeAddress(address); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	enc, err := encrypt(a.masterKey, a.db, data)
+	if err != nil {
+		return err
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(a.bucketId).Bucket(autoReplyBucket)
+		if bucket.Bucket([]byte(address)) != nil {
+			if err := bucket.DeleteBucket([]byte(address)); err != nil {
+				return err
+			}
+		}
+
+		id, err := bucket.CreateBucket([]byte(address))
+		if err != nil {
+			return err
+		}
+		if _, err = id.CreateBucket(autoReplySentBucket); err != nil {
+			return err
+		}
+		return id.Put(autoReplySettingsKey, enc)
+	})
+}
+
+// Get returns the automatic reply of one of the user's identities.
+// ErrNotFound is returned if it has none.
+func (a *AutoReplies) Get(address string) (*AutoReply, error) {
+	var reply *AutoReply
+	err := a.db.View(func(tx *bolt.Tx) error {
+		id := a.identity(tx, address)
+		if id == nil {
+			return ErrNotFound
+		}
+
+		var err error
+		reply, err = a.decode(id.Get(autoReplySettingsKey))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Remove removes the automatic reply of one of the user's identities.
+// ErrNotFound is returned if it has none.
+func (a *AutoReplies) Remove(address string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(a.bucketId).Bucket(autoReplyBucket)
+		if bucket.Bucket([]byte(address)) == nil {
+			return ErrNotFound
+		}
+		return bucket.DeleteBucket([]byte(address))
+	})
+}
+
+// ForEach runs the specified function for each identity which has an
+// automatic reply, breaking early if an error occurs.
+func (a *AutoReplies) ForEach(f func(address string, reply *AutoReply) error) error {
+	return a.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(a.bucketId).Bucket(autoReplyBucket)
+		return bucket.ForEach(func(k, _ []byte) error {
+			reply, err := a.decode(bucket.Bucket(k).Get(autoReplySettingsKey))
+			if err != nil {
+				return err
+			}
+			return f(string(k), reply)
+		})
+	})
+}
+
+// Reply returns the automatic reply that one of the user's identities should
+// send to a sender whose message was received at the given time, or nil if
+// none should be sent. If there is one, the time is recorded so that the
+// sender is not replied to again within the reply's window.
+func (a *AutoReplies) Reply(address, sender string, t time.Time) (*AutoReply, error) {
+	var reply *AutoReply
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		id := a.identity(tx, address)
+		if id == nil {
+			return nil
+		}
+
+		r, err := a.decode(id.Get(autoReplySettingsKey))
+		if err != nil {
+			return err
+		}
+		if !r.Active(t) {
+			return nil
+		}
+
+		sent := id.Bucket(autoReplySentBucket)
+		if v := sent.Get([]byte(sender)); len(v) == 8 {
+			if r.Window == 0 {
+				return nil
+			}
+			last := time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+			if t.Before(last.Add(r.Window)) {
+				return nil
+			}
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(t.Unix()))
+		reply = r
+		return sent.Put([]byte(sender), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+func TestAutoReplies(t *testing.T) {
+	// Open store.
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := u.AutoReplies
+
+	support := "BM-2cUfDTJXLeMxAVe7pWXBEneBjDuQ783VSq"
+	alice := "BM-2cUJvFYHhXpBHyd96KHfjxsgTYi44BajdE"
+	bob := "BM-2cW67GEKkHGonXKZLCzouLLxnLym3azS8r"
+	start := time.Date(2016, time.July, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2016, time.July, 15, 0, 0, 0, 0, time.UTC)
+
+	if _, err = replies.Get(support); err != store.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if r, err := replies.Reply(support, alice, start); r != nil || err != nil {
+		t.Errorf("Expected no reply without settings, got %v, %v", r, err)
+	}
+	if err = replies.Set("not an address", &store.AutoReply{}); err == nil {
+		t.Error("Expected error setting reply of invalid address.")
+	}
+
+	reply := &store.AutoReply{
+		Subject: "Out of office",
+		Body:    "I will answer when I am back.",
+		Start:   start,
+		End:     end,
+		Window:  72 * time.Hour,
+	}
+	if err = replies.Set(support, reply); err != nil {
+		t.Fatal(err)
+	}
+	got, err := replies.Get(support)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != reply.Subject || got.Body != reply.Body ||
+		!got.Start.Equal(start) || !got.End.Equal(end) || got.Window != reply.Window {
+		t.Errorf("Expected %v, got %v", reply, got)
+	}
+
+	tests := []struct {
+		sender   string
+		t        time.Time
+		expected bool
+	}{
+		{alice, start.Add(-time.Hour), false},
+		{alice, start.Add(time.Hour), true},
+		{alice, start.Add(2 * time.Hour), false},
+		{bob, start.Add(2 * time.Hour), true},
+		{alice, start.Add(74 * time.Hour), true},
+		{bob, end.Add(time.Hour), false},
+	}
+	for i, test := range tests {
+		r, err := replies.Reply(support, test.sender, test.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (r != nil) != test.expected {
+			t.Errorf("Test %d: expected %v, got %v", i, test.expected, r)
+		}
+		if r != nil && r.Body != reply.Body {
+			t.Errorf("Test %d: expected body %q, got %q", i, reply.Body, r.Body)
+		}
+	}
+
+	// Setting the reply again forgets the senders. With no window, each is
+	// replied to once.
+	reply.Window = 0
+	if err = replies.Set(support, reply); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []bool{true, false} {
+		r, err := replies.Reply(support, alice, end.Add(-time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (r != nil) != expected {
+			t.Errorf("Expected %v, got %v", expected, r)
+		}
+	}
+
+	addresses := make(map[string]string)
+	err = replies.ForEach(func(address string, r *store.AutoReply) error {
+		addresses[address] = r.Subject
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addresses, map[string]string{support: "Out of office"}) {
+		t.Errorf("Unexpected replies %v", addresses)
+	}
+
+	if err = replies.Remove(support); err != nil {
+		t.Fatal(err)
+	}
+	if err = replies.Remove(support); err != store.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
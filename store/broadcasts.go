@@ -7,6 +7,7 @@ package store
 
 import (
 	"bytes"
+	"sync"
 
 	"github.com/boltdb/bolt"
 	"github.com/DanielKrawisz/bmutil"
@@ -14,11 +15,14 @@ import (
 
 // BroadcastAddresses keeps track of the broadcasts that the user is listening
 // to. It provides functionality for adding, removal and running a function for
-// each address.
+// each address. Each address may optionally be given a label, which is stored
+// as the value of the address in the broadcasts bucket.
 type BroadcastAddresses struct {
 	db *bolt.DB
 	username []byte
+	mutex sync.RWMutex // Protects the following fields.
 	addrs []bmutil.Address // All broadcast addresses.
+	labels map[string]string // Labels indexed by address.
 }
 
 // newBroadcastsStore creates a new BroadcastAddresses object after doing the
@@ -29,6 +33,7 @@ func newBroadcastsStore(db *bolt.DB, username string) (*BroadcastAddresses, erro
 		db : db,
 		username : []byte(username), 
 		addrs: make([]bmutil.Address, 0),
+		labels: make(map[string]string),
 	}
 
 	err := db.Update(func(tx *bolt.Tx) error {
@@ -42,13 +47,14 @@ func newBroadcastsStore(db *bolt.DB, username string) (*BroadcastAddresses, erro
 			return err
 		}
 
-		return bucket.ForEach(func(k, _ []byte) error {
+		return bucket.ForEach(func(k, v []byte) error {
 			addr, err := bmutil.DecodeAddress(string(k))
 			if err != nil {
 				return err
 			}
 
 			b.addrs = append(b.addrs, *addr)
+			b.labels[string(k)] = string(v)
 			return nil
 		})
 	})
@@ -59,15 +65,19 @@ func newBroadcastsStore(db *bolt.DB, username string) (*BroadcastAddresses, erro
 	return b, nil
 }
 
-// Add adds a new address to the store.
-func (b *BroadcastAddresses) Add(address string) error {
+// Add adds a new address to the store with the given label, which may be
+// empty. If the address is already in the store, its label is replaced.
+func (b *BroadcastAddresses) Add(address, label string) error {
 	addr, err := bmutil.DecodeAddress(address)
 	if err != nil {
 		return err
 	}
 
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	k := []byte(address)
-	v := []byte{}
+	v := []byte(label)
 
 	err = b.db.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket(b.username).Bucket(broadcastAddressesBucket).Put(k, v)
@@ -76,10 +86,26 @@ func (b *BroadcastAddresses) Add(address string) error {
 		return err
 	}
 
-	b.addrs = append(b.addrs, *addr)
+	if _, ok := b.labels[address]; !ok {
+		b.addrs = append(b.addrs, *addr)
+	}
+	b.labels[address] = label
 	return nil
 }
 
+// Label returns the label of the given address. ErrNotFound is returned if
+// the address is not in the store.
+func (b *BroadcastAddresses) Label(address string) (string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	label, ok := b.labels[address]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return label, nil
+}
+
 // Remove removes an address from the store.
 func (b *BroadcastAddresses) Remove(address string) error {
 	addr, err := bmutil.DecodeAddress(address)
@@ -87,19 +113,23 @@ func (b *BroadcastAddresses) Remove(address string) error {
 		return err
 	}
 
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.labels[address]; !ok {
+		return ErrNotFound
+	}
+
 	k := []byte(address)
 
 	err = b.db.Update(func(tx *bolt.Tx) error {
-		if tx.Bucket(b.username).Bucket(broadcastAddressesBucket).Get(k) == nil {
-			return ErrNotFound
-		}
-
-		return tx.Bucket(broadcastAddressesBucket).Delete(k)
+		return tx.Bucket(b.username).Bucket(broadcastAddressesBucket).Delete(k)
 	})
 	if err != nil {
 		return err
 	}
 
+	delete(b.labels, address)
 	for i, t := range b.addrs {
 		if bytes.Equal(t.Ripe[:], addr.Ripe[:]) {
 			// Delete.
@@ -113,7 +143,12 @@ func (b *BroadcastAddresses) Remove(address string) error {
 // ForEach runs the specified function for each broadcast address, breaking
 // early if an error occurs.
 func (b *BroadcastAddresses) ForEach(f func(address *bmutil.Address) error) error {
-	for _, addr := range b.addrs {
+	b.mutex.RLock()
+	addrs := make([]bmutil.Address, len(b.addrs))
+	copy(addrs, b.addrs)
+	b.mutex.RUnlock()
+
+	for _, addr := range addrs {
 		err := f(&addr)
 		if err != nil {
 			return err
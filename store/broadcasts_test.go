@@ -56,11 +56,11 @@ func TestBroadcastAddresses(t *testing.T) {
 	}
 
 	// Add 2 address.
-	err = u.BroadcastAddresses.Add(addr1)
+	err = u.BroadcastAddresses.Add(addr1, "")
 	if err != nil {
 		t.Error(err)
 	}
-	err = u.BroadcastAddresses.Add(addr2)
+	err = u.BroadcastAddresses.Add(addr2, "Bitmessage news")
 	if err != nil {
 		t.Error(err)
 	}
@@ -74,4 +74,35 @@ func TestBroadcastAddresses(t *testing.T) {
 	if counter != 2 {
 		t.Errorf("For counter expected %d got %d", 2, counter)
 	}
+
+	// Check labels.
+	if label, err := u.BroadcastAddresses.Label(addr2); err != nil || label != "Bitmessage news" {
+		t.Errorf("Label expected %s got %s, error %v", "Bitmessage news", label, err)
+	}
+
+	// Adding an address again should only change its label.
+	err = u.BroadcastAddresses.Add(addr1, "Updates")
+	if err != nil {
+		t.Error(err)
+	}
+	if label, err := u.BroadcastAddresses.Label(addr1); err != nil || label != "Updates" {
+		t.Errorf("Label expected %s got %s, error %v", "Updates", label, err)
+	}
+
+	// Remove an address.
+	err = u.BroadcastAddresses.Remove(addr1)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := u.BroadcastAddresses.Label(addr1); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound got ", err)
+	}
+	counter = 0
+	u.BroadcastAddresses.ForEach(func(*bmutil.Address) error {
+		counter++
+		return nil
+	})
+	if counter != 1 {
+		t.Errorf("For counter expected %d got %d", 1, counter)
+	}
 }
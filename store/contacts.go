@@ -0,0 +1,243 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/DanielKrawisz/bmutil"
+)
+
+// Contact is what is known about a Bitmessage address that the user has
+// added to the address book or has received messages from.
+type Contact struct {
+	// Label is the name that the user gave the contact.
+	Label string
+
+	// AddressBook is true if the user added the contact to the address
+	// book, rather than it having been saved from an incoming message.
+	AddressBook bool
+
+	// Card is the name under which the contact's vCard was saved through
+	// CardDAV, or empty if it was added in some other way.
+	Card string
+
+	// The contact's public keys as serialized by btcec, or nil if they
+	// are not known.
+	SigningKey    []byte
+	EncryptionKey []byte
+
+	// The proof-of-work demanded by the contact.
+	NonceTrialsPerByte uint64
+	ExtraBytes         uint64
+
+	// The times that the contact's public key was first and last seen.
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Contacts is the user's address book. It maps the Bitmessage addresses of
+// the user's contacts to labels and keeps the public keys of the senders of
+// incoming messages, so that they need not be requested again. It is
+// encrypted with the master key.
+type Contacts struct {
+	masterKey *[keySize]byte // can be nil.
+	db        *bolt.DB
+	bucketId  []byte // The name of the user's bucket.
+}
+
+// newContacts creates a new Contacts object after doing the necessary
+// initialization.
+func newContacts(masterKey *[keySize]byte, db *bolt.DB, bucketId []byte) (*Contacts, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(bucketId).CreateBucketIfNotExists(contactsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Contacts{
+		masterKey: masterKey,
+		db:        db,
+		bucketId:  bucketId,
+	}, nil
+}
+
+// decodeContact decrypts and decodes a contact.
+func (c *Contacts) decodeContact(v []byte) (*Contact, error) {
+	data, ok := decrypt(c.masterKey, c.db, v)
+	if !ok {
+		return nil, errors.New("Unable to decrypt contact.")
+	}
+
+	contact := &Contact{}
+	if err := json.Unmarshal(data, contact); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// get returns the contact with the given address, or nil if there is none.
+func (c *Contacts) get(bucket *bolt.Bucket, address string) (*Contact, error) {
+	v := bucket.Get([]byte(address))
+	if v == nil {
+		return nil, nil
+	}
+	return c.decodeContact(v)
+}
+
+// put encodes, encrypts and saves a contact.
+func (c *Contacts) put(bucket *bolt.Bucket, address string, contact *Contact) error {
+	data, err := json.Marshal(contact)
+	if err != nil {
+		return err
+	}
+	enc, err := encrypt(c.masterKey, c.db, data)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(address), enc)
+}
+
+// update runs f on the contact with the given address, which is created if
+// it does not exist, and saves the result.
+func (c *Contacts) update(address string, f func(contact *Contact) error) error {
+	if _, err := bmutil.DecodeAddress(address); err != nil {
+		return err
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(c.bucketId).Bucket(contactsBucket)
+		contact, err := c.get(bucket, address)
+		if err != nil {
+			return err
+		}
+		if contact == nil {
+			contact = &Contact{}
+		}
+		if err := f(contact); err != nil {
+			return err
+		}
+		return c.put(bucket, address, contact)
+	})
+}
+
+// Add adds an address to the address book with the given label. If the
+// address is already in the address book, its label is replaced.
+func (c *Contacts) Add(address, label string) error {
+	return c.update(address, func(contact *Contact) error {
+		contact.Label = label
+		contact.AddressBook = true
+		return nil
+	})
+}
+
+// AddCard adds an address to the address book with the given label, like
+// Add, and saves the name of the vCard which was uploaded for it.
+func (c *Contacts) AddCard(address, label, card string) error {
+	return c.update(address, func(contact *Contact) error {
+		contact.Label = label
+		contact.AddressBook = true
+		contact.Card = card
+		return nil
+	})
+}
+
+// SetPublicKey saves the public key of a contact, which was seen at the given
+// time. The contact is created if it does not exist, but it is not added to
+// the address book.
+func (c *Contacts) SetPublicKey(address string, signingKey, encryptionKey []byte,
+	nonceTrials, extraBytes uint64, seen time.Time) error {
+
+	return c.update(address, func(contact *Contact) error {
+		contact.SigningKey = signingKey
+		contact.EncryptionKey = encryptionKey
+		contact.NonceTrialsPerByte = nonceTrials
+		contact.ExtraBytes = extraBytes
+		if contact.FirstSeen.IsZero() {
+			contact.FirstSeen = seen
+		}
+		contact.LastSeen = seen
+		return nil
+	})
+}
+
+// Get returns the contact with the given address. ErrNotFound is returned
+// if there is no such contact.
+func (c *Contacts) Get(address string) (*Contact, error) {
+	var contact *Contact
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		contact, err = c.get(tx.Bucket(c.bucketId).Bucket(contactsBucket), address)
+		if err != nil {
+			return err
+		}
+		if contact == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
+
+// Label returns the label of the given address. ErrNotFound is returned if
+// the address is not in the address book.
+func (c *Contacts) Label(address string) (string, error) {
+	contact, err := c.Get(address)
+	if err != nil {
+		return "", err
+	}
+	if !contact.AddressBook {
+		return "", ErrNotFound
+	}
+	return contact.Label, nil
+}
+
+// Remove removes an address from the address book. Its public key is kept,
+// if it is known. ErrNotFound is returned if the address is not in the
+// address book.
+func (c *Contacts) Remove(address string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(c.bucketId).Bucket(contactsBucket)
+		contact, err := c.get(bucket, address)
+		if err != nil {
+			return err
+		}
+		if contact == nil || !contact.AddressBook {
+			return ErrNotFound
+		}
+
+		if contact.SigningKey == nil {
+			return bucket.Delete([]byte(address))
+		}
+
+		contact.Label = ""
+		contact.AddressBook = false
+		contact.Card = ""
+		return c.put(bucket, address, contact)
+	})
+}
+
+// ForEach runs the specified function for each contact, breaking early if an
+// error occurs.
+func (c *Contacts) ForEach(f func(address string, contact *Contact) error) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucketId).Bucket(contactsBucket).ForEach(
+			func(k, v []byte) error {
+				contact, err := c.decodeContact(v)
+				if err != nil {
+					return err
+				}
+				return f(string(k), contact)
+			})
+	})
+}
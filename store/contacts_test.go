@@ -0,0 +1,144 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+func TestContacts(t *testing.T) {
+	// Open store.
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := u.Contacts
+
+	addr1 := "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+	addr2 := "BM-2DAV89w336ovy6BUJnfVRD5B9qipFbRgmr"
+
+	if _, err = c.Label(addr1); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	if err = c.Add("BM-invalid", "Nobody"); err == nil {
+		t.Error("Invalid address should not be added.")
+	}
+
+	if err = c.Add(addr1, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Add(addr2, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Add(addr2, "Bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{addr1: "Alice", addr2: "Bob"}
+	count := 0
+	err = c.ForEach(func(address string, contact *store.Contact) error {
+		count++
+		if !contact.AddressBook || contact.Label != expected[address] {
+			t.Errorf("For address %s expected label %s got %v", address,
+				expected[address], contact)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("Got error", err)
+	}
+	if count != 2 {
+		t.Errorf("For count, expected %v got %v", 2, count)
+	}
+
+	if err = c.Remove(addr1); err != nil {
+		t.Error("Got error", err)
+	}
+	if err = c.Remove(addr1); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	if label, err := c.Label(addr2); err != nil || label != "Bob" {
+		t.Errorf("Expected label Bob, got %s, %v", label, err)
+	}
+
+	// Public keys are saved for senders who are not in the address book,
+	// and kept when an address is removed from it.
+	first := time.Unix(1000, 0)
+	last := time.Unix(2000, 0)
+	sign, encr := []byte("signing key"), []byte("encryption key")
+	if err = c.SetPublicKey(addr1, sign, encr, 1000, 1000, first); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetPublicKey(addr1, sign, encr, 2000, 1000, last); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Label(addr1); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	contact, err := c.Get(addr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contact.AddressBook || !bytes.Equal(contact.SigningKey, sign) ||
+		!bytes.Equal(contact.EncryptionKey, encr) || contact.NonceTrialsPerByte != 2000 ||
+		!contact.FirstSeen.Equal(first) || !contact.LastSeen.Equal(last) {
+		t.Errorf("Wrong contact %v", contact)
+	}
+
+	if err = c.AddCard(addr1, "Alice", "alice.vcf"); err != nil {
+		t.Fatal(err)
+	}
+	if contact, err = c.Get(addr1); err != nil || contact.Card != "alice.vcf" ||
+		contact.Label != "Alice" || !contact.AddressBook {
+		t.Errorf("Wrong contact %v, %v", contact, err)
+	}
+	if err = c.Remove(addr1); err != nil {
+		t.Error("Got error", err)
+	}
+	if contact, err = c.Get(addr1); err != nil || contact.SigningKey == nil || contact.Card != "" {
+		t.Errorf("Public key should be kept, got %v, %v", contact, err)
+	}
+	if err = c.Remove(addr2); err != nil {
+		t.Error("Got error", err)
+	}
+	if _, err = c.Get(addr2); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	// A contact which cannot be decrypted is an error.
+	if err = store.TstPutRawContact(c, addr2, []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Get(addr2); err == nil || err == store.ErrNotFound {
+		t.Error("Expected error, got", err)
+	}
+	if err = c.ForEach(func(string, *store.Contact) error { return nil }); err == nil {
+		t.Error("Expected error from ForEach")
+	}
+}
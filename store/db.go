@@ -44,15 +44,32 @@ const (
 // Buckets for storing data in the database.
 var (
 	powQueueBucket           = []byte("powQueue")
+	powProgressBucket        = []byte("powProgress")
+	powOrderBucket           = []byte("powOrder")
+	powTurnsBucket           = []byte("powTurns")
 	pkRequestsBucket         = []byte("pubkeyRequests")
 	miscBucket               = []byte("misc")
 	countersBucket           = []byte("counters")
 	broadcastAddressesBucket = []byte("broadcastAddresses")
+	pubkeyPublicationsBucket = []byte("pubkeyPublications")
+	contactsBucket           = []byte("contacts")
+	senderFilterBucket       = []byte("senderFilter")
+	sieveBucket              = []byte("sieve")
+	autoReplyBucket          = []byte("autoReply")
 	foldersBucket            = []byte("folders")
 	usersBucket              = []byte("users")
 
 	// Bucket is a sub-bucket of "folders"
 	folderDataBucket = []byte("data")
+
+	// Buckets are sub-buckets of the buckets of the priority classes in 
+	// "powOrder"
+	powOrderUsersBucket   = []byte("users")
+	powOrderEntriesBucket = []byte("entries")
+
+	// Buckets are sub-buckets of "senderFilter"
+	blacklistBucket = []byte("blacklist")
+	whitelistBucket = []byte("whitelist")
 	
 	userPrefix = []byte("user:")
 
@@ -75,6 +92,10 @@ var (
 	powQueueLatestIDKey = []byte("powQueueLatestID")
 	
 	usersLatestIDKey = []byte("usersLatestIDKey")
+
+	// powLastTurnKey contains the last turn given to a user in the POW
+	// queue.
+	powLastTurnKey = []byte("powLastTurn")
 )
 
 var (
@@ -332,6 +353,36 @@ func (s *Store) addUser(username string) (*UserData, error) {
 		s.Close()
 		return nil, err
 	}
+
+	publications, err := newPublications(s.db, uname)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	contacts, err := newContacts(s.masterKey, s.db, uname)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	filter, err := newSenderFilter(s.db, uname)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	sieve, err := newSieveScript(s.masterKey, s.db, uname)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	autoReplies, err := newAutoReplies(s.masterKey, s.db, uname)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
 	
 	user := newUserData(
 		s.masterKey, 
@@ -339,6 +390,11 @@ func (s *Store) addUser(username string) (*UserData, error) {
 		uname, 
 		username, 
 		broadcast, 
+		publications, 
+		contacts, 
+		filter, 
+		sieve, 
+		autoReplies, 
 		folders)
 	
 	s.Users[username] = user
@@ -578,6 +634,9 @@ func decrypt(masterKey *[keySize]byte, db *bolt.DB, data []byte) ([]byte, bool)
 	if (masterKey == nil) {
 		return data, true
 	}
+	if len(data) < nonceSize {
+		return nil, false
+	}
 	
 	// Read nonce
 	var nonce [nonceSize]byte
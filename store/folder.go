@@ -20,6 +20,15 @@ var (
 	// folderCreatedOnKey contains the time of creation of mailbox.
 	folderCreatedOnKey = []byte("createdOn")
 
+	// folderIndexBucket contains the secondary indexes of the mailbox. 
+	// Each index is a bucket containing folderIndexKeysBucket, which maps
+	// keys to buckets of message ids, and folderIndexIDsBucket, which maps 
+	// message ids back to their keys. 
+	folderIndexBucket = []byte("index")
+	
+	folderIndexKeysBucket = []byte("keys")
+	folderIndexIDsBucket = []byte("ids")
+
 	// ErrDuplicateID is returned by InsertMessage when the a message with the
 	// specified ID already exists in the folder.
 	ErrDuplicateID = errors.New("duplicate ID")
@@ -52,10 +61,28 @@ type Folder interface {
 	// index doesn't exist in the database.
 	GetMessage(id uint64) (uint64, []byte, error)
 
+	// UpdateMessage replaces the message with the given id, keeping the id. 
+	// ErrNotFound is returned if there is no message with the given id. 
+	UpdateMessage(id uint64, msg []byte, suffix uint64) error
+
 	// DeleteMessage deletes a message with the given index from the store. An error
 	// is returned if the message doesn't exist in the store.
 	DeleteMessage(id uint64) error 
 
+	// SetIndex sets the key under which the message with the given id is
+	// found in the named secondary index, replacing any key that it had 
+	// before. If the key is empty, the message is removed from the index.
+	// A message is removed from every index when it is deleted. 
+	SetIndex(index string, id uint64, key []byte) error
+
+	// Lookup returns the ids of the messages found under the given key in 
+	// the named secondary index, in ascending order. 
+	Lookup(index string, key []byte) ([]uint64, error)
+
+	// HasIndex returns whether the named secondary index has been created
+	// by a call to SetIndex. 
+	HasIndex(index string) bool
+
 	// ForEachMessage runs the given function for messages that have IDs between
 	// lowID and highID with the given suffix. If lowID is 0, it starts from the
 	// first message. If highID is 0, it returns all messages with id >= lowID with
@@ -329,6 +356,46 @@ func (f *folder) InsertMessage(id uint64, msg []byte, suffix uint64) error {
 	return nil
 }
 
+// UpdateMessage replaces the message with the given id, keeping the id. 
+// ErrNotFound is returned if there is no message with the given id. 
+func (f *folder) UpdateMessage(id uint64, msg []byte, suffix uint64) error {
+	if msg == nil {
+		return errors.New("Nil message inserted.")
+	}
+	
+	enc, err := encrypt(f.masterKey, f.db, msg)
+	if err != nil {
+		return err
+	}
+
+	return f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(f.userId)
+		if bucket == nil {
+			return ErrNotFound
+		}
+		m := bucket.Bucket(foldersBucket).Bucket([]byte(f.name))
+
+		k := make([]byte, 16)
+		binary.BigEndian.PutUint64(k[:8], id)
+		binary.BigEndian.PutUint64(k[8:], suffix)
+
+		// The old message may have had a different suffix. 
+		kk, v := m.Cursor().Seek(k[:8])
+		if kk == nil || v == nil || !bytes.Equal(kk[:8], k[:8]) {
+			return ErrNotFound
+		}
+		
+		if !bytes.Equal(kk, k) {
+			err := m.Delete(kk)
+			if err != nil {
+				return err
+			}
+		}
+
+		return m.Put(k, enc)
+	})
+}
+
 // GetMessage retrieves a message from the folder by its index. It returns the
 // suffix and the message. An error is returned if the message with the given
 // index doesn't exist in the database.
@@ -469,7 +536,7 @@ func (f *folder) DeleteMessage(id uint64) error {
 			return err
 		}
 		
-		return nil
+		return unindex(bucket, id)
 	})
 	
 	if err != nil {
@@ -479,6 +546,184 @@ func (f *folder) DeleteMessage(id uint64) error {
 	return nil
 }
 
+// unindex removes the message with the given id from every secondary index
+// in the folder bucket bf. 
+func unindex(bf *bolt.Bucket, id uint64) error {
+	indexes := bf.Bucket(folderIndexBucket)
+	if indexes == nil {
+		return nil
+	}
+	
+	var names [][]byte
+	indexes.ForEach(func(name, _ []byte) error {
+		names = append(names, name)
+		return nil
+	})
+	
+	for _, name := range names {
+		err := setIndex(indexes.Bucket(name), id, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIndex sets the key of the message with the given id in an index bucket.
+func setIndex(index *bolt.Bucket, id uint64, key []byte) error {
+	keys := index.Bucket(folderIndexKeysBucket)
+	ids := index.Bucket(folderIndexIDsBucket)
+	
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	
+	// Remove the old entry. 
+	if old := ids.Get(k); old != nil {
+		old = append([]byte{}, old...)
+		if b := keys.Bucket(old); b != nil {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+			
+			if first, _ := b.Cursor().First(); first == nil {
+				err = keys.DeleteBucket(old)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		
+		err := ids.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	
+	if len(key) == 0 {
+		return nil
+	}
+	
+	b, err := keys.CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	
+	err = b.Put(k, []byte{})
+	if err != nil {
+		return err
+	}
+	
+	return ids.Put(k, key)
+}
+
+// SetIndex sets the key under which the message with the given id is found
+// in the named secondary index.
+func (f *folder) SetIndex(index string, id uint64, key []byte) error {
+	if index == "" {
+		return errors.New("Index name cannot be empty.")
+	}
+	
+	return f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(f.userId).Bucket(foldersBucket).Bucket([]byte(f.name))
+		
+		indexes, err := bucket.CreateBucketIfNotExists(folderIndexBucket)
+		if err != nil {
+			return err
+		}
+		
+		b, err := indexes.CreateBucketIfNotExists([]byte(index))
+		if err != nil {
+			return err
+		}
+		
+		_, err = b.CreateBucketIfNotExists(folderIndexKeysBucket)
+		if err != nil {
+			return err
+		}
+		
+		_, err = b.CreateBucketIfNotExists(folderIndexIDsBucket)
+		if err != nil {
+			return err
+		}
+		
+		return setIndex(b, id, key)
+	})
+}
+
+// Lookup returns the ids of the messages found under the given key in the
+// named secondary index.
+func (f *folder) Lookup(index string, key []byte) ([]uint64, error) {
+	var ids []uint64
+	
+	if len(key) == 0 {
+		return nil, nil
+	}
+	
+	err := f.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(f.userId).Bucket(foldersBucket).Bucket([]byte(f.name))
+		
+		indexes := bucket.Bucket(folderIndexBucket)
+		if indexes == nil {
+			return nil
+		}
+		
+		b := indexes.Bucket([]byte(index))
+		if b == nil {
+			return nil
+		}
+		
+		b = b.Bucket(folderIndexKeysBucket).Bucket(key)
+		if b == nil {
+			return nil
+		}
+		
+		return b.ForEach(func(k, _ []byte) error {
+			ids = append(ids, binary.BigEndian.Uint64(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	
+	return ids, nil
+}
+
+// HasIndex returns whether the named secondary index has been created.
+func (f *folder) HasIndex(index string) bool {
+	var exists bool
+	
+	f.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(f.userId).Bucket(foldersBucket).Bucket([]byte(f.name))
+		
+		if indexes := bucket.Bucket(folderIndexBucket); indexes != nil {
+			exists = indexes.Bucket([]byte(index)) != nil
+		}
+		return nil
+	})
+	
+	return exists
+}
+
+// copyBucket copies the contents of one bucket into another, including 
+// nested buckets. 
+func copyBucket(to, from *bolt.Bucket) error {
+	return from.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return to.Put(k, v)
+		}
+		
+		// It's a bucket.
+		b, err := to.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		
+		return copyBucket(b, from.Bucket(k))
+	})
+}
+
 // Name returns the user-friendly name of the mailbox.
 func (f *folder) Name() string {
 	return f.name
@@ -510,20 +755,10 @@ func (f *folder) SetName(name string) error {
 
 		// Copy everything.
 		oldB := tx.Bucket(f.userId).Bucket(foldersBucket).Bucket([]byte(f.name))
-		oldB.ForEach(func(k, v []byte) error {
-			if v == nil { // It's a bucket.
-				b1, err := b.CreateBucket(k)
-				if err != nil {
-					return err
-				}
-
-				// Copy all keys.
-				return oldB.Bucket(k).ForEach(func(k1, v1 []byte) error {
-					return b1.Put(k1, v1)
-				})
-			}
-			return b.Put(k, v)
-		})
+		err = copyBucket(b, oldB)
+		if err != nil {
+			return err
+		}
 
 		// Delete old mailbox.
 		return tx.Bucket(f.userId).Bucket(foldersBucket).DeleteBucket([]byte(f.name))
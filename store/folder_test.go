@@ -181,6 +181,35 @@ func TestFolder(t *testing.T) {
 		t.Error("Expected ErrDuplicateMailbox got", err)
 	}
 
+	// Secondary indexes must survive renaming.
+	id, _ = mbox.InsertNewMessage([]byte("indexed"), 1)
+	if err = mbox.SetIndex("test", id, []byte("key")); err != nil {
+		t.Error("Got error", err)
+	}
+
+	// Rename the mailbox and back again.
+	newName := "Renamed mailbox"
+	err = u.RenameFolder(name, newName)
+	if err != nil {
+		t.Error("Got error", err)
+	}
+	if _, err = u.FolderByName(name); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound got", err)
+	}
+	mbox, err = u.FolderByName(newName)
+	if err != nil {
+		t.Error("Got error", err)
+	} else if mbox.Name() != newName {
+		t.Errorf("Expected name %s got %s", newName, mbox.Name())
+	}
+	err = u.RenameFolder(newName, name)
+	if err != nil {
+		t.Error("Got error", err)
+	}
+	if ids, _ := mbox.Lookup("test", []byte("key")); len(ids) != 1 || ids[0] != id {
+		t.Errorf("Expected [%d] got %v", id, ids)
+	}
+
 	// Try deleting mailbox.
 	err = u.DeleteFolder(name)
 	if err != nil {
@@ -1,6 +1,7 @@
 package store_test
 
 import (
+	"bytes"
 	"testing"
 	"errors"
 	
@@ -18,6 +19,7 @@ type testFolder struct {
 	name string
 	nextIndex uint64
 	messages map[uint64]message
+	indexes map[string]map[uint64][]byte
 }
 
 func (f *testFolder) Name() string {
@@ -52,6 +54,35 @@ func (f *testFolder) LastID() (uint64, map[uint64]uint64) {
 	return lastId, lastBySuffix
 }
 
+func (f *testFolder) SetIndex(index string, id uint64, key []byte) error {
+	if f.indexes[index] == nil {
+		f.indexes[index] = make(map[uint64][]byte)
+	}
+	
+	if len(key) == 0 {
+		delete(f.indexes[index], id)
+	} else {
+		f.indexes[index][id] = key
+	}
+	return nil
+}
+
+func (f *testFolder) Lookup(index string, key []byte) ([]uint64, error) {
+	var ids []uint64
+	var id uint64
+	
+	for id = 1; id < f.nextIndex; id ++ {
+		if k, ok := f.indexes[index][id]; ok && len(key) > 0 && bytes.Equal(k, key) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (f *testFolder) HasIndex(index string) bool {
+	return f.indexes[index] != nil
+}
+
 func (f *testFolder) InsertNewMessage(msg []byte, suffix uint64) (uint64, error) {
 	if msg == nil {
 		return 0, errors.New("Nil message inserted.")
@@ -84,6 +115,20 @@ func (f *testFolder) InsertMessage(id uint64, msg []byte, suffix uint64) error {
 	return nil
 }
 
+func (f *testFolder) UpdateMessage(id uint64, msg []byte, suffix uint64) error {
+	if msg == nil {
+		return errors.New("Nil message inserted.")
+	}
+	
+	if _, ok := f.messages[id]; !ok {
+		return store.ErrNotFound
+	}
+	
+	f.messages[id] = message{payload : msg, suffix : suffix}
+	
+	return nil
+}
+
 func (f *testFolder) GetMessage(id uint64) (uint64, []byte, error) {
 	if id == 0 || id >= f.nextIndex {
 		return 0, nil, store.ErrNotFound
@@ -107,6 +152,10 @@ func (f *testFolder) DeleteMessage(id uint64) error {
 	
 	delete(f.messages, id)
 	
+	for _, idx := range f.indexes {
+		delete(idx, id)
+	}
+	
 	return nil
 }
 
@@ -148,6 +197,7 @@ func (tc *testFolderTestContext) New() store.Folder {
 		name : "test folder", 
 		nextIndex : 1,
 		messages : make(map[uint64]message), 
+		indexes : make(map[string]map[uint64][]byte),
 	}
 }
 
@@ -266,6 +316,94 @@ func testInterface(tc testContext) {
 	testDeleteMessage(tc, folder, 6, "S")
 	testLastIDBySuffix(tc, folder, 3, 0, "T")
 	testNextLast(tc, folder, 5, 7, "U")
+	
+	testUpdateMessage(tc)
+	testIndex(tc)
+}
+
+func testIndex(tc testContext) {
+	folder := tc.New()
+	
+	if folder.HasIndex("to") {
+		tc.T().Error(tc.Context(), ": new folder should have no indexes.")
+	}
+	
+	id1, _ := folder.InsertNewMessage([]byte("first"), 1)
+	id2, _ := folder.InsertNewMessage([]byte("second"), 1)
+	id3, _ := folder.InsertNewMessage([]byte("third"), 1)
+	
+	for id, key := range map[uint64]string{id1: "alice", id2: "bob", id3: "alice"} {
+		if err := folder.SetIndex("to", id, []byte(key)); err != nil {
+			tc.T().Error(tc.Context(), ": got error ", err)
+		}
+	}
+	if !folder.HasIndex("to") {
+		tc.T().Error(tc.Context(), ": index should exist.")
+	}
+	
+	testLookup(tc, folder, "alice", []uint64{id1, id3}, "A")
+	testLookup(tc, folder, "bob", []uint64{id2}, "B")
+	testLookup(tc, folder, "carol", nil, "C")
+	
+	// Changing the key of a message. 
+	folder.SetIndex("to", id1, []byte("bob"))
+	testLookup(tc, folder, "alice", []uint64{id3}, "D")
+	testLookup(tc, folder, "bob", []uint64{id1, id2}, "E")
+	
+	// Updating a message does not change its keys. 
+	folder.UpdateMessage(id1, []byte("updated"), 1)
+	testLookup(tc, folder, "bob", []uint64{id1, id2}, "F")
+	
+	// Removing a message from an index. 
+	folder.SetIndex("to", id2, nil)
+	testLookup(tc, folder, "bob", []uint64{id1}, "G")
+	
+	// Deleting a message removes it from the index. 
+	folder.DeleteMessage(id3)
+	testLookup(tc, folder, "alice", nil, "H")
+}
+
+func testLookup(tc testContext, folder store.Folder, key string, expected []uint64, note string) {
+	ids, err := folder.Lookup("to", []byte(key))
+	if err != nil {
+		tc.T().Error(tc.Context(), ", ", note, ": got error ", err)
+		return
+	}
+	
+	if len(ids) != len(expected) {
+		tc.T().Error(tc.Context(), ", ", note, ": expected ", expected, " got ", ids)
+		return
+	}
+	
+	for i := range ids {
+		if ids[i] != expected[i] {
+			tc.T().Error(tc.Context(), ", ", note, ": expected ", expected, " got ", ids)
+			return
+		}
+	}
+}
+
+func testUpdateMessage(tc testContext) {
+	folder := tc.New()
+	
+	id1, _ := folder.InsertNewMessage([]byte("first"), 1)
+	id2, _ := folder.InsertNewMessage([]byte("second"), 1)
+	
+	// Updating a message keeps its id. 
+	if err := folder.UpdateMessage(id1, []byte("updated"), 2); err != nil {
+		tc.T().Error(tc.Context(), ": got error ", err)
+	}
+	suffix, msg, err := folder.GetMessage(id1)
+	if err != nil || suffix != 2 || !bytes.Equal(msg, []byte("updated")) {
+		tc.T().Error(tc.Context(), ": update failed: ", suffix, ", ", string(msg), ", ", err)
+	}
+	
+	if err := folder.DeleteMessage(id2); err != nil {
+		tc.T().Error(tc.Context(), ": got error ", err)
+	}
+	if err := folder.UpdateMessage(id2, []byte("gone"), 1); err != store.ErrNotFound {
+		tc.T().Error(tc.Context(), ": expected ", store.ErrNotFound, " got ", err)
+	}
 }
 
 func testNextLast(tc testContext, folder store.Folder, exLast, exNext uint64, note string) {
@@ -0,0 +1,17 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"github.com/boltdb/bolt"
+)
+
+// TstPutRawContact saves a contact as it is given, without encoding or
+// encrypting it.
+func TstPutRawContact(c *Contacts, address string, v []byte) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(c.bucketId).Bucket(contactsBucket).Put([]byte(address), v)
+	})
+}
@@ -1,7 +1,9 @@
 package mem
 
 import (
+	"bytes"
 	"errors"
+	"sort"
 	
 	"github.com/DanielKrawisz/bmagent/store"
 )
@@ -19,6 +21,7 @@ type memFolder struct {
 	nextIndex uint64
 	lastIndexBySuffix map[uint64]uint64
 	messages map[uint64]message
+	indexes map[string]map[uint64][]byte
 }
 
 func NewFolder(name string) *memFolder {
@@ -28,6 +31,7 @@ func NewFolder(name string) *memFolder {
 		nextIndex : 1,
 		messages : make(map[uint64]message), 
 		lastIndexBySuffix : make(map[uint64]uint64),
+		indexes : make(map[string]map[uint64][]byte),
 	}
 }
 
@@ -48,6 +52,53 @@ func (f *memFolder) LastID() (uint64, map[uint64]uint64) {
 	return f.lastIndex, f.lastIndexBySuffix
 }
 
+func (f *memFolder) SetIndex(index string, id uint64, key []byte) error {
+	if index == "" {
+		return errors.New("Index name cannot be empty.")
+	}
+	
+	idx, ok := f.indexes[index]
+	if !ok {
+		idx = make(map[uint64][]byte)
+		f.indexes[index] = idx
+	}
+	
+	if len(key) == 0 {
+		delete(idx, id)
+		return nil
+	}
+	
+	idx[id] = key
+	return nil
+}
+
+type uids []uint64
+
+func (u uids) Len() int { return len(u) }
+func (u uids) Less(i, j int) bool { return u[i] < u[j] }
+func (u uids) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+
+func (f *memFolder) Lookup(index string, key []byte) ([]uint64, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	
+	var ids []uint64
+	for id, k := range f.indexes[index] {
+		if bytes.Equal(k, key) {
+			ids = append(ids, id)
+		}
+	}
+	
+	sort.Sort(uids(ids))
+	return ids, nil
+}
+
+func (f *memFolder) HasIndex(index string) bool {
+	_, ok := f.indexes[index]
+	return ok
+}
+
 func (f *memFolder) updateLast(id, suffix uint64) {
 	
 	if f.lastIndex < id {
@@ -97,6 +148,25 @@ func (f *memFolder) InsertMessage(id uint64, msg []byte, suffix uint64) error {
 	return nil
 }
 
+func (f *memFolder) UpdateMessage(id uint64, msg []byte, suffix uint64) error {
+	if msg == nil {
+		return errors.New("Nil message inserted.")
+	}
+	
+	if _, ok := f.messages[id]; !ok {
+		return store.ErrNotFound
+	}
+	
+	// Remove the old message so that the last indices by suffix are
+	// kept correct if the suffix changes. 
+	f.remove(id)
+	
+	f.updateLast(id, suffix)
+	f.messages[id] = message{payload : msg, suffix : suffix}
+	
+	return nil
+}
+
 func (f *memFolder) GetMessage(id uint64) (uint64, []byte, error) {
 	if id == 0 || id >= f.nextIndex {
 		return 0, nil, store.ErrNotFound
@@ -114,17 +184,26 @@ func (f *memFolder) DeleteMessage(id uint64) error {
 		return store.ErrInvalidID
 	}
 	
-	var suffix uint64
-	if m, ok := f.messages[id]; !ok {
+	if _, ok := f.messages[id]; !ok {
 		return store.ErrNotFound
-	} else {
-		suffix = m.suffix
 	}
 	
+	f.remove(id)
+	
+	for _, idx := range f.indexes {
+		delete(idx, id)
+	}
+	
+	return nil
+}
+
+// remove removes a message and updates the last indices. 
+func (f *memFolder) remove(id uint64) {
+	suffix := f.messages[id].suffix
 	delete(f.messages, id)
 	
 	if f.lastIndexBySuffix[suffix] != id {
-		return nil
+		return
 	}
 	
 	for k := id - 1; k > 0; k -- {
@@ -136,7 +215,7 @@ func (f *memFolder) DeleteMessage(id uint64) error {
 			
 			if m.suffix == suffix {
 				f.lastIndexBySuffix[suffix] = k;
-				return nil
+				return
 			}
 		}
 	}
@@ -148,7 +227,7 @@ func (f *memFolder) DeleteMessage(id uint64) error {
 		f.lastIndex = 0
 	}
 	
-	return nil
+	return
 }
 
 func (f *memFolder) ForEachMessage(lowID, highID, suffix uint64,
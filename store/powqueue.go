@@ -10,25 +10,102 @@ import (
 
 	"github.com/boltdb/bolt"
 	"github.com/DanielKrawisz/bmutil"
+	"github.com/DanielKrawisz/bmutil/wire"
 )
 
-// PowQueue is a FIFO queue for objects that need proof-of-work done on them.
+// Priority classes of the objects in the pow queue. Objects in a higher
+// class are always processed before those in a lower class.
+const (
+	// PowPriorityLow is for broadcasts and objects of unknown type.
+	PowPriorityLow uint8 = iota
+
+	// PowPriorityNormal is for messages and acks.
+	PowPriorityNormal
+
+	// PowPriorityHigh is for pubkeys and getpubkey requests, which other
+	// messages are waiting on.
+	PowPriorityHigh
+)
+
+// PowPriority returns the priority class of an object without its nonce.
+func PowPriority(obj []byte) uint8 {
+	// The object begins with the expiration time (8 bytes) and the
+	// object type (4 bytes).
+	if len(obj) < 12 {
+		return PowPriorityLow
+	}
+
+	switch wire.ObjectType(binary.BigEndian.Uint32(obj[8:12])) {
+	case wire.ObjectTypeGetPubKey, wire.ObjectTypePubKey:
+		return PowPriorityHigh
+	case wire.ObjectTypeMsg:
+		return PowPriorityNormal
+	default:
+		return PowPriorityLow
+	}
+}
+
+// PowQueue is a queue for objects that need proof-of-work done on them.
 // It implements Enqueue, Dequeue and Peek; the most basic queue operations.
+// Since the pow of several elements may be calculated at once, elements are
+// dequeued by index. Elements can also be removed without their pow having
+// been done with Remove.
+//
+// PeekForPow does not simply return the oldest element. Elements are
+// ordered by priority class, and within a class the users take turns, so
+// that one user with many large messages cannot hold up the others. The
+// priority classes and the users' turns are kept in an index alongside the
+// elements, so that the next element is found without reading the others.
+//
+// The index is a bucket for each priority class, which holds the users who
+// have elements in the class in the order of their turns, and for each of
+// them, the indexes of their elements.
 type PowQueue struct {
 	db     *bolt.DB
 	nextIndex uint64
 }
 
+// PowEntry describes an element of the pow queue.
+type PowEntry struct {
+	Index    uint64
+	User     uint32
+	Priority uint8
+	Target   uint64
+	// Progress is the nonce from which its pow calculation will continue.
+	Progress uint64
+}
+
 // newPowQueue creates a new PowQueue object from the provided Store.
 func newPowQueue(db *bolt.DB) (*PowQueue, error) {
-	q := &PowQueue{db: db}
+	q := &PowQueue{
+		db: db,
+	}
 
 	err := db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(powQueueBucket)
 		if err != nil {
 			return err
 		}
-		return nil
+		_, err = tx.CreateBucketIfNotExists(powProgressBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(powTurnsBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(powOrderBucket) != nil {
+			return nil
+		}
+
+		// Index the elements which were queued before there was an index.
+		_, err = tx.CreateBucket(powOrderBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(powQueueBucket).ForEach(func(k, v []byte) error {
+			return addToOrder(tx, PowPriority(v[12:]), v[8:12], k)
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -37,6 +114,118 @@ func newPowQueue(db *bolt.DB) (*PowQueue, error) {
 	return q, nil
 }
 
+// turnKey returns the key of a user in the turn order of a priority class.
+func turnKey(turn []byte, user []byte) []byte {
+	k := make([]byte, 12)
+	copy(k, turn)
+	copy(k[8:], user)
+	return k
+}
+
+// userTurn returns the last turn that a user had, which is zero if the user
+// has never had an element dequeued.
+func userTurn(tx *bolt.Tx, user []byte) []byte {
+	if turn := tx.Bucket(powTurnsBucket).Get(user); turn != nil {
+		return turn
+	}
+	return make([]byte, 8)
+}
+
+// addToOrder adds the element with the given index to the index of the
+// queue.
+func addToOrder(tx *bolt.Tx, priority uint8, user, index []byte) error {
+	class, err := tx.Bucket(powOrderBucket).CreateBucketIfNotExists([]byte{priority})
+	if err != nil {
+		return err
+	}
+
+	users, err := class.CreateBucketIfNotExists(powOrderUsersBucket)
+	if err != nil {
+		return err
+	}
+	entries, err := class.CreateBucketIfNotExists(powOrderEntriesBucket)
+	if err != nil {
+		return err
+	}
+
+	userEntries := entries.Bucket(user)
+	if userEntries == nil {
+		// The user joins the turn order of the class.
+		userEntries, err = entries.CreateBucket(user)
+		if err != nil {
+			return err
+		}
+		err = users.Put(turnKey(userTurn(tx, user), user), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return userEntries.Put(index, []byte{})
+}
+
+// removeFromOrder removes the element with the given index from the index of
+// the queue.
+func removeFromOrder(tx *bolt.Tx, user, index []byte) error {
+	return tx.Bucket(powOrderBucket).ForEach(func(priority, _ []byte) error {
+		class := tx.Bucket(powOrderBucket).Bucket(priority)
+		entries := class.Bucket(powOrderEntriesBucket)
+
+		userEntries := entries.Bucket(user)
+		if userEntries == nil || userEntries.Get(index) == nil {
+			return nil
+		}
+		if err := userEntries.Delete(index); err != nil {
+			return err
+		}
+
+		// The user leaves the turn order of the class if it has nothing
+		// left in it.
+		if k, _ := userEntries.Cursor().First(); k != nil {
+			return nil
+		}
+		if err := entries.DeleteBucket(user); err != nil {
+			return err
+		}
+		return class.Bucket(powOrderUsersBucket).Delete(turnKey(userTurn(tx, user), user))
+	})
+}
+
+// takeTurn gives a user the next turn, which places it after all the other
+// users in the turn order of every priority class.
+func takeTurn(tx *bolt.Tx, user []byte) error {
+	misc := tx.Bucket(miscBucket)
+
+	var last uint64
+	if v := misc.Get(powLastTurnKey); v != nil {
+		last = binary.BigEndian.Uint64(v)
+	}
+	turn := make([]byte, 8)
+	binary.BigEndian.PutUint64(turn, last+1)
+
+	old := userTurn(tx, user)
+	err := tx.Bucket(powOrderBucket).ForEach(func(priority, _ []byte) error {
+		class := tx.Bucket(powOrderBucket).Bucket(priority)
+		if class.Bucket(powOrderEntriesBucket).Bucket(user) == nil {
+			return nil
+		}
+
+		users := class.Bucket(powOrderUsersBucket)
+		if err := users.Delete(turnKey(old, user)); err != nil {
+			return err
+		}
+		return users.Put(turnKey(turn, user), []byte{})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = misc.Put(powLastTurnKey, turn); err != nil {
+		return err
+	}
+	return tx.Bucket(powTurnsBucket).Put(user, turn)
+}
+
 // Enqueue adds an object message with a target value for PoW to the end of the
 // queue. It returns the index value of the stored element.
 func (q *PowQueue) Enqueue(target uint64, user uint32, obj []byte) (uint64, error) {
@@ -59,7 +248,11 @@ func (q *PowQueue) Enqueue(target uint64, user uint32, obj []byte) (uint64, erro
 		if err != nil {
 			return err
 		}
-		return tx.Bucket(powQueueBucket).Put(k, v)
+		err = tx.Bucket(powQueueBucket).Put(k, v)
+		if err != nil {
+			return err
+		}
+		return addToOrder(tx, PowPriority(obj), v[8:12], k)
 	})
 	if err != nil {
 		return 0, err
@@ -68,55 +261,229 @@ func (q *PowQueue) Enqueue(target uint64, user uint32, obj []byte) (uint64, erro
 	return idx, nil
 }
 
-// Dequeue removes the object message at beginning of the queue and returns its
-// index, the user that requested it, and itself.
-func (q *PowQueue) Dequeue() (uint64, uint32, []byte, error) {
-	var idx uint64
+// Dequeue removes the element with the given index from the queue once its
+// pow has been calculated, and returns the user that requested it and the
+// object. ErrNotFound is returned if there is no such element.
+func (q *PowQueue) Dequeue(index uint64) (uint32, []byte, error) {
+	return q.remove(index, true)
+}
+
+// Remove removes the element with the given index from the queue without
+// its pow having been calculated, and returns the user that requested it
+// and the object. ErrNotFound is returned if there is no such element.
+func (q *PowQueue) Remove(index uint64) (uint32, []byte, error) {
+	return q.remove(index, false)
+}
+
+// remove removes the element with the given index from the queue. If done
+// is true, the user who requested it has had its turn.
+func (q *PowQueue) remove(index uint64, done bool) (uint32, []byte, error) {
 	var user uint32
 	var obj []byte
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+
 	err := q.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(powQueueBucket)
 
-		k, v := bucket.Cursor().First()
-		if k == nil || v == nil { // No elements
+		v := bucket.Get(k)
+		if v == nil {
 			return ErrNotFound
 		}
-		idx = binary.BigEndian.Uint64(k)
-		user = binary.BigEndian.Uint32(v[8:12])
+		u := make([]byte, 4)
+		copy(u, v[8:12])
+		user = binary.BigEndian.Uint32(u)
 		obj = make([]byte, len(v[12:]))
 		copy(obj, v[12:])
 
-		return bucket.Delete(k)
+		err := tx.Bucket(powProgressBucket).Delete(k)
+		if err != nil {
+			return err
+		}
+		err = bucket.Delete(k)
+		if err != nil {
+			return err
+		}
+		err = removeFromOrder(tx, u, k)
+		if err != nil || !done {
+			return err
+		}
+		return takeTurn(tx, u)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return user, obj, nil
+}
+
+// SetProgress records that every nonce below next has been tried for the
+// element with the given index, so that its pow calculation can be resumed
+// from there. ErrNotFound is returned if there is no such element.
+func (q *PowQueue) SetProgress(index, next uint64) error {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, next)
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(powQueueBucket).Get(k) == nil {
+			return ErrNotFound
+		}
+		return tx.Bucket(powProgressBucket).Put(k, v)
+	})
+}
+
+// Progress returns the nonce from which to resume the pow calculation of the
+// element with the given index, which is zero if it has not been started.
+// ErrNotFound is returned if there is no such element.
+func (q *PowQueue) Progress(index uint64) (uint64, error) {
+	var next uint64
+
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(powQueueBucket).Get(k) == nil {
+			return ErrNotFound
+		}
+		if v := tx.Bucket(powProgressBucket).Get(k); v != nil {
+			next = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return next, nil
+}
+
+// Entries returns the elements of the queue in the order in which they will
+// be processed if no more are added, taking into account the turns that the
+// users will take.
+func (q *PowQueue) Entries() ([]*PowEntry, error) {
+	var entries []*PowEntry
+
+	err := q.db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(powQueueBucket)
+		progress := tx.Bucket(powProgressBucket)
+		order := tx.Bucket(powOrderBucket)
+
+		// Turns taken while going through the queue.
+		var turn uint64
+		turns := make(map[uint32]uint64)
+
+		cursor := order.Cursor()
+		for priority, _ := cursor.Last(); priority != nil; priority, _ = cursor.Prev() {
+			class := order.Bucket(priority)
+
+			// The elements of each user in the class, in their turn order.
+			var users []uint32
+			userEntries := make(map[uint32][][]byte)
+			err := class.Bucket(powOrderUsersBucket).ForEach(func(k, _ []byte) error {
+				user := binary.BigEndian.Uint32(k[8:])
+				users = append(users, user)
+				return class.Bucket(powOrderEntriesBucket).Bucket(k[8:]).ForEach(func(index, _ []byte) error {
+					userEntries[user] = append(userEntries[user], index)
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			for len(users) > 0 {
+				// The user who has waited longest goes next. Those who have
+				// taken a turn while going through the queue have waited
+				// less than the others, in the order of their turns.
+				next := 0
+				for i, user := range users {
+					if turns[user] < turns[users[next]] {
+						next = i
+					}
+				}
+				user := users[next]
+				index := userEntries[user][0]
+
+				v := queue.Get(index)
+				entry := &PowEntry{
+					Index:    binary.BigEndian.Uint64(index),
+					User:     user,
+					Priority: priority[0],
+					Target:   binary.BigEndian.Uint64(v[:8]),
+				}
+				if p := progress.Get(index); p != nil {
+					entry.Progress = binary.BigEndian.Uint64(p)
+				}
+				entries = append(entries, entry)
+
+				turn++
+				turns[user] = turn
+				userEntries[user] = userEntries[user][1:]
+				if len(userEntries[user]) == 0 {
+					users = append(users[:next], users[next+1:]...)
+				}
+			}
+		}
+		return nil
 	})
 	if err != nil {
-		return 0, 0, nil, err
+		return nil, err
 	}
 
-	return idx, user, obj, nil
+	return entries, nil
 }
 
-// PeekForPow returns the target and hash values for the object that would be
-// removed when Dequeue is run next.
-func (q *PowQueue) PeekForPow() (uint64, []byte, error) {
+// PeekForPow returns the index, priority class, target and hash values for
+// the object which should be processed next. This is the element with the
+// highest priority class. Among those, it belongs to the user who has waited
+// longest since an element of theirs was dequeued, and among those elements
+// it is the oldest. Elements for which skip returns true, such as those
+// already being processed, are ignored. skip can be nil.
+func (q *PowQueue) PeekForPow(skip func(index uint64) bool) (uint64, uint8, uint64, []byte, error) {
+	var idx uint64
+	var priority uint8
 	var target uint64
 	var hash []byte
 
 	err := q.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(powQueueBucket)
+		order := tx.Bucket(powOrderBucket)
+
+		var best []byte
+		classes := order.Cursor()
+		for p, _ := classes.Last(); p != nil && best == nil; p, _ = classes.Prev() {
+			class := order.Bucket(p)
+			entries := class.Bucket(powOrderEntriesBucket)
 
-		k, v := bucket.Cursor().First()
-		if k == nil || v == nil { // No elements
+			users := class.Bucket(powOrderUsersBucket).Cursor()
+			for u, _ := users.First(); u != nil && best == nil; u, _ = users.Next() {
+				indexes := entries.Bucket(u[8:]).Cursor()
+				for k, _ := indexes.First(); k != nil; k, _ = indexes.Next() {
+					if skip == nil || !skip(binary.BigEndian.Uint64(k)) {
+						best = k
+						priority = p[0]
+						break
+					}
+				}
+			}
+		}
+
+		if best == nil { // No elements
 			return ErrNotFound
 		}
 
+		v := tx.Bucket(powQueueBucket).Get(best)
+		idx = binary.BigEndian.Uint64(best)
 		target = binary.BigEndian.Uint64(v[:8])
 		hash = bmutil.Sha512(v[12:])
 		return nil
-
 	})
 	if err != nil {
-		return 0, nil, err
+		return 0, 0, 0, nil, err
 	}
 
-	return target, hash, nil
+	return idx, priority, target, hash, nil
 }
@@ -7,12 +7,14 @@ package store_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/DanielKrawisz/bmagent/store"
 	"github.com/DanielKrawisz/bmutil"
+	"github.com/DanielKrawisz/bmutil/wire"
 )
 
 func TestPowQueue(t *testing.T) {
@@ -40,14 +42,14 @@ func TestPowQueue(t *testing.T) {
 	target1 := uint64(456)
 
 	// PeekForPow should fail.
-	_, _, err = q.PeekForPow()
+	_, _, _, _, err = q.PeekForPow(nil)
 	if err != store.ErrNotFound {
 		t.Errorf("PeekForPow didn't give expected error %v, got %v",
 			store.ErrNotFound, err)
 	}
 
 	// Dequeue should fail.
-	_, _, _, err = q.Dequeue()
+	_, _, err = q.Dequeue(1)
 	if err != store.ErrNotFound {
 		t.Errorf("Dequeue didn't give expected error %v, got %v",
 			store.ErrNotFound, err)
@@ -64,7 +66,7 @@ func TestPowQueue(t *testing.T) {
 	}
 
 	// First PeekForPow.
-	targetT, hashT, err := q.PeekForPow()
+	idxT, _, targetT, hashT, err := q.PeekForPow(nil)
 	if err != nil {
 		t.Error("PeekForPow failed:", err)
 	}
@@ -74,6 +76,9 @@ func TestPowQueue(t *testing.T) {
 	if !bytes.Equal(hash, hashT) {
 		t.Errorf("Expected %v got %v", hash, hashT)
 	}
+	if idx != idxT {
+		t.Errorf("Expected %d got %d", idx, idxT)
+	}
 
 	// Close and re-open database to test if ordering is still preserved.
 	err = s.Close()
@@ -97,7 +102,7 @@ func TestPowQueue(t *testing.T) {
 	}
 
 	// PeekForPow again, should still give same answers.
-	targetT, hashT, err = q.PeekForPow()
+	_, _, targetT, hashT, err = q.PeekForPow(nil)
 	if err != nil {
 		t.Error("PeekForPow failed:", err)
 	}
@@ -109,22 +114,19 @@ func TestPowQueue(t *testing.T) {
 	}
 
 	// First dequeue.
-	idxT, uT, objT, err := q.Dequeue()
+	uT, objT, err := q.Dequeue(idx)
 	if err != nil {
 		t.Error("Dequeue failed:", err)
 	}
 	if !bytes.Equal(obj, objT) {
 		t.Errorf("Expected %v got %v", obj, objT)
 	}
-	if idx != idxT {
-		t.Errorf("Expected %d got %d", idx, idxT)
-	}
 	if u != uT {
 		t.Errorf("Expected %d got %d", u, uT)
 	}
 
 	// Second PeekForPow. Second item should move to first now.
-	targetT, hashT, err = q.PeekForPow()
+	_, _, targetT, hashT, err = q.PeekForPow(nil)
 	if err != nil {
 		t.Error("PeekForPow failed:", err)
 	}
@@ -136,34 +138,88 @@ func TestPowQueue(t *testing.T) {
 	}
 
 	// Second dequeue.
-	idxT, uT, objT, err = q.Dequeue()
+	uT, objT, err = q.Dequeue(idx1)
 	if err != nil {
 		t.Error("Dequeue failed:", err)
 	}
 	if !bytes.Equal(obj1, objT) {
 		t.Errorf("Expected %v got %v", obj1, objT)
 	}
-	if idx1 != idxT {
-		t.Errorf("Expected %d got %d", idx1, idxT)
-	}
 	if u1 != uT {
 		t.Errorf("Expected %d got %d", u1, uT)
 	}
 
 	// PeekForPow should fail.
-	_, _, err = q.PeekForPow()
+	_, _, _, _, err = q.PeekForPow(nil)
 	if err != store.ErrNotFound {
 		t.Errorf("PeekForPow didn't give expected error %v, got %v",
 			store.ErrNotFound, err)
 	}
 
 	// Dequeue should fail.
-	_, _, _, err = q.Dequeue()
+	_, _, err = q.Dequeue(1)
 	if err != store.ErrNotFound {
 		t.Errorf("Dequeue didn't give expected error %v, got %v",
 			store.ErrNotFound, err)
 	}
 
+	// Remove an element from the middle of the queue.
+	idx, _ = q.Enqueue(target, u, obj)
+	idx1, _ = q.Enqueue(target1, u1, obj1)
+	idx2, _ := q.Enqueue(target, u, obj)
+	uT, objT, err = q.Remove(idx1)
+	if err != nil {
+		t.Error("Remove failed:", err)
+	}
+	if u1 != uT || !bytes.Equal(obj1, objT) {
+		t.Errorf("Expected %d, %v got %d, %v", u1, obj1, uT, objT)
+	}
+	_, _, err = q.Remove(idx1)
+	if err != store.ErrNotFound {
+		t.Errorf("Remove didn't give expected error %v, got %v",
+			store.ErrNotFound, err)
+	}
+	if idxT, _, _, _, _ = q.PeekForPow(nil); idxT != idx {
+		t.Errorf("Expected %d got %d", idx, idxT)
+	}
+
+	// Progress is kept until the element is removed.
+	if next, err := q.Progress(idx2); err != nil || next != 0 {
+		t.Errorf("Expected progress 0, got %d, %v", next, err)
+	}
+	if err = q.SetProgress(idx2, 1000); err != nil {
+		t.Error("SetProgress failed:", err)
+	}
+	if next, err := q.Progress(idx2); err != nil || next != 1000 {
+		t.Errorf("Expected progress 1000, got %d, %v", next, err)
+	}
+	if err = q.SetProgress(idx1, 1000); err != store.ErrNotFound {
+		t.Errorf("SetProgress didn't give expected error %v, got %v",
+			store.ErrNotFound, err)
+	}
+	if _, err = q.Progress(idx1); err != store.ErrNotFound {
+		t.Errorf("Progress didn't give expected error %v, got %v",
+			store.ErrNotFound, err)
+	}
+
+	// Elements being processed can be skipped.
+	idxT, _, _, _, _ = q.PeekForPow(func(index uint64) bool {
+		return index == idx
+	})
+	if idxT != idx2 {
+		t.Errorf("Expected %d got %d", idx2, idxT)
+	}
+	if _, _, err = q.Dequeue(idx2); err != nil {
+		t.Error("Dequeue failed:", err)
+	}
+	if _, err = q.Progress(idx2); err != store.ErrNotFound {
+		t.Errorf("Progress didn't give expected error %v, got %v",
+			store.ErrNotFound, err)
+	}
+	if idxT, _, _, _, _ = q.PeekForPow(nil); idxT != idx {
+		t.Errorf("Expected %d got %d", idx, idxT)
+	}
+
 	// Close database.
 	err = s.Close()
 	if err != nil {
@@ -171,3 +227,91 @@ func TestPowQueue(t *testing.T) {
 	}
 	os.Remove(fName)
 }
+
+// testObject returns an object of the given type without its nonce.
+func testObject(objType wire.ObjectType, payload string) []byte {
+	obj := make([]byte, 12+len(payload))
+	binary.BigEndian.PutUint32(obj[8:12], uint32(objType))
+	copy(obj[12:], payload)
+	return obj
+}
+
+func TestPowQueuePriority(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	s, q, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// User 1 sends several messages, then user 2 sends one.
+	msg1, _ := q.Enqueue(1, 1, testObject(wire.ObjectTypeMsg, "a"))
+	msg2, _ := q.Enqueue(1, 1, testObject(wire.ObjectTypeMsg, "b"))
+	msg3, _ := q.Enqueue(1, 2, testObject(wire.ObjectTypeMsg, "c"))
+	broadcast, _ := q.Enqueue(1, 2, testObject(wire.ObjectTypeBroadcast, "d"))
+
+	// A getpubkey request goes before everything else.
+	getpubkey, _ := q.Enqueue(1, 1, testObject(wire.ObjectTypeGetPubKey, "e"))
+
+	// Entries gives the order in which the elements are processed.
+	entries, err := q.Entries()
+	if err != nil {
+		t.Fatal("Entries failed: ", err)
+	}
+	order := []uint64{getpubkey, msg3, msg1, msg2, broadcast}
+	if len(entries) != len(order) {
+		t.Fatalf("Expected %d entries, got %d", len(order), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Index != order[i] {
+			t.Errorf("Entry %d: expected index %d, got %d", i, order[i], entry.Index)
+		}
+	}
+
+	tests := []struct {
+		index    uint64
+		priority uint8
+	}{
+		{getpubkey, store.PowPriorityHigh},
+		// User 1 has just been served, so it is user 2's turn.
+		{msg3, store.PowPriorityNormal},
+		{msg1, store.PowPriorityNormal},
+		{msg2, store.PowPriorityNormal},
+		{broadcast, store.PowPriorityLow},
+	}
+
+	for i, test := range tests {
+		index, priority, _, _, err := q.PeekForPow(nil)
+		if err != nil {
+			t.Fatalf("%d: PeekForPow failed: %v", i, err)
+		}
+		if index != test.index || priority != test.priority {
+			t.Errorf("%d: expected index %d with priority %d, got %d with %d",
+				i, test.index, test.priority, index, priority)
+		}
+		if _, _, err = q.Dequeue(index); err != nil {
+			t.Errorf("%d: Dequeue failed: %v", i, err)
+		}
+
+		// Users' turns are kept when the database is re-opened.
+		if i == 0 {
+			s.Close()
+			l, err = store.Open(fName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, q, _, err = l.Construct([]byte("password"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s.Close()
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Publications keeps track of when the public key of each of a user's
+// identities was last published to the Bitmessage network and when that
+// publication expires, so that it can be published again before it expires
+// and requests for it can be ignored while it is still valid. A pubkey only
+// counts as published once it has been sent; while its proof-of-work is
+// being done, it is kept in memory as queued.
+type Publications struct {
+	db       *bolt.DB
+	bucketId []byte // The name of the user's bucket.
+	mtx      sync.Mutex
+	queued   map[string]*queuedPubkey // Indexed by the object without nonce.
+}
+
+// queuedPubkey is a pubkey which is waiting for its proof-of-work.
+type queuedPubkey struct {
+	addr    string
+	expires time.Time
+}
+
+// newPublications creates a new Publications object after doing the
+// necessary initialization.
+func newPublications(db *bolt.DB, bucketId []byte) (*Publications, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(bucketId).CreateBucketIfNotExists(pubkeyPublicationsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Publications{
+		db:       db,
+		bucketId: bucketId,
+		queued:   make(map[string]*queuedPubkey),
+	}, nil
+}
+
+// encodePublication encodes the publication and expiry times of a pubkey as
+// two big-endian Unix times in seconds.
+func encodePublication(published, expires time.Time) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[:8], uint64(published.Unix()))
+	binary.BigEndian.PutUint64(v[8:], uint64(expires.Unix()))
+	return v
+}
+
+// decodePublication decodes a value encoded by encodePublication. ok is false
+// if the value cannot be decoded, in which case the entry is treated as
+// missing so that the pubkey is published again.
+func decodePublication(v []byte) (published, expires time.Time, ok bool) {
+	if len(v) != 16 {
+		return time.Time{}, time.Time{}, false
+	}
+	published = time.Unix(int64(binary.BigEndian.Uint64(v[:8])), 0)
+	expires = time.Unix(int64(binary.BigEndian.Uint64(v[8:])), 0)
+	return published, expires, true
+}
+
+// Set records the time that the public key of the given address was
+// published and the time that the published pubkey expires.
+func (p *Publications) Set(addr string, published, expires time.Time) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(p.bucketId).Bucket(pubkeyPublicationsBucket).Put(
+			[]byte(addr), encodePublication(published, expires))
+	})
+}
+
+// LastPublished returns the time that the public key of the given address was
+// last published and the time that it expires. If it has never been
+// published, an ErrNotFound is returned.
+func (p *Publications) LastPublished(addr string) (published, expires time.Time, err error) {
+	err = p.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(p.bucketId).Bucket(pubkeyPublicationsBucket).Get([]byte(addr))
+		var ok bool
+		published, expires, ok = decodePublication(v)
+		if !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return published, expires, nil
+}
+
+// Queue records that the given pubkey object, without its nonce, has been
+// queued for proof-of-work in order to publish the public key of addr.
+func (p *Publications) Queue(addr string, obj []byte, expires time.Time) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.queued[string(obj)] = &queuedPubkey{
+		addr:    addr,
+		expires: expires,
+	}
+}
+
+// Unqueue forgets a pubkey object that was given to Queue, for example
+// because it could not be sent.
+func (p *Publications) Unqueue(obj []byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.queued, string(obj))
+}
+
+// IsQueued returns whether a pubkey for the given address is waiting for
+// its proof-of-work. Queued pubkeys which have expired are forgotten.
+func (p *Publications) IsQueued(addr string) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+	queued := false
+	for obj, q := range p.queued {
+		if now.After(q.expires) {
+			delete(p.queued, obj)
+			continue
+		}
+		if q.addr == addr {
+			queued = true
+		}
+	}
+	return queued
+}
+
+// Sent records that a pubkey object which was given to Queue has been sent
+// at the given time and returns the address that it belongs to. An
+// ErrNotFound is returned if the object was not queued.
+func (p *Publications) Sent(obj []byte, sent time.Time) (string, error) {
+	p.mtx.Lock()
+	q, ok := p.queued[string(obj)]
+	delete(p.queued, string(obj))
+	p.mtx.Unlock()
+
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return q.addr, p.Set(q.addr, sent, q.expires)
+}
+
+// Remove removes an address from the store.
+func (p *Publications) Remove(addr string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(p.bucketId).Bucket(pubkeyPublicationsBucket).Delete([]byte(addr))
+	})
+}
+
+// ForEach runs the specified function for each address in the store along
+// with the time its public key was last published and the time that it
+// expires, breaking early if an error occurs.
+func (p *Publications) ForEach(f func(addr string, published, expires time.Time) error) error {
+	return p.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(p.bucketId).Bucket(pubkeyPublicationsBucket)
+		return bucket.ForEach(func(k, v []byte) error {
+			published, expires, ok := decodePublication(v)
+			if !ok {
+				return nil
+			}
+			return f(string(k), published, expires)
+		})
+	})
+}
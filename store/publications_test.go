@@ -0,0 +1,198 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+func TestPublications(t *testing.T) {
+	// Open store.
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := u.Publications
+
+	addr1 := "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+	addr2 := "BM-2DAV89w336ovy6BUJnfVRD5B9qipFbRgmr"
+
+	// Check if a non-existing address returns correct error.
+	_, _, err = p.LastPublished(addr1)
+	if err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	// Times are stored to the second.
+	t1 := time.Unix(time.Now().Add(-time.Hour).Unix(), 0)
+	t2 := time.Unix(time.Now().Unix(), 0)
+	expiry := time.Hour * 24
+	if err = p.Set(addr1, t1, t1.Add(expiry)); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Set(addr2, t1, t1.Add(expiry)); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Set(addr2, t2, t2.Add(expiry)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Time{addr1: t1, addr2: t2}
+	count := 0
+	err = p.ForEach(func(addr string, published, expires time.Time) error {
+		count++
+		if !published.Equal(expected[addr]) {
+			t.Errorf("For address %s expected %s got %s", addr, expected[addr], published)
+		}
+		if !expires.Equal(expected[addr].Add(expiry)) {
+			t.Errorf("For address %s expected expiry %s got %s", addr,
+				expected[addr].Add(expiry), expires)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("Got error", err)
+	}
+	if count != 2 {
+		t.Errorf("For count, expected %v got %v", 2, count)
+	}
+
+	// Publication times should persist after the store is reopened.
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err = l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err = s.GetUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = u.Publications
+
+	published, expires, err := p.LastPublished(addr2)
+	if err != nil {
+		t.Error("Got error", err)
+	} else if !published.Equal(t2) || !expires.Equal(t2.Add(expiry)) {
+		t.Errorf("Expected %s, %s got %s, %s", t2, t2.Add(expiry), published, expires)
+	}
+
+	if err = p.Remove(addr1); err != nil {
+		t.Error("Got error", err)
+	}
+	_, _, err = p.LastPublished(addr1)
+	if err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueuedPublications(t *testing.T) {
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := u.Publications
+
+	addr := "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+	obj1 := []byte("first pubkey")
+	obj2 := []byte("second pubkey")
+	expires := time.Unix(time.Now().Add(time.Hour*24).Unix(), 0)
+
+	// A pubkey which is queued but not sent has not been published.
+	p.Queue(addr, obj1, expires)
+	if !p.IsQueued(addr) {
+		t.Error("Expected pubkey to be queued.")
+	}
+	if _, _, err = p.LastPublished(addr); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	// A pubkey which could not be sent is no longer queued.
+	p.Unqueue(obj1)
+	if p.IsQueued(addr) {
+		t.Error("Expected pubkey not to be queued.")
+	}
+	if _, err = p.Sent(obj1, time.Now()); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	if _, _, err = p.LastPublished(addr); err != store.ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	// The publication time is the time that the pubkey was sent.
+	p.Queue(addr, obj2, expires)
+	sent := time.Unix(time.Now().Add(time.Minute).Unix(), 0)
+	a, err := p.Sent(obj2, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != addr {
+		t.Errorf("Expected address %s got %s", addr, a)
+	}
+	if p.IsQueued(addr) {
+		t.Error("Expected pubkey not to be queued.")
+	}
+	published, exp, err := p.LastPublished(addr)
+	if err != nil {
+		t.Error("Got error", err)
+	} else if !published.Equal(sent) || !exp.Equal(expires) {
+		t.Errorf("Expected %s, %s got %s, %s", sent, expires, published, exp)
+	}
+
+	// Queued pubkeys which have expired are forgotten.
+	p.Queue(addr, obj1, time.Now().Add(-time.Second))
+	if p.IsQueued(addr) {
+		t.Error("Expected expired pubkey not to be queued.")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/DanielKrawisz/bmutil"
+)
+
+// FilterMode determines which of the user's lists decides whether a sender is
+// blocked.
+type FilterMode byte
+
+const (
+	// BlacklistMode blocks the senders on the blacklist.
+	BlacklistMode FilterMode = iota
+
+	// WhitelistMode blocks the senders which are not on the whitelist.
+	WhitelistMode
+)
+
+// String returns the name of the mode.
+func (m FilterMode) String() string {
+	if m == WhitelistMode {
+		return "whitelist"
+	}
+	return "blacklist"
+}
+
+// ParseFilterMode returns the mode with the given name.
+func ParseFilterMode(name string) (FilterMode, error) {
+	switch strings.ToLower(name) {
+	case "blacklist":
+		return BlacklistMode, nil
+	case "whitelist":
+		return WhitelistMode, nil
+	}
+	return 0, ErrInvalidMode
+}
+
+// FilterAction is what is done with messages from blocked senders.
+type FilterAction byte
+
+const (
+	// DropBlocked drops messages from blocked senders without
+	// acknowledging them.
+	DropBlocked FilterAction = iota
+
+	// JunkBlocked files messages from blocked senders in the Junk folder.
+	JunkBlocked
+)
+
+// String returns the name of the action.
+func (a FilterAction) String() string {
+	if a == JunkBlocked {
+		return "junk"
+	}
+	return "drop"
+}
+
+// ParseFilterAction returns the action with the given name.
+func ParseFilterAction(name string) (FilterAction, error) {
+	switch strings.ToLower(name) {
+	case "drop":
+		return DropBlocked, nil
+	case "junk":
+		return JunkBlocked, nil
+	}
+	return 0, ErrInvalidMode
+}
+
+var (
+	// ErrInvalidMode is returned when a filter mode or action is not
+	// recognized.
+	ErrInvalidMode = errors.New("invalid filter mode")
+
+	filterModeKey   = []byte("mode")
+	filterActionKey = []byte("action")
+)
+
+// AddressList is a list of Bitmessage addresses, each with an optional
+// label.
+type AddressList struct {
+	db       *bolt.DB
+	bucketId []byte // The name of the user's bucket.
+	name     []byte // The name of the list's bucket.
+}
+
+// list returns the bucket of the list.
+func (l *AddressList) list(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket(l.bucketId).Bucket(senderFilterBucket).Bucket(l.name)
+}
+
+// Add adds an address to the list with the given label, which may be empty.
+// If the address is already in the list, its label is replaced.
+func (l *AddressList) Add(address, label string) error {
+	if _, err := bmutil.DecodeAddress(address); err != nil {
+		return err
+	}
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return l.list(tx).Put([]byte(address), []byte(label))
+	})
+}
+
+// Remove removes an address from the list. ErrNotFound is returned if it is
+// not in the list.
+func (l *AddressList) Remove(address string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		bucket := l.list(tx)
+		if bucket.Get([]byte(address)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(address))
+	})
+}
+
+// Contains returns whether the address is in the list.
+func (l *AddressList) Contains(address string) (bool, error) {
+	var found bool
+	err := l.db.View(func(tx *bolt.Tx) error {
+		found = l.list(tx).Get([]byte(address)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// ForEach runs the specified function for each address in the list with its
+// label, breaking early if an error occurs.
+func (l *AddressList) ForEach(f func(address, label string) error) error {
+	return l.db.View(func(tx *bolt.Tx) error {
+		return l.list(tx).ForEach(func(k, v []byte) error {
+			return f(string(k), string(v))
+		})
+	})
+}
+
+// SenderFilter decides which senders' messages are blocked. In blacklist
+// mode, the senders on the blacklist are blocked. In whitelist mode, only
+// the senders on the whitelist are accepted. The action determines whether
+// the messages of blocked senders are dropped or filed as junk.
+type SenderFilter struct {
+	Blacklist *AddressList
+	Whitelist *AddressList
+	db        *bolt.DB
+	bucketId  []byte // The name of the user's bucket.
+}
+
+// newSenderFilter creates a new SenderFilter object after doing the necessary
+// initialization.
+func newSenderFilter(db *bolt.DB, bucketId []byte) (*SenderFilter, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketId).CreateBucketIfNotExists(senderFilterBucket)
+		if err != nil {
+			return err
+		}
+		if _, err = bucket.CreateBucketIfNotExists(blacklistBucket); err != nil {
+			return err
+		}
+		_, err = bucket.CreateBucketIfNotExists(whitelistBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SenderFilter{
+		Blacklist: &AddressList{db: db, bucketId: bucketId, name: blacklistBucket},
+		Whitelist: &AddressList{db: db, bucketId: bucketId, name: whitelistBucket},
+		db:        db,
+		bucketId:  bucketId,
+	}, nil
+}
+
+// setting reads a setting which is stored as a single byte. It is zero if
+// it has not been set.
+func (f *SenderFilter) setting(key []byte) (byte, error) {
+	var v byte
+	err := f.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(f.bucketId).Bucket(senderFilterBucket).Get(key)
+		if len(b) == 1 {
+			v = b[0]
+		}
+		return nil
+	})
+	return v, err
+}
+
+// setSetting saves a setting which is stored as a single byte.
+func (f *SenderFilter) setSetting(key []byte, v byte) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(f.bucketId).Bucket(senderFilterBucket).Put(key, []byte{v})
+	})
+}
+
+// Mode returns the filter mode. It is BlacklistMode unless it has been set.
+func (f *SenderFilter) Mode() (FilterMode, error) {
+	v, err := f.setting(filterModeKey)
+	return FilterMode(v), err
+}
+
+// SetMode sets the filter mode.
+func (f *SenderFilter) SetMode(mode FilterMode) error {
+	if mode != BlacklistMode && mode != WhitelistMode {
+		return ErrInvalidMode
+	}
+	return f.setSetting(filterModeKey, byte(mode))
+}
+
+// Action returns what is done with messages from blocked senders. It is
+// DropBlocked unless it has been set.
+func (f *SenderFilter) Action() (FilterAction, error) {
+	v, err := f.setting(filterActionKey)
+	return FilterAction(v), err
+}
+
+// SetAction sets what is done with messages from blocked senders.
+func (f *SenderFilter) SetAction(action FilterAction) error {
+	if action != DropBlocked && action != JunkBlocked {
+		return ErrInvalidMode
+	}
+	return f.setSetting(filterActionKey, byte(action))
+}
+
+// Blocked returns whether messages from the given address are blocked.
+func (f *SenderFilter) Blocked(address string) (bool, error) {
+	mode, err := f.Mode()
+	if err != nil {
+		return false, err
+	}
+
+	if mode == WhitelistMode {
+		listed, err := f.Whitelist.Contains(address)
+		return !listed, err
+	}
+	return f.Blacklist.Contains(address)
+}
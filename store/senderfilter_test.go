@@ -0,0 +1,135 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+func TestSenderFilter(t *testing.T) {
+	// Open store.
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := u.SenderFilter
+
+	addr1 := "BM-2DB6AzjZvzM8NkS3HMYWMP9R1Rt778mhN8"
+	addr2 := "BM-2DAV89w336ovy6BUJnfVRD5B9qipFbRgmr"
+
+	// The filter starts in blacklist mode with empty lists, so nobody is
+	// blocked and blocked messages are dropped.
+	if mode, err := filter.Mode(); err != nil || mode != store.BlacklistMode {
+		t.Errorf("Expected blacklist mode, got %v, %v", mode, err)
+	}
+	if action, err := filter.Action(); err != nil || action != store.DropBlocked {
+		t.Errorf("Expected drop action, got %v, %v", action, err)
+	}
+	if blocked, err := filter.Blocked(addr1); err != nil || blocked {
+		t.Errorf("Expected %s not to be blocked, got %v, %v", addr1, blocked, err)
+	}
+
+	// Invalid addresses cannot be added.
+	if err = filter.Blacklist.Add("BM-moo", ""); err == nil {
+		t.Error("Expected error adding invalid address")
+	}
+
+	if err = filter.Blacklist.Add(addr1, "spammer"); err != nil {
+		t.Fatal(err)
+	}
+	if err = filter.Whitelist.Add(addr2, "friend"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := filter.Blocked(addr1); err != nil || !blocked {
+		t.Errorf("Expected %s to be blocked, got %v, %v", addr1, blocked, err)
+	}
+	if blocked, err := filter.Blocked(addr2); err != nil || blocked {
+		t.Errorf("Expected %s not to be blocked, got %v, %v", addr2, blocked, err)
+	}
+
+	// Switch to whitelist mode and file blocked messages as junk.
+	if err = filter.SetMode(store.WhitelistMode); err != nil {
+		t.Fatal(err)
+	}
+	if err = filter.SetAction(store.JunkBlocked); err != nil {
+		t.Fatal(err)
+	}
+	if err = filter.SetMode(store.FilterMode(7)); err != store.ErrInvalidMode {
+		t.Errorf("Expected ErrInvalidMode, got %v", err)
+	}
+	if action, err := filter.Action(); err != nil || action != store.JunkBlocked {
+		t.Errorf("Expected junk action, got %v, %v", action, err)
+	}
+	if blocked, err := filter.Blocked(addr1); err != nil || !blocked {
+		t.Errorf("Expected %s to be blocked, got %v, %v", addr1, blocked, err)
+	}
+	if blocked, err := filter.Blocked(addr2); err != nil || blocked {
+		t.Errorf("Expected %s not to be blocked, got %v, %v", addr2, blocked, err)
+	}
+
+	// Remove from the whitelist.
+	if err = filter.Whitelist.Remove(addr2); err != nil {
+		t.Fatal(err)
+	}
+	if err = filter.Whitelist.Remove(addr2); err != store.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if blocked, err := filter.Blocked(addr2); err != nil || !blocked {
+		t.Errorf("Expected %s to be blocked, got %v, %v", addr2, blocked, err)
+	}
+
+	// Settings and lists persist when the store is reopened.
+	s.Close()
+	l, err = store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err = l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	u, err = s.GetUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter = u.SenderFilter
+
+	if mode, err := filter.Mode(); err != nil || mode != store.WhitelistMode {
+		t.Errorf("Expected whitelist mode, got %v, %v", mode, err)
+	}
+	labels := make(map[string]string)
+	err = filter.Blacklist.ForEach(func(address, label string) error {
+		labels[address] = label
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 1 || labels[addr1] != "spammer" {
+		t.Errorf("Unexpected blacklist %v", labels)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+)
+
+// sieveScriptKey is the key of the user's script in the sieve bucket.
+var sieveScriptKey = []byte("script")
+
+// SieveScript is the Sieve script which files the user's incoming messages.
+// It is stored as it was written, encrypted with the master key, and is
+// parsed by the sieve package.
+type SieveScript struct {
+	masterKey *[keySize]byte // can be nil.
+	db        *bolt.DB
+	bucketId  []byte // The name of the user's bucket.
+}
+
+// newSieveScript creates a new SieveScript object after doing the necessary
+// initialization.
+func newSieveScript(masterKey *[keySize]byte, db *bolt.DB, bucketId []byte) (*SieveScript, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(bucketId).CreateBucketIfNotExists(sieveBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SieveScript{
+		masterKey: masterKey,
+		db:        db,
+		bucketId:  bucketId,
+	}, nil
+}
+
+// Get returns the script, or the empty string if the user has none.
+func (s *SieveScript) Get() (string, error) {
+	var script string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.bucketId).Bucket(sieveBucket).Get(sieveScriptKey)
+		if v == nil {
+			return nil
+		}
+
+		data, ok := decrypt(s.masterKey, s.db, v)
+		if !ok {
+			return errors.New("Unable to decrypt Sieve script.")
+		}
+		script = string(data)
+		return nil
+	})
+	return script, err
+}
+
+// Set replaces the script. An empty script removes it.
+func (s *SieveScript) Set(script string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucketId).Bucket(sieveBucket)
+		if script == "" {
+			return bucket.Delete(sieveScriptKey)
+		}
+
+		enc, err := encrypt(s.masterKey, s.db, []byte(script))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(sieveScriptKey, enc)
+	})
+}
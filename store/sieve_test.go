@@ -0,0 +1,64 @@
+// Copyright 2016 Daniel Krawisz.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/DanielKrawisz/bmagent/store"
+)
+
+func TestSieveScript(t *testing.T) {
+	// Open store.
+	f, err := ioutil.TempFile("", "tempstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fName := f.Name()
+	f.Close()
+	defer os.Remove(fName)
+
+	l, err := store.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _, _, err := l.Construct([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u, err := s.NewUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sieve := u.SieveScript
+
+	// There is no script at first.
+	script, err := sieve.Get()
+	if err != nil || script != "" {
+		t.Errorf("Expected no script, got %q, %v", script, err)
+	}
+
+	expected := "require \"fileinto\";\r\nfileinto \"Archive\";\r\n"
+	if err = sieve.Set(expected); err != nil {
+		t.Fatal(err)
+	}
+	script, err = sieve.Get()
+	if err != nil || script != expected {
+		t.Errorf("Expected %q, got %q, %v", expected, script, err)
+	}
+
+	// An empty script removes it.
+	if err = sieve.Set(""); err != nil {
+		t.Fatal(err)
+	}
+	script, err = sieve.Get()
+	if err != nil || script != "" {
+		t.Errorf("Expected no script, got %q, %v", script, err)
+	}
+}